@@ -1,7 +1,13 @@
 package ker
 
 import (
+	"context"
+	"errors"
+	"log"
 	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Curton/GoMatchingKernel/types"
 )
@@ -11,6 +17,48 @@ func SetSaveOrderLog(v bool) {
 	saveOrderLog = v
 }
 
+// SetWALRotation sets when the active WAL segment is sealed and replaced by a new one: once it holds
+// maxBytes or is maxAge old, checked before each write. A zero value disables that limit.
+func SetWALRotation(maxBytes int64, maxAge time.Duration) {
+	walSegmentSize = maxBytes
+	walSegmentAge = maxAge
+}
+
+// SetWALRetention controls whether the sealed WAL segments whose records are all covered by a snapshot
+// are deleted once the snapshot is durable. The manifest keeps the sequence the snapshot covers.
+// The WAL shared by the books of an Exchange is never deleted, Exchange.Recover reads it from its start.
+func SetWALRetention(v bool) {
+	walRetention = v
+}
+
+// SetWALDurability sets when the WAL is fsynced, for the logs created afterwards. With WAL_GROUP_COMMIT a
+// group is fsynced once it holds maxRecords records or its first order waited maxWait. The orders of a
+// group are applied one at a time as they arrive, their acks and events are held until the fsync.
+func SetWALDurability(mode WALDurability, maxRecords int, maxWait time.Duration) {
+	walDurability = mode
+	walGroupRecords = maxRecords
+	walGroupInterval = maxWait
+}
+
+// SetSnapshotPolicy sets when the periodic snapshots of the redo kernel and of the engines enabling them
+// are taken: once interval elapsed or records WAL records of the book were written since the last one, a
+// zero value disables that trigger. No snapshot is taken if no record of the book was written since the last
+// one, the records of the other books of an Exchange don't count. The keep newest
+// snapshots of a directory are kept, older ones are deleted once the newer ones are read back complete,
+// 0 keeps them all.
+func SetSnapshotPolicy(interval time.Duration, records uint64, keep int) {
+	snapshotInterval = interval
+	snapshotRecords = records
+	snapshotKeep = keep
+}
+
+// SetSnapshotDeltas has up to n periodic snapshots in a row hold only the price levels changed since the
+// previous one, the last of a chain is then compacted with its chain into a full snapshot. Pruning keeps
+// the snapshots a kept delta applies to, 0 takes full snapshots only.
+func SetSnapshotDeltas(n int) {
+	snapshotDeltas = n
+}
+
 // PriceLevel represents a single price level in the order book.
 type PriceLevel struct {
 	Price int64 `json:"price"`
@@ -28,12 +76,70 @@ type MatchResult struct {
 	TakerOrder     types.KernelOrder
 	MakerOrders    []types.KernelOrder
 	MatchedSizeMap map[uint64]int64
+	// Summary of a mass-cancel request, nil for other results
+	MassCancel *MassCancelReport
+	// Set when TakerOrder is a pegged order that moved, nil for other results
+	Reprice *PegReprice
+	// QuoteBudget - FilledTotal of a quote-budget TakerOrder, final once TakerOrder is no longer open
+	BudgetLeft int64
+	// Trades of this result with their fees, nil for results without trade
+	Fills []Fill
+	// Ledger entries settling Fills, nil without ledger
+	Postings []Posting
+}
+
+// newMatchResult copies an internal matchedInfo, so that callers never share memory with the kernel.
+func newMatchResult(mi *matchedInfo) MatchResult {
+	makerOrders := make([]types.KernelOrder, len(mi.makerOrders))
+	copy(makerOrders, mi.makerOrders)
+	sizeMap := make(map[uint64]int64, len(mi.matchedSizeMap))
+	maps.Copy(sizeMap, mi.matchedSizeMap)
+	var report *MassCancelReport
+	if mi.massCancelReport != nil {
+		r := *mi.massCancelReport
+		report = &r
+	}
+	var reprice *PegReprice
+	if mi.reprice != nil {
+		r := *mi.reprice
+		reprice = &r
+	}
+	var budgetLeft int64
+	if mi.takerOrder.QuoteBudget != 0 {
+		budgetLeft = mi.takerOrder.QuoteBudget - mi.takerOrder.FilledTotal
+	}
+	var fills []Fill
+	if mi.fills != nil {
+		fills = make([]Fill, len(mi.fills))
+		copy(fills, mi.fills)
+	}
+	var postings []Posting
+	if mi.postings != nil {
+		postings = make([]Posting, len(mi.postings))
+		copy(postings, mi.postings)
+	}
+	return MatchResult{
+		TakerOrder:     mi.takerOrder,
+		MakerOrders:    makerOrders,
+		MatchedSizeMap: sizeMap,
+		MassCancel:     report,
+		Reprice:        reprice,
+		BudgetLeft:     budgetLeft,
+		Fills:          fills,
+		Postings:       postings,
+	}
 }
 
 // MatchingEngine is the exported wrapper around the internal matching kernel.
 type MatchingEngine struct {
 	s             *scheduler
 	matchResultCh chan MatchResult
+	errorCh       chan error
+	dropped       atomic.Uint64 // errors dropped as errorCh was full
+	bridges       sync.WaitGroup
+	started       bool
+	snapshot      bool // take a snapshot on Shutdown
+	closeOnce     sync.Once
 }
 
 // NewMatchingEngine creates a new matching engine instance.
@@ -41,37 +147,255 @@ func NewMatchingEngine(serverID uint64, desc string) *MatchingEngine {
 	return &MatchingEngine{
 		s:             initAcceptor(serverID, desc),
 		matchResultCh: make(chan MatchResult, 256),
+		errorCh:       make(chan error, 256),
+	}
+}
+
+// SetInstrument sets the reference data every new order is validated against.
+// Orders failing validation are reported on ErrorInfoChan as *OrderRejectErr.
+// Must be called before Start.
+func (e *MatchingEngine) SetInstrument(ins *types.Instrument) error {
+	if err := ins.Validate(); err != nil {
+		return err
 	}
+	e.s.setInstrument(ins)
+	return nil
+}
+
+// SetFeeSchedule sets the fees attached to every fill. Must be called before Start.
+func (e *MatchingEngine) SetFeeSchedule(fs *types.FeeSchedule) error {
+	if err := fs.Validate(); err != nil {
+		return err
+	}
+	if err := checkFeeCurrency(fs, e.s.kernel.quote); err != nil {
+		return err
+	}
+	e.s.kernel.fees = fs
+	return nil
+}
+
+// EnableLedger makes every new order reserve funds of its account, quote for bids and base for asks,
+// and settles the trades between the accounts. Orders without enough funds are rejected with
+// types.REJECT_INSUFFICIENT_FUNDS, orders without account with types.REJECT_NO_ACCOUNT. Fees must be
+// charged in quote. Must be called before Start.
+func (e *MatchingEngine) EnableLedger(base, quote string) error {
+	if base == "" || quote == "" || base == quote {
+		return errors.New("ledger: base and quote must be two different assets")
+	}
+	if err := checkFeeCurrency(e.s.kernel.fees, quote); err != nil {
+		return err
+	}
+	e.s.kernel.ledger = newLedger()
+	e.s.kernel.base = base
+	e.s.kernel.quote = quote
+	return nil
+}
+
+// Deposit credits an account with a positive amount of an asset or withdraws a negative one.
+// The transfer is written to the WAL in order with the orders.
+func (e *MatchingEngine) Deposit(account uint64, asset string, amount int64) error {
+	return e.s.requestTransfer(account, asset, amount)
+}
+
+// Balance returns the balance of an asset of an account.
+func (e *MatchingEngine) Balance(account uint64, asset string) Balance {
+	if e.s.kernel.ledger == nil {
+		return Balance{}
+	}
+	return e.s.kernel.ledger.get(account, asset)
+}
+
+// EnablePositions tracks the net position, average entry price and PnL of every account from its fills.
+// Must be called before Start.
+func (e *MatchingEngine) EnablePositions() {
+	e.s.kernel.positions = newPositionBook()
+}
+
+// Position returns the position of an account, use Position.UnrealizedPnL with MarkPrice to mark it.
+func (e *MatchingEngine) Position(account uint64) Position {
+	if e.s.kernel.positions == nil {
+		return Position{Account: account}
+	}
+	return e.s.kernel.positions.get(account)
+}
+
+// Positions returns the positions of every account that traded, sorted by account.
+func (e *MatchingEngine) Positions() []Position {
+	if e.s.kernel.positions == nil {
+		return nil
+	}
+	return e.s.kernel.positions.all()
+}
+
+// SetMarkPrice sets the price unrealized PnL is marked at, 0 marks at the last trade price.
+func (e *MatchingEngine) SetMarkPrice(price int64) {
+	if e.s.kernel.positions != nil {
+		e.s.kernel.positions.setMark(price)
+	}
+}
+
+// MarkPrice returns the price unrealized PnL is marked at, 0 before the first trade.
+func (e *MatchingEngine) MarkPrice() int64 {
+	if e.s.kernel.positions == nil {
+		return 0
+	}
+	return e.s.kernel.positions.markPrice()
+}
+
+// SetRateLimits sets the order rate limits of every account and every gateway session, new orders above
+// them are rejected with types.REJECT_THROTTLED, cancels are never throttled. It can be called at any time,
+// the buckets start over full.
+func (e *MatchingEngine) SetRateLimits(account, session RateLimit) error {
+	if err := account.Validate(); err != nil {
+		return err
+	}
+	if err := session.Validate(); err != nil {
+		return err
+	}
+	e.s.limiter.setLimits(account, session)
+	return nil
+}
+
+// ThrottleStats returns the number of orders rejected by the rate limits.
+func (e *MatchingEngine) ThrottleStats() ThrottleStats {
+	return e.s.limiter.stats()
+}
+
+// SetRiskLimits sets the limits of the built-in pre-trade risk check, it can be called at any time.
+// Orders failing a check are reported on ErrorInfoChan as *OrderRejectErr.
+func (e *MatchingEngine) SetRiskLimits(limits RiskLimits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	e.s.risk.setLimits(limits)
+	return nil
+}
+
+// AddRiskCheck adds a custom pre-trade risk check, it can be called at any time.
+func (e *MatchingEngine) AddRiskCheck(check RiskCheck) {
+	e.s.risk.addCheck(check)
+}
+
+// SetKillSwitch turns the kill switch of an account on or off, new orders of a killed account are
+// rejected while it can still cancel. Use MassCancel to cancel its resting orders.
+func (e *MatchingEngine) SetKillSwitch(account uint64, on bool) {
+	e.s.risk.kills.set(account, on)
 }
 
 // Start begins order processing. Must be called before submitting orders.
 func (e *MatchingEngine) Start() {
 	go e.s.orderAcceptor()
 	e.s.startDummyOrderReceivedChan()
+	go e.s.sessions.watch(e.s.kernel.ctx, func(id uint64) {
+		e.s.requestMassCancel(&MassCancel{SessionID: id})
+	})
 
-	// Bridge internal matchedInfoChan to exported matchResultCh
+	// Bridges return once the acceptor returned and every event is delivered, so that the exported
+	// channels are never written once closed. Once stopped, events nobody reads are dropped.
+	e.started = true
+	e.bridges.Add(2)
 	go func() {
-		for {
-			mi, ok := <-e.s.kernel.matchedInfoChan
-			if !ok {
-				return
+		defer e.bridges.Done()
+		for mi := range e.s.kernel.matchedInfoChan {
+			select {
+			case e.matchResultCh <- newMatchResult(mi):
+			case <-e.s.kernel.ctx.Done():
 			}
-			makerOrders := make([]types.KernelOrder, len(mi.makerOrders))
-			copy(makerOrders, mi.makerOrders)
-			sizeMap := make(map[uint64]int64, len(mi.matchedSizeMap))
-			maps.Copy(sizeMap, mi.matchedSizeMap)
-			e.matchResultCh <- MatchResult{
-				TakerOrder:     mi.takerOrder,
-				MakerOrders:    makerOrders,
-				MatchedSizeMap: sizeMap,
+		}
+	}()
+
+	go func() {
+		defer e.bridges.Done()
+		// a reader that falls behind loses errors, it never stops the acceptor
+		for err := range e.s.kernel.errorInfoChan {
+			select {
+			case e.errorCh <- err:
+			default:
+				e.dropped.Add(1)
 			}
 		}
 	}()
 }
 
 // SubmitOrder sends an order into the matching engine.
+// Orders submitted once the engine is stopped are dropped.
 func (e *MatchingEngine) SubmitOrder(order *types.KernelOrder) {
-	e.s.newOrderChan <- order
+	if err := e.s.submit(order); err != nil {
+		log.Println("Order dropped: ", err)
+	}
+}
+
+// TrySubmit queues an order without blocking, it returns ErrQueueFull when the inbound queue is full,
+// so that a gateway can shed load instead of waiting for the kernel.
+func (e *MatchingEngine) TrySubmit(order *types.KernelOrder) error {
+	return e.s.trySubmit(order)
+}
+
+// SubmitOrderContext queues an order, waiting for room in the inbound queue until ctx is done.
+// It returns ctx.Err() on timeout and ErrStopped once the engine is stopped.
+func (e *MatchingEngine) SubmitOrderContext(ctx context.Context, order *types.KernelOrder) error {
+	return e.s.submitContext(ctx, order)
+}
+
+// SubmitBatch hands a slice of orders and cancels off to the acceptor at once. They are processed in
+// order, each checked against the book and balances left by the previous one, and written to the WAL
+// as one group.
+// It returns one ack per order once the batch is applied, or ctx.Err() if ctx is done before the handoff.
+func (e *MatchingEngine) SubmitBatch(ctx context.Context, orders []*types.KernelOrder) ([]OrderAck, error) {
+	return e.s.submitBatch(ctx, orders)
+}
+
+// SetQueueDepth sets how many orders the inbound queue holds before SubmitOrder blocks, 1 by default.
+// Must be called before Start.
+func (e *MatchingEngine) SetQueueDepth(depth int) error {
+	return e.s.setQueueDepth(depth)
+}
+
+// QueueDepth returns the number of orders waiting in the inbound queue.
+func (e *MatchingEngine) QueueDepth() int {
+	return len(e.s.newOrderChan)
+}
+
+// MassQuote atomically replaces every quote of an account, within one acceptor step no other order
+// sees the book with only part of the quotes. Unchanged levels keep their queue priority, the others
+// are cancelled before the new levels are placed, so the account never crosses itself.
+func (e *MatchingEngine) MassQuote(quote MassQuote) (MassQuoteReport, error) {
+	report, err := e.s.requestMassQuote(&quote)
+	if err != nil {
+		return MassQuoteReport{}, err
+	}
+	return *report, nil
+}
+
+// MassCancel atomically cancels every resting order selected by filter. A cancelled order result is
+// published for each of them, followed by a result carrying the returned report.
+func (e *MatchingEngine) MassCancel(filter MassCancel) MassCancelReport {
+	return *e.s.requestMassCancel(&filter)
+}
+
+// SetSessionGracePeriod sets how long a session may miss heartbeats before its resting orders
+// are cancelled. Must be called before Start.
+func (e *MatchingEngine) SetSessionGracePeriod(d time.Duration) {
+	e.s.sessions.setGracePeriod(d)
+}
+
+// OpenSession registers a gateway session. Orders tagged with a SessionID are rejected
+// unless their session is open.
+func (e *MatchingEngine) OpenSession(id uint64) {
+	e.s.sessions.open(id)
+}
+
+// Heartbeat keeps a session alive, it fails with ErrUnknownSession if the session already expired.
+func (e *MatchingEngine) Heartbeat(id uint64) error {
+	return e.s.sessions.heartbeat(id)
+}
+
+// CloseSession unregisters a session and cancels its resting orders right away.
+func (e *MatchingEngine) CloseSession(id uint64) (MassCancelReport, error) {
+	if !e.s.sessions.close(id) {
+		return MassCancelReport{}, ErrUnknownSession
+	}
+	return *e.s.requestMassCancel(&MassCancel{SessionID: id}), nil
 }
 
 // MatchedInfoChan returns a read-only channel of match results.
@@ -79,9 +403,24 @@ func (e *MatchingEngine) MatchedInfoChan() <-chan MatchResult {
 	return e.matchResultCh
 }
 
+// ErrorInfoChan returns a read-only channel of rejected orders and other kernel errors. It holds 256
+// errors, the ones reported while it is full are dropped and counted by DroppedErrors.
+func (e *MatchingEngine) ErrorInfoChan() <-chan error {
+	return e.errorCh
+}
+
+// DroppedErrors returns how many errors were dropped as ErrorInfoChan was full.
+func (e *MatchingEngine) DroppedErrors() uint64 {
+	return e.dropped.Load()
+}
+
 // OrderBook returns a snapshot of the current order book.
 func (e *MatchingEngine) OrderBook() *OrderBookSnapshot {
-	ob := e.s.kernel.fullDepth()
+	return newOrderBookSnapshot(e.s.kernel)
+}
+
+func newOrderBookSnapshot(k *kernel) *OrderBookSnapshot {
+	ob := k.fullDepth()
 	asks := make([]PriceLevel, len(ob.ask))
 	for i, item := range ob.ask {
 		asks[i] = PriceLevel{Price: item.Price, Size: item.Size}
@@ -113,8 +452,96 @@ func (e *MatchingEngine) BidLength() int {
 	return e.s.kernel.bid.Length
 }
 
-// Stop gracefully shuts down the matching engine.
+// Recover restores the newest complete snapshot found in dir, a directory of snapshots such as the one
+// Shutdown writes to, then replays the orders written to the WAL of the engine after that snapshot,
+// the whole WAL if there is none. Match results of the replay are not published, new orders continue
+// the WAL. A gap between the snapshot and the WAL is reported as ErrCorruptWAL.
+// Must be called before Start.
+func (e *MatchingEngine) Recover(dir string) error {
+	return e.s.recover(dir)
+}
+
+// Snapshot writes a snapshot of the book to the directory Shutdown writes to, for Recover to start from.
+// The acceptor copies the book between two orders and goes on trading while the copy is written, it
+// returns once the snapshot is durable. With SetWALRetention, the WAL segments it covers are then deleted.
+// Returns ErrStopped if the engine is not running.
+func (e *MatchingEngine) Snapshot() error {
+	if !e.started {
+		return ErrStopped
+	}
+	seq, err := e.s.requestSnapshot()
+	if err == nil && walRetention {
+		err = e.s.wal.retain(seq)
+	}
+	return err
+}
+
+// EnablePeriodicSnapshots makes the engine take snapshots as SetSnapshotPolicy sets, online as Snapshot
+// does, to the directory Shutdown writes to. Must be called before Start.
+func (e *MatchingEngine) EnablePeriodicSnapshots() {
+	e.s.periodic = newSnapshotSchedule()
+}
+
+// EnableShutdownSnapshot makes Shutdown write a snapshot of the book once the queued orders are processed.
+func (e *MatchingEngine) EnableShutdownSnapshot() {
+	e.snapshot = true
+}
+
+// Shutdown stops the engine gracefully: new orders and requests fail with ErrStopped, the queued ones are
+// processed, every event is delivered to MatchedInfoChan and, if it has room, ErrorInfoChan, the WAL is
+// fsynced and closed, and a final snapshot is written if enabled. With SetWALRetention, the WAL segments
+// it covers are then deleted. If ctx is done first, ctx.Err() is returned and Stop ends the shutdown,
+// dropping the events nobody read.
+func (e *MatchingEngine) Shutdown(ctx context.Context) error {
+	if !e.started || e.s.kernel.ctx.Err() != nil {
+		e.Stop()
+		return nil
+	}
+	e.s.stopIntake()
+	delivered := make(chan struct{})
+	go func() {
+		e.s.closeEvents()
+		e.bridges.Wait()
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var seq uint64
+	var snapErr error
+	if e.snapshot {
+		seq, snapErr = e.s.finalSnapshot()
+	}
+	e.s.kernel.Stop()
+	err := e.s.closeLog()
+	if err == nil {
+		err = snapErr
+	}
+	if err == nil && e.snapshot && walRetention {
+		err = e.s.wal.retain(seq)
+	}
+	e.closeOnce.Do(func() {
+		close(e.matchResultCh)
+		close(e.errorCh)
+	})
+	return err
+}
+
+// Stop shuts down the matching engine at once, queued orders are dropped. It waits for the order being
+// processed, then closes the WAL and the exported channels.
 func (e *MatchingEngine) Stop() {
 	e.s.kernel.Stop()
-	close(e.matchResultCh)
+	if e.started {
+		e.s.closeEvents()
+		e.bridges.Wait()
+		if err := e.s.closeLog(); err != nil {
+			log.Println("Error in closing order log: ", err)
+		}
+	}
+	e.closeOnce.Do(func() {
+		close(e.matchResultCh)
+		close(e.errorCh)
+	})
 }
@@ -0,0 +1,144 @@
+package ker
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// OrderAck is the result of one order of a batch.
+type OrderAck struct {
+	Accepted bool
+	// The order as accepted, with its KernelOrderID, for accepted orders only
+	Order types.KernelOrder
+	// Why the order was rejected, REJECT_NONE for accepted orders and invalid orders dropped without reject
+	Reason types.RejectReason
+}
+
+// orderBatch is a slice of orders handed off to the acceptor at once, acks has room for the reply.
+type orderBatch struct {
+	orders []*types.KernelOrder
+	acks   chan []OrderAck
+}
+
+// heldEvents queues the acks, rejects and match results of orders applied before their records are
+// written to the WAL, or fsynced with group commit, in the order they were sent. The clearBucket
+// goroutines add to it too.
+type heldEvents struct {
+	mux    sync.Mutex
+	events []func()
+}
+
+func (h *heldEvents) add(send func()) {
+	h.mux.Lock()
+	h.events = append(h.events, send)
+	h.mux.Unlock()
+}
+
+// hold queues the events of the kernel until release, should sync call between two orders.
+func (k *kernel) hold() {
+	if k.held == nil {
+		k.held = &heldEvents{}
+	}
+}
+
+// release sends the events held, should sync call between two orders.
+func (k *kernel) release() {
+	held := k.held
+	k.held = nil
+	if held == nil {
+		return
+	}
+	for _, send := range held.events {
+		send()
+	}
+}
+
+// sendMatchedInfo sends a match result, or queues it while the kernel holds its events.
+func (k *kernel) sendMatchedInfo(mi *matchedInfo) {
+	if k.held != nil {
+		k.held.add(func() { k.matchedInfoChan <- mi })
+		return
+	}
+	k.matchedInfoChan <- mi
+}
+
+// sendReceived acknowledges an order, or queues the ack while the kernel holds its events.
+func (k *kernel) sendReceived(orderReceivedChan chan *types.KernelOrder, order *types.KernelOrder) {
+	if k.held != nil {
+		k.held.add(func() { orderReceivedChan <- order })
+		return
+	}
+	orderReceivedChan <- order
+}
+
+// acceptBatch admits and applies the orders of a batch one at a time, as the WAL replay does, writes them
+// to the WAL as one group, then releases their events, should sync call. With a ledger the records are
+// written one by one as the funds are reserved, so that the WAL order of ledger operations stays the order
+// they were applied in. With group commit the batch is fsynced as a group of its own.
+func (s *scheduler) acceptBatch(batch *orderBatch) {
+	s.commit()
+	kernel := s.kernel
+	acks := make([]OrderAck, len(batch.orders))
+	var group []*types.KernelOrder
+	journal := func(order *types.KernelOrder) {
+		group = append(group, order)
+	}
+	if kernel.ledger != nil {
+		journal = s.journal(false)
+	}
+	kernel.hold()
+	s.group.collecting = true
+	defer func() { s.group.collecting = false }()
+	for i, order := range batch.orders {
+		o, reason := s.admit(kernel, order, false, journal)
+		if reason != types.REJECT_NONE {
+			rejectOrder(kernel, order, reason)
+		}
+		acks[i].Reason = reason
+		if o != nil {
+			acks[i].Accepted = true
+			acks[i].Order = *o
+			if o.Amount == 0 {
+				acks[i].Order.Status = types.CANCELLED
+			}
+			s.apply(kernel, o, s.orderReceivedChan)
+		}
+	}
+	if len(group) != 0 && !s.logOrders(group, false) {
+		log.Panicln("Error in writing order log.")
+	}
+	if !s.syncLog() {
+		log.Panicln("Error in syncing order log.")
+	}
+	s.group.collecting = false
+	kernel.release()
+	batch.acks <- acks
+}
+
+// submitBatch hands a batch off to the acceptor and waits for its acks, until ctx is done or the kernel stops.
+func (s *scheduler) submitBatch(ctx context.Context, orders []*types.KernelOrder) ([]OrderAck, error) {
+	batch := &orderBatch{orders: orders, acks: make(chan []OrderAck, 1)}
+	if !s.enter() {
+		return nil, ErrStopped
+	}
+	defer s.leave()
+	select {
+	case s.batchChan <- batch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.life.closing:
+		return nil, ErrStopped
+	case <-s.kernel.ctx.Done():
+		return nil, ErrStopped
+	}
+	// once handed off the batch is applied, only a stop interrupts it
+	select {
+	case acks := <-batch.acks:
+		return acks, nil
+	case <-s.kernel.ctx.Done():
+		return nil, ErrStopped
+	}
+}
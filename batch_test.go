@@ -0,0 +1,134 @@
+package ker
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_MatchingEngine_SubmitBatch(t *testing.T) {
+	originalPath := kernelOrderLogPath
+	kernelOrderLogPath = t.TempDir() + "/"
+	defer func() { kernelOrderLogPath = originalPath }()
+	saveOrderLogOrig := saveOrderLog
+	saveOrderLog = true
+	defer func() { saveOrderLog = saveOrderLogOrig }()
+
+	engine := NewMatchingEngine(1, "test_engine_batch")
+	assert.Nil(t, engine.SetRiskLimits(RiskLimits{MaxQty: 100}))
+	engine.Start()
+	go func() {
+		for range engine.ErrorInfoChan() {
+		}
+	}()
+	go func() {
+		for range engine.MatchedInfoChan() {
+		}
+	}()
+
+	invalid := newTestBidOrder(100, 10)
+	invalid.Left = 20
+	acks, err := engine.SubmitBatch(context.Background(), []*types.KernelOrder{
+		newTestBidOrder(100, 10),
+		newTestBidOrder(101, 1000),
+		invalid,
+		newTestAskOrder(110, 10),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(acks))
+	assert.True(t, acks[0].Accepted)
+	assert.NotZero(t, acks[0].Order.KernelOrderID)
+	assert.Equal(t, types.REJECT_RISK_MAX_QTY, acks[1].Reason)
+	assert.Equal(t, OrderAck{}, acks[2])
+	assert.True(t, acks[3].Accepted)
+	// applied once acked
+	assert.Equal(t, int64(100), engine.BestBid())
+	assert.Equal(t, int64(110), engine.BestAsk())
+
+	// cancels and orders in one batch, processed in order
+	acks, err = engine.SubmitBatch(context.Background(), []*types.KernelOrder{
+		{KernelOrderID: acks[0].Order.KernelOrderID, Price: 100},
+		newTestBidOrder(105, 10),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, types.CANCELLED, acks[0].Order.Status)
+	assert.True(t, acks[1].Accepted)
+	assert.Equal(t, int64(105), engine.BestBid())
+
+	// the accepted orders of a batch are written to the WAL
+	b, err := os.ReadFile(engine.s.wal.f[0].Name())
+	assert.Nil(t, err)
+	r := newWALReader(bytes.NewReader(b))
+	var logged []uint64
+	for rec, err := r.next(); err == nil; rec, err = r.next() {
+		_, order := rec.order()
+		logged = append(logged, order.KernelOrderID)
+	}
+	assert.Equal(t, 4, len(logged))
+	assert.Equal(t, uint64(4), r.seq)
+	assert.Equal(t, acks[1].Order.KernelOrderID, logged[len(logged)-1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	engine.s.kernel.Pause()
+	_, err = engine.SubmitBatch(ctx, []*types.KernelOrder{newTestBidOrder(100, 1)})
+	assert.ErrorIs(t, err, context.Canceled)
+	engine.Stop()
+	_, err = engine.SubmitBatch(context.Background(), []*types.KernelOrder{newTestBidOrder(100, 1)})
+	assert.ErrorIs(t, err, ErrStopped)
+}
+
+func Test_MatchingEngine_SubmitBatchLedger(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_batch_ledger")
+	assert.Nil(t, engine.EnableLedger("BTC", "USDT"))
+	engine.Start()
+	go func() {
+		for range engine.MatchedInfoChan() {
+		}
+	}()
+	assert.Nil(t, engine.Deposit(1, "USDT", 1000))
+	assert.Nil(t, engine.Deposit(2, "BTC", 20))
+
+	// the first bid reserves 1000 and fills at 90, the second one is only backed by what the fill gave back
+	acks, err := engine.SubmitBatch(context.Background(), []*types.KernelOrder{
+		{Amount: -20, Price: 90, Left: -20, AccountID: 2},
+		{Amount: 10, Price: 100, Left: 10, AccountID: 1},
+		{Amount: 1, Price: 100, Left: 1, AccountID: 1},
+	})
+	assert.Nil(t, err)
+	for _, ack := range acks {
+		assert.True(t, ack.Accepted)
+	}
+	assert.Equal(t, Balance{Available: 10}, engine.Balance(1, "USDT"))
+	assert.Equal(t, Balance{Available: 11}, engine.Balance(1, "BTC"))
+	engine.Stop()
+}
+
+func Test_Exchange_SubmitBatch(t *testing.T) {
+	x, err := NewExchange(1, "test_exchange_batch", newTestInstruments("AAA"))
+	assert.Nil(t, err)
+	_, err = x.SubmitBatch(context.Background(), "BBB", nil)
+	assert.ErrorIs(t, err, ErrUnknownSymbol)
+	x.Start()
+	go func() {
+		for range x.Events() {
+		}
+	}()
+	acks, err := x.SubmitBatch(context.Background(), "AAA", []*types.KernelOrder{
+		newTestAskOrder(110, 10),
+		newTestBidOrder(110, 4),
+	})
+	assert.Nil(t, err)
+	assert.True(t, acks[0].Accepted && acks[1].Accepted)
+	assert.Eventually(t, func() bool {
+		book, _ := x.OrderBook("AAA")
+		return len(book.Asks) == 1 && book.Asks[0].Size == -6
+	}, time.Second, 5*time.Millisecond)
+	x.Stop()
+}
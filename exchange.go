@@ -0,0 +1,643 @@
+package ker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// ErrUnknownSymbol is returned for orders and queries of an instrument the Exchange doesn't host.
+var ErrUnknownSymbol = errors.New("unknown symbol")
+
+// Event is a match result of one instrument on the unified Exchange event stream.
+type Event struct {
+	Symbol string
+	MatchResult
+}
+
+// Exchange hosts many instruments on one server. Each instrument has its own kernel and
+// acceptor goroutine, all of them share one event stream, one error stream and one WAL.
+type Exchange struct {
+	books    map[string]*scheduler
+	log      *sharedOrderLog
+	sessions *sessionManager
+	kills    *killSwitch
+	limiter  *rateLimiter
+	eventCh  chan Event
+	errorCh  chan error
+	dropped  atomic.Uint64 // errors dropped as errorCh was full
+	bridges  sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	started  bool
+	snapshot bool // take snapshots on Shutdown
+	once     sync.Once
+	logOnce  sync.Once
+	logErr   error
+}
+
+// NewExchange creates an exchange hosting the given instruments, as returned by types.LoadInstruments.
+func NewExchange(serverID uint64, desc string, instruments map[string]*types.Instrument) (*Exchange, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	x := &Exchange{
+		books:    make(map[string]*scheduler, len(instruments)),
+		log:      newSharedOrderLog(desc),
+		sessions: newSessionManager(sessionGracePeriod),
+		kills:    newKillSwitch(),
+		limiter:  newRateLimiter(),
+		eventCh:  make(chan Event, 256),
+		errorCh:  make(chan error, 256),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for symbol, ins := range instruments {
+		if len(symbol) > symbolSize {
+			return nil, fmt.Errorf("instrument %s: symbol longer than %d bytes", symbol, symbolSize)
+		}
+		if err := ins.Validate(); err != nil {
+			return nil, err
+		}
+		s := initAcceptor(serverID, desc+"_"+symbol)
+		s.setInstrument(ins)
+		s.symbol = symbol
+		s.sharedLog = x.log
+		s.sessions = x.sessions
+		s.risk.kills = x.kills
+		s.limiter = x.limiter
+		x.books[symbol] = s
+	}
+	return x, nil
+}
+
+// Recover replays the orders of the given symbols from a shared log written by a previous run, all hosted
+// symbols if none is given. path is one segment file or the manifest listing them. Match results of the
+// replay are not published. Transfers are replayed with the symbol they were routed to, see Deposit.
+// The newest snapshot of each book is restored first, only the records of the book written after it are
+// replayed. With a ledger, shared by the books, the snapshots are only restored if they all cover the
+// same records, as the ones written by Shutdown do, the whole log is replayed otherwise.
+// Must be called before Start.
+func (x *Exchange) Recover(path string, symbols ...string) error {
+	replay := make(map[string]*scheduler, len(x.books))
+	if len(symbols) == 0 {
+		for symbol, s := range x.books {
+			replay[symbol] = s
+		}
+	}
+	for _, symbol := range symbols {
+		s, ok := x.books[symbol]
+		if !ok {
+			return fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+		}
+		replay[symbol] = s
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	for _, s := range replay {
+		go func(k *kernel) {
+			for {
+				select {
+				case <-k.matchedInfoChan:
+				case <-quit:
+					return
+				}
+			}
+		}(s.kernel)
+	}
+
+	from, err := restoreSnapshots(replay)
+	if err != nil {
+		return err
+	}
+	err = readSharedOrderLog(path, func(rec walRecord) {
+		symbol, order := rec.order()
+		s, ok := replay[symbol]
+		if !ok || rec.seq <= from[symbol] {
+			return
+		}
+		s.replay(order, rec.quote())
+	})
+	for _, s := range replay {
+		s.risk.trackBook(s.kernel)
+	}
+	return err
+}
+
+// restoreSnapshots restores the newest snapshot of each book, it returns the sequence of the last record
+// of the shared log each restored snapshot covers.
+func restoreSnapshots(books map[string]*scheduler) (map[string]uint64, error) {
+	snaps := make(map[string]*snapshotFile, len(books))
+	paths := make(map[string]string, len(books))
+	shared := false
+	for symbol, s := range books {
+		snap, path, err := latestSnapshot(kernelSnapshotPath + s.acceptorDescription)
+		if err != nil {
+			return nil, err
+		}
+		if snap != nil {
+			snaps[symbol], paths[symbol] = snap, path
+		}
+		shared = s.kernel.ledger != nil
+	}
+	if shared {
+		// the ledger of a snapshot is the one of all books, it only fits the snapshots taken with it
+		seqs := make(map[uint64]bool)
+		for symbol := range books {
+			if snaps[symbol] == nil {
+				return nil, nil
+			}
+			seqs[snaps[symbol].Position.WAL.Seq] = true
+		}
+		if len(seqs) != 1 {
+			return nil, nil
+		}
+	}
+	from := make(map[string]uint64, len(snaps))
+	for symbol, snap := range snaps {
+		if err := books[symbol].restoreSnapshot(snap, paths[symbol]); err != nil {
+			return nil, err
+		}
+		from[symbol] = snap.Position.WAL.Seq
+	}
+	return from, nil
+}
+
+// EnableLedger makes the instruments reserve and settle funds in one ledger shared by all of them,
+// every instrument must have its BaseAsset and QuoteAsset set and charge its fees in its QuoteAsset.
+// Must be called before Start.
+func (x *Exchange) EnableLedger() error {
+	for _, symbol := range x.Symbols() {
+		ins := x.books[symbol].instrument
+		if ins.BaseAsset == "" || ins.QuoteAsset == "" || ins.BaseAsset == ins.QuoteAsset {
+			return fmt.Errorf("instrument %s: base and quote must be two different assets", symbol)
+		}
+		if err := checkFeeCurrency(x.books[symbol].kernel.fees, ins.QuoteAsset); err != nil {
+			return fmt.Errorf("instrument %s: %w", symbol, err)
+		}
+	}
+	l := newLedger()
+	for _, s := range x.books {
+		s.kernel.ledger = l
+		s.kernel.base = s.instrument.BaseAsset
+		s.kernel.quote = s.instrument.QuoteAsset
+	}
+	return nil
+}
+
+// Deposit credits an account with a positive amount of an asset or withdraws a negative one.
+// The transfer runs in, and is logged with, the first instrument by symbol that trades the asset.
+func (x *Exchange) Deposit(account uint64, asset string, amount int64) error {
+	for _, symbol := range x.Symbols() {
+		s := x.books[symbol]
+		if s.kernel.ledger == nil {
+			return ErrLedgerDisabled
+		}
+		if s.kernel.base == asset || s.kernel.quote == asset {
+			return s.requestTransfer(account, asset, amount)
+		}
+	}
+	return ErrUnknownAsset
+}
+
+// Balance returns the balance of an asset of an account.
+func (x *Exchange) Balance(account uint64, asset string) Balance {
+	// the ledger is shared, any instrument has it
+	for _, s := range x.books {
+		if s.kernel.ledger == nil {
+			return Balance{}
+		}
+		return s.kernel.ledger.get(account, asset)
+	}
+	return Balance{}
+}
+
+// EnablePositions tracks the positions of the accounts in each instrument. Must be called before Start.
+func (x *Exchange) EnablePositions() {
+	for _, s := range x.books {
+		s.kernel.positions = newPositionBook()
+	}
+}
+
+// Position returns the position of an account in an instrument.
+func (x *Exchange) Position(symbol string, account uint64) (Position, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return Position{}, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	if s.kernel.positions == nil {
+		return Position{Account: account}, nil
+	}
+	return s.kernel.positions.get(account), nil
+}
+
+// Positions returns the positions of every account that traded an instrument, sorted by account.
+func (x *Exchange) Positions(symbol string) ([]Position, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	if s.kernel.positions == nil {
+		return nil, nil
+	}
+	return s.kernel.positions.all(), nil
+}
+
+// SetMarkPrice sets the price unrealized PnL of an instrument is marked at, 0 marks at the last trade price.
+func (x *Exchange) SetMarkPrice(symbol string, price int64) error {
+	s, ok := x.books[symbol]
+	if !ok {
+		return fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	if s.kernel.positions != nil {
+		s.kernel.positions.setMark(price)
+	}
+	return nil
+}
+
+// MarkPrice returns the price unrealized PnL of an instrument is marked at, 0 before the first trade.
+func (x *Exchange) MarkPrice(symbol string) (int64, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	if s.kernel.positions == nil {
+		return 0, nil
+	}
+	return s.kernel.positions.markPrice(), nil
+}
+
+// SetFeeSchedule sets the fees attached to every fill of an instrument. Must be called before Start.
+func (x *Exchange) SetFeeSchedule(symbol string, fs *types.FeeSchedule) error {
+	s, ok := x.books[symbol]
+	if !ok {
+		return fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	if err := fs.Validate(); err != nil {
+		return err
+	}
+	if err := checkFeeCurrency(fs, s.kernel.quote); err != nil {
+		return err
+	}
+	s.kernel.fees = fs
+	return nil
+}
+
+// SetRiskLimits sets the limits of the built-in pre-trade risk check of an instrument, it can be called at any time.
+func (x *Exchange) SetRiskLimits(symbol string, limits RiskLimits) error {
+	s, ok := x.books[symbol]
+	if !ok {
+		return fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	s.risk.setLimits(limits)
+	return nil
+}
+
+// AddRiskCheck adds a custom pre-trade risk check to each of the given instruments, all hosted
+// instruments if none is given. It can be called at any time.
+func (x *Exchange) AddRiskCheck(check RiskCheck, symbols ...string) error {
+	if len(symbols) == 0 {
+		symbols = x.Symbols()
+	}
+	for _, symbol := range symbols {
+		if _, ok := x.books[symbol]; !ok {
+			return fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+		}
+	}
+	for _, symbol := range symbols {
+		x.books[symbol].risk.addCheck(check)
+	}
+	return nil
+}
+
+// SetRateLimits sets the order rate limits of every account and every gateway session, counted across
+// the instruments. It can be called at any time, the buckets start over full.
+func (x *Exchange) SetRateLimits(account, session RateLimit) error {
+	if err := account.Validate(); err != nil {
+		return err
+	}
+	if err := session.Validate(); err != nil {
+		return err
+	}
+	x.limiter.setLimits(account, session)
+	return nil
+}
+
+// ThrottleStats returns the number of orders rejected by the rate limits.
+func (x *Exchange) ThrottleStats() ThrottleStats {
+	return x.limiter.stats()
+}
+
+// SetKillSwitch turns the kill switch of an account on or off in every instrument.
+func (x *Exchange) SetKillSwitch(account uint64, on bool) {
+	x.kills.set(account, on)
+}
+
+// Start begins order processing of every instrument.
+func (x *Exchange) Start() {
+	go x.sessions.watch(x.ctx, func(id uint64) {
+		x.cancelSession(id)
+	})
+	for symbol, s := range x.books {
+		go s.orderAcceptor()
+		s.startDummyOrderReceivedChan()
+
+		// bridges return once the acceptor returned and every event is delivered, so that the exported
+		// channels are never written once closed. Once stopped, events nobody reads are dropped.
+		x.bridges.Add(2)
+		go func(symbol string, k *kernel) {
+			defer x.bridges.Done()
+			for mi := range k.matchedInfoChan {
+				select {
+				case x.eventCh <- Event{Symbol: symbol, MatchResult: newMatchResult(mi)}:
+				case <-x.ctx.Done():
+				}
+			}
+		}(symbol, s.kernel)
+
+		go func(symbol string, k *kernel) {
+			defer x.bridges.Done()
+			for err := range k.errorInfoChan {
+				select {
+				case x.errorCh <- fmt.Errorf("%s: %w", symbol, err):
+				default:
+					x.dropped.Add(1)
+				}
+			}
+		}(symbol, s.kernel)
+	}
+	x.started = true
+}
+
+// SubmitOrder routes an order to the kernel of its instrument.
+func (x *Exchange) SubmitOrder(symbol string, order *types.KernelOrder) error {
+	s, ok := x.books[symbol]
+	if !ok {
+		return fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	return s.submit(order)
+}
+
+// TrySubmit queues an order of an instrument without blocking, it returns ErrQueueFull when the
+// inbound queue of the instrument is full.
+func (x *Exchange) TrySubmit(symbol string, order *types.KernelOrder) error {
+	s, ok := x.books[symbol]
+	if !ok {
+		return fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	return s.trySubmit(order)
+}
+
+// SubmitOrderContext queues an order of an instrument, waiting for room in its inbound queue until ctx is done.
+func (x *Exchange) SubmitOrderContext(ctx context.Context, symbol string, order *types.KernelOrder) error {
+	s, ok := x.books[symbol]
+	if !ok {
+		return fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	return s.submitContext(ctx, order)
+}
+
+// SubmitBatch hands a slice of orders and cancels of an instrument off to its acceptor at once,
+// see MatchingEngine.SubmitBatch.
+func (x *Exchange) SubmitBatch(ctx context.Context, symbol string, orders []*types.KernelOrder) ([]OrderAck, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	return s.submitBatch(ctx, orders)
+}
+
+// SetQueueDepth sets the inbound queue depth of every instrument. Must be called before Start.
+func (x *Exchange) SetQueueDepth(depth int) error {
+	for _, s := range x.books {
+		if err := s.setQueueDepth(depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueueDepth returns the number of orders waiting in the inbound queue of an instrument.
+func (x *Exchange) QueueDepth(symbol string) (int, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	return len(s.newOrderChan), nil
+}
+
+// MassQuote atomically replaces every quote of an account in an instrument, see MatchingEngine.MassQuote.
+func (x *Exchange) MassQuote(symbol string, quote MassQuote) (MassQuoteReport, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return MassQuoteReport{}, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	report, err := s.requestMassQuote(&quote)
+	if err != nil {
+		return MassQuoteReport{}, err
+	}
+	return *report, nil
+}
+
+// MassCancel atomically cancels the resting orders selected by filter in each of the given
+// instruments, all hosted instruments if none is given. It returns the number of cancelled orders.
+func (x *Exchange) MassCancel(filter MassCancel, symbols ...string) (int, error) {
+	if len(symbols) == 0 {
+		symbols = x.Symbols()
+	}
+	for _, symbol := range symbols {
+		if _, ok := x.books[symbol]; !ok {
+			return 0, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+		}
+	}
+	cancelled := 0
+	for _, symbol := range symbols {
+		cancelled += x.books[symbol].requestMassCancel(&filter).Cancelled
+	}
+	return cancelled, nil
+}
+
+// SetSessionGracePeriod sets how long a session may miss heartbeats before its resting orders
+// are cancelled in every instrument. Must be called before Start.
+func (x *Exchange) SetSessionGracePeriod(d time.Duration) {
+	x.sessions.setGracePeriod(d)
+}
+
+// OpenSession registers a gateway session, sessions are shared by all instruments.
+func (x *Exchange) OpenSession(id uint64) {
+	x.sessions.open(id)
+}
+
+// Heartbeat keeps a session alive, it fails with ErrUnknownSession if the session already expired.
+func (x *Exchange) Heartbeat(id uint64) error {
+	return x.sessions.heartbeat(id)
+}
+
+// CloseSession unregisters a session and cancels its resting orders in every instrument right away.
+// It returns the number of cancelled orders.
+func (x *Exchange) CloseSession(id uint64) (int, error) {
+	if !x.sessions.close(id) {
+		return 0, ErrUnknownSession
+	}
+	return x.cancelSession(id), nil
+}
+
+func (x *Exchange) cancelSession(id uint64) int {
+	cancelled := 0
+	for _, s := range x.books {
+		cancelled += s.requestMassCancel(&MassCancel{SessionID: id}).Cancelled
+	}
+	return cancelled
+}
+
+// Events returns the match results of all instruments, tagged with their symbol.
+func (x *Exchange) Events() <-chan Event {
+	return x.eventCh
+}
+
+// ErrorInfoChan returns rejected orders and other kernel errors of all instruments,
+// wrapped with their symbol. It holds 256 errors, the ones reported while it is full are dropped and
+// counted by DroppedErrors.
+func (x *Exchange) ErrorInfoChan() <-chan error {
+	return x.errorCh
+}
+
+// DroppedErrors returns how many errors were dropped as ErrorInfoChan was full.
+func (x *Exchange) DroppedErrors() uint64 {
+	return x.dropped.Load()
+}
+
+// Symbols returns the hosted instrument symbols in ascending order.
+func (x *Exchange) Symbols() []string {
+	symbols := make([]string, 0, len(x.books))
+	for symbol := range x.books {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// OrderBook returns a snapshot of the order book of an instrument.
+func (x *Exchange) OrderBook(symbol string) (*OrderBookSnapshot, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	return newOrderBookSnapshot(s.kernel), nil
+}
+
+// BestAsk returns the best ask price of an instrument, math.MaxInt64 if there is none.
+func (x *Exchange) BestAsk(symbol string) (int64, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	return s.kernel.ask1Price, nil
+}
+
+// BestBid returns the best bid price of an instrument, math.MinInt64 if there is none.
+func (x *Exchange) BestBid(symbol string) (int64, error) {
+	s, ok := x.books[symbol]
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", symbol, ErrUnknownSymbol)
+	}
+	return s.kernel.bid1Price, nil
+}
+
+// EnablePeriodicSnapshots makes every book take snapshots as SetSnapshotPolicy sets, online as
+// MatchingEngine.Snapshot does. The WAL shared by the books is kept whole, see SetWALRetention. Must be
+// called before Start.
+func (x *Exchange) EnablePeriodicSnapshots() {
+	for _, s := range x.books {
+		s.periodic = newSnapshotSchedule()
+	}
+}
+
+// EnableShutdownSnapshot makes Shutdown write a snapshot of every book once the queued orders are processed,
+// Recover restores them.
+func (x *Exchange) EnableShutdownSnapshot() {
+	x.snapshot = true
+}
+
+// Shutdown stops every instrument gracefully, see MatchingEngine.Shutdown. The shared WAL is closed once
+// every instrument is drained, and kept whole as Recover reads it from its start.
+func (x *Exchange) Shutdown(ctx context.Context) error {
+	if !x.started || x.ctx.Err() != nil {
+		x.Stop()
+		return nil
+	}
+	for _, s := range x.books {
+		s.stopIntake()
+	}
+	delivered := make(chan struct{})
+	go func() {
+		for _, s := range x.books {
+			s.closeEvents()
+		}
+		x.bridges.Wait()
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var snapErr error
+	if x.snapshot {
+		for _, symbol := range x.Symbols() {
+			if _, err := x.books[symbol].finalSnapshot(); snapErr == nil {
+				snapErr = err
+			}
+		}
+	}
+	x.cancel()
+	for _, s := range x.books {
+		s.kernel.Stop()
+	}
+	err := x.closeLog()
+	if err == nil {
+		err = snapErr
+	}
+	x.once.Do(func() {
+		close(x.eventCh)
+		close(x.errorCh)
+	})
+	return err
+}
+
+// Stop shuts down every instrument of the exchange at once, queued orders are dropped.
+func (x *Exchange) Stop() {
+	x.cancel()
+	for _, s := range x.books {
+		s.kernel.Stop()
+	}
+	if x.started {
+		for _, s := range x.books {
+			s.closeEvents()
+		}
+		x.bridges.Wait()
+		if err := x.closeLog(); err != nil {
+			log.Println("Error in closing order log: ", err)
+		}
+	}
+	x.once.Do(func() {
+		close(x.eventCh)
+		close(x.errorCh)
+	})
+}
+
+func (x *Exchange) closeLog() error {
+	x.logOnce.Do(func() {
+		x.logErr = x.log.close()
+	})
+	return x.logErr
+}
@@ -0,0 +1,200 @@
+package ker
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func newTestInstruments(symbols ...string) map[string]*types.Instrument {
+	instruments := make(map[string]*types.Instrument, len(symbols))
+	for _, symbol := range symbols {
+		instruments[symbol] = &types.Instrument{Symbol: symbol, TickSize: 1, LotSize: 1}
+	}
+	return instruments
+}
+
+func Test_NewExchange_SymbolTooLong(t *testing.T) {
+	_, err := NewExchange(1, "test_exchange", newTestInstruments("A_VERY_LONG_SYMBOL_NAME"))
+	assert.NotNil(t, err)
+
+	_, err = NewExchange(1, "test_exchange", map[string]*types.Instrument{"A": {Symbol: "A"}})
+	assert.NotNil(t, err)
+}
+
+func Test_Exchange_RoutesBySymbol(t *testing.T) {
+	x, err := NewExchange(1, "test_exchange_route", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"AAA", "BBB"}, x.Symbols())
+	x.Start()
+
+	assert.Nil(t, x.SubmitOrder("AAA", newTestAskOrder(300, 10)))
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(100, 20)))
+	assert.True(t, errors.Is(x.SubmitOrder("CCC", newTestBidOrder(100, 20)), ErrUnknownSymbol))
+
+	assert.Eventually(t, func() bool {
+		askA, _ := x.BestAsk("AAA")
+		bidB, _ := x.BestBid("BBB")
+		return askA == 300 && bidB == 100
+	}, time.Second, 10*time.Millisecond)
+
+	bidA, _ := x.BestBid("AAA")
+	askB, _ := x.BestAsk("BBB")
+	assert.Equal(t, int64(math.MinInt64), bidA)
+	assert.Equal(t, int64(math.MaxInt64), askB)
+
+	ob, err := x.OrderBook("AAA")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ob.Asks))
+	assert.Equal(t, 0, len(ob.Bids))
+
+	_, err = x.OrderBook("CCC")
+	assert.True(t, errors.Is(err, ErrUnknownSymbol))
+	_, err = x.BestAsk("CCC")
+	assert.True(t, errors.Is(err, ErrUnknownSymbol))
+	_, err = x.BestBid("CCC")
+	assert.True(t, errors.Is(err, ErrUnknownSymbol))
+
+	// a crossing bid only matches the ask of its own instrument
+	assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(300, 10)))
+	select {
+	case ev := <-x.Events():
+		assert.Equal(t, "AAA", ev.Symbol)
+		assert.Equal(t, types.CLOSED, ev.TakerOrder.Status)
+		assert.Equal(t, 1, len(ev.MakerOrders))
+	case <-time.After(time.Second):
+		t.Fatal("expected a match event")
+	}
+	bidB, _ := x.BestBid("BBB")
+	assert.Equal(t, int64(100), bidB)
+
+	x.Stop()
+}
+
+func Test_Exchange_RejectTaggedWithSymbol(t *testing.T) {
+	instruments := newTestInstruments("AAA")
+	instruments["AAA"].TickSize = 10
+	x, err := NewExchange(1, "test_exchange_reject", instruments)
+	assert.Nil(t, err)
+	x.Start()
+
+	assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(105, 10)))
+	select {
+	case err := <-x.ErrorInfoChan():
+		var reject *OrderRejectErr
+		assert.True(t, errors.As(err, &reject))
+		assert.Equal(t, types.REJECT_OFF_TICK, reject.Reason)
+		assert.Contains(t, err.Error(), "AAA")
+	case <-time.After(time.Second):
+		t.Fatal("expected an order reject")
+	}
+
+	x.Stop()
+}
+
+func Test_Exchange_SharedLogRecoverPerSymbol(t *testing.T) {
+	originalPath := kernelOrderLogPath
+	kernelOrderLogPath = t.TempDir() + "/"
+	defer func() { kernelOrderLogPath = originalPath }()
+	saveOrderLogOrig := saveOrderLog
+	saveOrderLog = true
+	defer func() { saveOrderLog = saveOrderLogOrig }()
+
+	x, err := NewExchange(1, "test_exchange_wal", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	x.Start()
+
+	assert.Nil(t, x.SubmitOrder("AAA", newTestAskOrder(300, 10)))
+	assert.Nil(t, x.SubmitOrder("AAA", newTestAskOrder(310, 10)))
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(100, 20)))
+	// partially fills the first ask of AAA
+	assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(300, 4)))
+	<-x.Events()
+
+	var cancelID uint64
+	assert.Eventually(t, func() bool {
+		ob, _ := x.OrderBook("BBB")
+		if len(ob.Bids) != 1 {
+			return false
+		}
+		cancelID = x.books["BBB"].kernel.bid.Front().Value().(*priceBucket).l.Front().Value.(*types.KernelOrder).KernelOrderID
+		return true
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, x.SubmitOrder("BBB", &types.KernelOrder{KernelOrderID: cancelID, Price: 100}))
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(90, 5)))
+
+	assert.Eventually(t, func() bool {
+		bid, _ := x.BestBid("BBB")
+		return bid == 90
+	}, time.Second, 10*time.Millisecond)
+	expectA, _ := x.OrderBook("AAA")
+	expectB, _ := x.OrderBook("BBB")
+	path := x.log.f[0].Name()
+	x.Stop()
+
+	// only AAA is recovered
+	x2, err := NewExchange(1, "test_exchange_wal_2", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.Nil(t, x2.Recover(path, "AAA"))
+	gotA, _ := x2.OrderBook("AAA")
+	gotB, _ := x2.OrderBook("BBB")
+	assert.Equal(t, expectA, gotA)
+	assert.Equal(t, int64(-6), gotA.Asks[0].Size)
+	assert.Equal(t, 0, len(gotB.Bids))
+
+	// both symbols are recovered
+	x3, err := NewExchange(1, "test_exchange_wal_3", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.Nil(t, x3.Recover(path))
+	gotA, _ = x3.OrderBook("AAA")
+	gotB, _ = x3.OrderBook("BBB")
+	assert.Equal(t, expectA, gotA)
+	assert.Equal(t, expectB, gotB)
+
+	assert.True(t, errors.Is(x3.Recover(path, "CCC"), ErrUnknownSymbol))
+	assert.NotNil(t, x3.Recover(path+".missing"))
+}
+
+func Test_Exchange_RecoverSnapshots(t *testing.T) {
+	dir := setTestWAL(t, 0)
+	setTestSnapshots(t)
+	const desc = "test_exchange_recover_snapshots"
+	x, err := NewExchange(1, desc, newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	x.Start()
+	go func() {
+		for range x.Events() {
+		}
+	}()
+	assert.Nil(t, x.SubmitOrder("AAA", newTestAskOrder(300, 10)))
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(100, 20)))
+	assert.Eventually(t, func() bool { return x.log.seq == 2 }, time.Second, time.Millisecond)
+
+	// only AAA has a snapshot, the records of BBB written before it are replayed
+	seq, err := x.books["AAA"].requestSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), seq)
+	assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(300, 4)))
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(90, 5)))
+	assert.Eventually(t, func() bool { return x.log.seq == 4 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	expectA, _ := x.OrderBook("AAA")
+	expectB, _ := x.OrderBook("BBB")
+	x.Stop()
+
+	x2, err := NewExchange(1, desc, newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.Nil(t, x2.Recover(dir+desc+walManifestExt))
+	gotA, _ := x2.OrderBook("AAA")
+	gotB, _ := x2.OrderBook("BBB")
+	assert.Equal(t, expectA, gotA)
+	assert.Equal(t, expectB, gotB)
+	assert.Equal(t, []PriceLevel{{Price: 300, Size: -6}}, gotA.Asks)
+	assert.Equal(t, x.books["AAA"].ids, x2.books["AAA"].ids)
+	assert.Nil(t, x2.books["BBB"].lastOrder)
+}
@@ -0,0 +1,52 @@
+package ker
+
+import "github.com/Curton/GoMatchingKernel/types"
+
+// Fill is one trade between the taker order and a maker order of a match result.
+type Fill struct {
+	MakerOrderID uint64
+	TakerOrderID uint64
+	Price        int64
+	// Traded size, always positive
+	Size int64
+	// Size * Price / quantity scale, in the units of KernelOrder.FilledTotal
+	Notional int64
+	// Fees in the units of Notional, a negative MakerFee is a rebate
+	MakerFee    int64
+	TakerFee    int64
+	FeeCurrency string
+}
+
+// fillsOf evaluates the fills of a match result against the fee schedule of the kernel,
+// without a schedule the fees are 0. Can be called from the clearBucket goroutines.
+func (k *kernel) fillsOf(mi *matchedInfo) []Fill {
+	if len(mi.makerOrders) == 0 {
+		return nil
+	}
+	var taker types.FeeTier
+	if k.fees != nil {
+		taker = k.fees.Tier(mi.takerOrder.AccountID)
+	}
+	fills := make([]Fill, 0, len(mi.makerOrders))
+	for i := range mi.makerOrders {
+		maker := &mi.makerOrders[i]
+		size := mi.matchedSizeMap[maker.KernelOrderID]
+		if size < 0 {
+			size = -size
+		}
+		fill := Fill{
+			MakerOrderID: maker.KernelOrderID,
+			TakerOrderID: mi.takerOrder.KernelOrderID,
+			Price:        maker.Price,
+			Size:         size,
+			Notional:     k.notional(size, maker.Price),
+		}
+		if k.fees != nil {
+			fill.MakerFee = types.Fee(fill.Notional, k.fees.Tier(maker.AccountID).Maker)
+			fill.TakerFee = types.Fee(fill.Notional, taker.Taker)
+			fill.FeeCurrency = k.fees.Currency
+		}
+		fills = append(fills, fill)
+	}
+	return fills
+}
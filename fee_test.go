@@ -0,0 +1,82 @@
+package ker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func newTestFeeSchedule() *types.FeeSchedule {
+	return &types.FeeSchedule{
+		Currency: "USDT",
+		Tiers:    []types.FeeTier{{Maker: types.ONE / 1000, Taker: types.ONE / 500}, {Maker: -types.ONE / 10000, Taker: types.ONE / 1000}},
+		Accounts: map[uint64]int{1: 1},
+	}
+}
+
+func Test_orderAcceptor_Fees(t *testing.T) {
+	acceptor := newTestAcceptor()
+	acceptor.kernel.fees = newTestFeeSchedule()
+	events := collectMatchedInfo(acceptor)
+	maker1 := submitAndWait(acceptor, &types.KernelOrder{Amount: -10, Price: 1000, Left: -10, AccountID: 1})
+	maker3 := submitAndWait(acceptor, &types.KernelOrder{Amount: -10, Price: 1000, Left: -10, AccountID: 3})
+
+	// partially fills the level, fills are priced one maker at a time
+	taker := submitAndWait(acceptor, &types.KernelOrder{Amount: 15, Price: 1000, Left: 15, AccountID: 2})
+	filled := func(mi *matchedInfo) bool { return mi.fills != nil }
+	fills := nextMatchedInfo(t, events, filled).fills
+	assert.Equal(t, []Fill{
+		{MakerOrderID: maker1.KernelOrderID, TakerOrderID: taker.KernelOrderID, Price: 1000, Size: 10, Notional: 10000,
+			MakerFee: -1, TakerFee: 20, FeeCurrency: "USDT"},
+		{MakerOrderID: maker3.KernelOrderID, TakerOrderID: taker.KernelOrderID, Price: 1000, Size: 5, Notional: 5000,
+			MakerFee: 5, TakerFee: 10, FeeCurrency: "USDT"},
+	}, fills)
+
+	// clears the level
+	taker = submitAndWait(acceptor, &types.KernelOrder{Amount: 5, Price: 1000, Left: 5, AccountID: 1})
+	fills = nextMatchedInfo(t, events, filled).fills
+	assert.Equal(t, []Fill{
+		{MakerOrderID: maker3.KernelOrderID, TakerOrderID: taker.KernelOrderID, Price: 1000, Size: 5, Notional: 5000,
+			MakerFee: 5, TakerFee: 5, FeeCurrency: "USDT"},
+	}, fills)
+	acceptor.kernel.Stop()
+}
+
+func Test_MatchingEngine_Fees(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_fees")
+	assert.NotNil(t, engine.SetFeeSchedule(&types.FeeSchedule{}))
+	assert.Nil(t, engine.SetFeeSchedule(newTestFeeSchedule()))
+	engine.Start()
+
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 1000, Left: 10, AccountID: 1})
+	engine.SubmitOrder(&types.KernelOrder{Amount: -10, Price: 1000, Left: -10, AccountID: 2})
+	select {
+	case r := <-engine.MatchedInfoChan():
+		assert.Equal(t, 1, len(r.Fills))
+		assert.Equal(t, int64(-1), r.Fills[0].MakerFee)
+		assert.Equal(t, int64(20), r.Fills[0].TakerFee)
+		assert.Equal(t, "USDT", r.Fills[0].FeeCurrency)
+	case <-time.After(time.Second):
+		t.Fatal("expected a trade")
+	}
+	engine.Stop()
+
+	// without a schedule the fills have no fee
+	x, err := NewExchange(1, "test_exchange_fees", newTestInstruments("AAA"))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, x.SetFeeSchedule("BBB", newTestFeeSchedule()), ErrUnknownSymbol)
+	x.Start()
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: 10, Price: 1000, Left: 10, AccountID: 1}))
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: -10, Price: 1000, Left: -10, AccountID: 2}))
+	select {
+	case e := <-x.Events():
+		assert.Equal(t, []Fill{{MakerOrderID: e.Fills[0].MakerOrderID, TakerOrderID: e.TakerOrder.KernelOrderID,
+			Price: 1000, Size: 10, Notional: 10000}}, e.Fills)
+	case <-time.After(time.Second):
+		t.Fatal("expected a trade")
+	}
+	x.Stop()
+}
@@ -0,0 +1,122 @@
+package ker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func newTestInstrument() *types.Instrument {
+	ins := &types.Instrument{
+		Symbol:   "TEST",
+		TickSize: 10,
+		LotSize:  5,
+		MinQty:   5,
+		MaxQty:   1000,
+	}
+	if err := ins.Validate(); err != nil {
+		panic(err)
+	}
+	return ins
+}
+
+func Test_orderAcceptor_InstrumentReject(t *testing.T) {
+	acceptor := initAcceptor(1, "test_instrument_reject")
+	acceptor.instrument = newTestInstrument()
+	go acceptor.orderAcceptor()
+	acceptor.startDummyOrderReceivedChan()
+	acceptor.kernel.startDummyMatchedInfoChan()
+
+	offTick := newTestBidOrder(205, 100)
+	acceptor.newOrderChan <- offTick
+	kerr := <-acceptor.kernel.errorInfoChan
+	var reject *OrderRejectErr
+	assert.True(t, errors.As(kerr, &reject))
+	assert.Equal(t, types.REJECT_OFF_TICK, reject.Reason)
+	assert.Equal(t, types.REJECTED, reject.Order.Status)
+	assert.Equal(t, types.OPEN, offTick.Status)
+
+	offLot := newTestAskOrder(200, 101)
+	acceptor.newOrderChan <- offLot
+	kerr = <-acceptor.kernel.errorInfoChan
+	assert.True(t, errors.As(kerr, &reject))
+	assert.Equal(t, types.REJECT_OFF_LOT, reject.Reason)
+
+	tooLarge := newTestAskOrder(200, 2000)
+	acceptor.newOrderChan <- tooLarge
+	kerr = <-acceptor.kernel.errorInfoChan
+	assert.True(t, errors.As(kerr, &reject))
+	assert.Equal(t, types.REJECT_QTY_TOO_LARGE, reject.Reason)
+	assert.Contains(t, kerr.Error(), "size too large")
+
+	valid := newTestBidOrder(200, 100)
+	acceptor.newOrderChan <- valid
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, acceptor.kernel.bid.Length)
+	assert.Equal(t, 0, acceptor.kernel.ask.Length)
+	assert.Equal(t, int64(200), acceptor.kernel.bid1Price)
+
+	acceptor.kernel.Stop()
+}
+
+func Test_MatchingEngine_SetInstrument(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_instrument")
+	assert.NotNil(t, engine.SetInstrument(&types.Instrument{Symbol: "BAD"}))
+	assert.Nil(t, engine.SetInstrument(newTestInstrument()))
+	engine.Start()
+
+	engine.SubmitOrder(newTestBidOrder(203, 100))
+	select {
+	case err := <-engine.ErrorInfoChan():
+		var reject *OrderRejectErr
+		assert.True(t, errors.As(err, &reject))
+		assert.Equal(t, types.REJECT_OFF_TICK, reject.Reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected an order reject")
+	}
+
+	engine.SubmitOrder(newTestBidOrder(200, 100))
+	assert.Eventually(t, func() bool {
+		return engine.BestBid() == 200
+	}, time.Second, 10*time.Millisecond)
+
+	engine.Stop()
+}
+
+func Test_MatchingEngine_ErrorInfoChanFull(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_errors_full")
+	assert.Nil(t, engine.SetInstrument(newTestInstrument()))
+	engine.Start()
+
+	// nobody reads the rejects, the ones past the buffer are dropped and matching goes on
+	for i := 0; i < 300; i++ {
+		engine.SubmitOrder(newTestBidOrder(203, 100))
+	}
+	engine.SubmitOrder(newTestBidOrder(200, 100))
+	assert.Eventually(t, func() bool { return engine.BestBid() == 200 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return engine.DroppedErrors() == 300-256 }, time.Second, time.Millisecond)
+	assert.Equal(t, 256, len(engine.ErrorInfoChan()))
+	engine.Stop()
+}
+
+func Test_Exchange_ErrorInfoChanFull(t *testing.T) {
+	instruments := newTestInstruments("AAA", "BBB")
+	instruments["AAA"].TickSize = 5
+	x, err := NewExchange(1, "test_exchange_errors_full", instruments)
+	assert.Nil(t, err)
+	x.Start()
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(203, 100)))
+	}
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(200, 100)))
+	assert.Eventually(t, func() bool {
+		bid, _ := x.BestBid("BBB")
+		return bid == 200
+	}, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return x.DroppedErrors() == 300-256 }, time.Second, time.Millisecond)
+	x.Stop()
+}
@@ -8,11 +8,8 @@ package ker
 import (
 	"container/list"
 	"context"
-	"fmt"
 	"log"
 	"math"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 
@@ -25,18 +22,35 @@ type kernel struct {
 	ask1Price       int64
 	bid1Price       int64
 	matchedInfoChan chan *matchedInfo
-	errorInfoChan   chan *KernelErr
+	errorInfoChan   chan KernelErr
 	pauseChan       chan bool
+	snapshotChan    chan *snapshotRequest // snapshots taken by the acceptor between two orders
 	ask1PriceMux    sync.Mutex
 	bid1PriceMux    sync.Mutex
 	ctx             context.Context
 	cancel          context.CancelFunc
+	tickSize        int64              // price increment pegged orders are aligned to
+	lotSize         int64              // size increment quote-budget orders are filled in
+	qtyScale        int64              // raw size units representing 1, notionals are size * price / qtyScale
+	fees            *types.FeeSchedule // nil means no fees
+	ledger          *ledger            // nil means no balance checks
+	base, quote     string             // ledger assets of the instrument
+	positions       *positionBook      // nil means positions are not tracked
+	pegged          *list.List         // resting pegged orders, oldest first
+	askChanges      map[float64]bool   // keys of the levels changed since the last snapshot, nil if not tracked
+	bidChanges      map[float64]bool
+	lastCapture     int64       // creation time of the last snapshot captured, the one deltas apply to
+	held            *heldEvents // events of applied orders waiting for the fsync of their records, nil sends them at once
 }
 
 type matchedInfo struct {
-	makerOrders    []types.KernelOrder
-	matchedSizeMap map[uint64]int64
-	takerOrder     types.KernelOrder
+	makerOrders      []types.KernelOrder
+	matchedSizeMap   map[uint64]int64
+	takerOrder       types.KernelOrder
+	massCancelReport *MassCancelReport // set on the summary of a mass-cancel request only
+	reprice          *PegReprice       // set when takerOrder is a repriced pegged order only
+	fills            []Fill            // one per maker order of a trade
+	postings         []Posting         // ledger entries of the fills
 }
 
 type KernelErr error
@@ -83,86 +97,35 @@ func (k *kernel) fullDepth() *orderBook {
 	}
 }
 
-// should stop kernel before calling this func
-func (k *kernel) takeSnapshot(description string, lastKernelOrder *types.KernelOrder) {
-	uTime := time.Now().Unix()
-	uTimeFmt := strconv.FormatInt(uTime, 10)
-	askBasePath := kernelSnapshotPath + description + "/" + uTimeFmt + "/ask/"
-	bidBasePath := kernelSnapshotPath + description + "/" + uTimeFmt + "/bid/"
-	_ = os.MkdirAll(askBasePath, 0755)
-	_ = os.MkdirAll(bidBasePath, 0755)
-
-	wg := sync.WaitGroup{}
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for bucket := k.ask.Front(); bucket != nil; bucket = bucket.Next() {
-			pb := bucket.value.(*priceBucket)
-			order := pb.l.Front().Value.(*types.KernelOrder)
-			price := order.Price
-			path := askBasePath + strconv.FormatInt(price, 10) + ".list"
-			f, err := os.OpenFile(path, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				panic(err.Error())
-			}
-			bytes := kernelOrderListToBytes(pb.l)
-			_, err = f.Write(bytes)
-			if err != nil {
-				panic(err.Error())
-			}
-			err = f.Close()
-			if err != nil {
-				panic(err.Error())
-			}
-		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for bucket := k.bid.Front(); bucket != nil; bucket = bucket.Next() {
-			pb := bucket.value.(*priceBucket)
-			order := pb.l.Front().Value.(*types.KernelOrder)
-			price := order.Price
-			path := bidBasePath + strconv.FormatInt(price, 10) + ".list"
-			f, err := os.OpenFile(path, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				panic(err.Error())
-			}
-			bytes := kernelOrderListToBytes(pb.l)
-			_, err = f.Write(bytes)
-			if err != nil {
-				panic(err.Error())
-			}
-			err = f.Close()
-			if err != nil {
-				panic(err.Error())
-			}
-		}
-	}()
-
-	wg.Wait()
-	f, _ := os.OpenFile(kernelSnapshotPath+description+"/"+uTimeFmt+"/finished.log", os.O_EXCL|os.O_CREATE|os.O_WRONLY|os.O_SYNC, 0644)
-	_, _ = f.WriteString(fmt.Sprintln(*lastKernelOrder) + "If you see this file, it means snapshot is completed.")
-	_ = f.Close()
-}
-
 // should sync call
 func (k *kernel) cancelOrder(order *types.KernelOrder) {
-	get := k.ask.Get(float64(order.Price))
+	refs := k.pegRefs()
+	k.removeOrder(order)
+	k.repriceIfMoved(refs)
+}
+
+func (k *kernel) removeOrder(order *types.KernelOrder) {
+	price := order.Price
+	// pegged orders may have moved since the client saw them
+	if pegged := k.findPegged(order.KernelOrderID); pegged != nil {
+		price = pegged.Price
+	}
+	get := k.ask.Get(float64(price))
 	if get != nil {
+		k.markChanged(k.ask, float64(price))
 		bucket := get.Value().(*priceBucket)
 		for i := bucket.l.Front(); i != nil; i = i.Next() {
 			kernelOrder := i.Value.(*types.KernelOrder)
 			if kernelOrder.KernelOrderID == order.KernelOrderID {
 				bucket.Left -= kernelOrder.Left
 				bucket.l.Remove(i)
+				kernelOrder.Status = types.CANCELLED
+				k.releaseFunds(kernelOrder)
 				break
 			}
 		}
 		if bucket.Left == 0 {
-			k.ask.Remove(float64(order.Price))
+			k.ask.Remove(float64(price))
 		}
 		if k.ask.Length == 0 {
 			k.ask1PriceMux.Lock()
@@ -177,19 +140,22 @@ func (k *kernel) cancelOrder(order *types.KernelOrder) {
 		return
 	}
 
-	get2 := k.bid.Get(float64(-order.Price))
+	get2 := k.bid.Get(float64(-price))
 	if get2 != nil {
+		k.markChanged(k.bid, float64(-price))
 		bucket := get2.Value().(*priceBucket)
 		for i := bucket.l.Front(); i != nil; i = i.Next() {
 			kernelOrder := i.Value.(*types.KernelOrder)
 			if kernelOrder.KernelOrderID == order.KernelOrderID {
 				bucket.Left -= kernelOrder.Left
 				bucket.l.Remove(i)
+				kernelOrder.Status = types.CANCELLED
+				k.releaseFunds(kernelOrder)
 				break
 			}
 		}
 		if bucket.Left == 0 {
-			k.bid.Remove(float64(-order.Price))
+			k.bid.Remove(float64(-price))
 		}
 		if k.bid.Length == 0 {
 			k.bid1PriceMux.Lock()
@@ -209,6 +175,7 @@ func (k *kernel) cancelOrder(order *types.KernelOrder) {
 // after price & amount checked, Conditional asynchronous, orders (at different prices) that (cannot be executed) can be inserted simultaneously, both of the above conditions must be met at the same time.
 func (k *kernel) insertUnmatchedOrder(order *types.KernelOrder) bool {
 	if order.Amount < 0 {
+		k.markChanged(k.ask, float64(order.Price))
 		get := k.ask.Get(float64(order.Price))
 		if get != nil {
 			bucket := get.Value().(*priceBucket)
@@ -230,6 +197,7 @@ func (k *kernel) insertUnmatchedOrder(order *types.KernelOrder) bool {
 			return true
 		}
 	} else {
+		k.markChanged(k.bid, float64(-order.Price))
 		get := k.bid.Get(float64(-order.Price))
 		if get != nil {
 			bucket := get.Value().(*priceBucket)
@@ -267,7 +235,7 @@ func (k *kernel) clearBucket(e *Element, takerOrder types.KernelOrder, wg *sync.
 	element := bucket.l.Back()
 	for v := element; v != nil; v = v.Prev() {
 		matchedOrder := v.Value.(*types.KernelOrder)
-		matchedOrder.FilledTotal += matchedOrder.Left * matchedOrder.Price
+		matchedOrder.FilledTotal += k.notional(matchedOrder.Left, matchedOrder.Price)
 		matchingInfo.matchedSizeMap[matchedOrder.KernelOrderID] = matchedOrder.Left
 		matchedOrder.Left = 0
 		matchedOrder.Status = types.CLOSED
@@ -275,7 +243,8 @@ func (k *kernel) clearBucket(e *Element, takerOrder types.KernelOrder, wg *sync.
 		makerOrders = append(makerOrders, *matchedOrder)
 	}
 	matchingInfo.makerOrders = makerOrders
-	k.matchedInfoChan <- matchingInfo
+	k.recordTrades(matchingInfo)
+	k.sendMatchedInfo(matchingInfo)
 }
 
 // run in single thread, Need to ensure that the orders can be matched
@@ -287,11 +256,11 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 		// cancel
 		takerOrder.UpdateTime = time.Now().UnixNano()
 		takerOrder.Status = types.CANCELLED
-		k.matchedInfoChan <- &matchedInfo{
+		k.sendMatchedInfo(&matchedInfo{
 			makerOrders:    nil,
 			matchedSizeMap: nil,
 			takerOrder:     *takerOrder,
-		}
+		})
 		return
 	}
 	// FOK : Fill Or Kill
@@ -311,17 +280,18 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 			// cancel all
 			takerOrder.UpdateTime = time.Now().UnixNano()
 			takerOrder.Status = types.CANCELLED
-			k.matchedInfoChan <- &matchedInfo{
+			k.sendMatchedInfo(&matchedInfo{
 				makerOrders:    nil,
 				matchedSizeMap: nil,
 				takerOrder:     *takerOrder,
-			}
+			})
 			return
 		}
 	}
 
-	// GTC takerOrder
-	if takerOrder.TimeInForce == types.GTC || takerOrder.TimeInForce == types.IOC {
+	if takerOrder.QuoteBudget != 0 {
+		k.matchWithinBudget(targetSide, takerOrder, removeBucketKeyList)
+	} else if takerOrder.TimeInForce == types.GTC || takerOrder.TimeInForce == types.IOC { // GTC takerOrder
 	Loop:
 		for skipListElement := targetSide.Front(); skipListElement != nil; skipListElement = skipListElement.Next() {
 			bucket := skipListElement.Value().(*priceBucket)
@@ -334,7 +304,7 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 			if (isAsk && bucket.Left <= -takerOrder.Left) || (!isAsk && bucket.Left >= -takerOrder.Left) {
 				// async clear price bucket
 				takerOrder.Left += bucket.Left
-				takerOrder.FilledTotal -= bucket.Left * bucketListHead.Price
+				takerOrder.FilledTotal -= k.notional(bucket.Left, bucketListHead.Price)
 				if takerOrder.Left == 0 {
 					takerOrder.Status = types.CLOSED
 				}
@@ -346,6 +316,7 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 				if takerOrder.Left == 0 {
 					break Loop
 				}
+				k.markChanged(targetSide, skipListElement.key)
 				matchingInfo := &matchedInfo{
 					makerOrders:    make([]types.KernelOrder, 0, bucket.l.Len()),
 					matchedSizeMap: make(map[uint64]int64),
@@ -359,8 +330,9 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 						// clear matched maker Order
 						bucket.Left -= matchedOrder.Left
 						takerOrder.Left += matchedOrder.Left
-						matchedOrder.FilledTotal += matchedOrder.Left * matchedOrder.Price
-						takerOrder.FilledTotal -= matchedOrder.Left * matchedOrder.Price
+						notional := k.notional(matchedOrder.Left, matchedOrder.Price)
+						matchedOrder.FilledTotal += notional
+						takerOrder.FilledTotal -= notional
 						matchingInfo.matchedSizeMap[matchedOrder.KernelOrderID] = matchedOrder.Left
 						matchedOrder.Left = 0
 						matchedOrder.Status = types.CLOSED
@@ -371,8 +343,9 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 						bucket.l.Remove(rm)
 					} else {
 						// After consuming the matchedOrder, there is still a remainder
-						matchedOrder.FilledTotal -= takerOrder.Left * matchedOrder.Price
-						takerOrder.FilledTotal += takerOrder.Left * matchedOrder.Price
+						notional := k.notional(takerOrder.Left, matchedOrder.Price)
+						matchedOrder.FilledTotal -= notional
+						takerOrder.FilledTotal += notional
 						matchingInfo.matchedSizeMap[matchedOrder.KernelOrderID] = -takerOrder.Left
 						matchedOrder.Left += takerOrder.Left
 						bucket.Left += takerOrder.Left
@@ -385,7 +358,8 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 						takerOrder.Status = types.CLOSED
 						matchingInfo.takerOrder = *takerOrder
 						// send matched info.
-						k.matchedInfoChan <- matchingInfo
+						k.recordTrades(matchingInfo)
+						k.sendMatchedInfo(matchingInfo)
 						break Loop
 					}
 				}
@@ -396,11 +370,11 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 		if takerOrder.TimeInForce == types.IOC {
 			takerOrder.UpdateTime = time.Now().UnixNano()
 			takerOrder.Status = types.CANCELLED
-			k.matchedInfoChan <- &matchedInfo{
+			k.sendMatchedInfo(&matchedInfo{
 				makerOrders:    nil,
 				matchedSizeMap: nil,
 				takerOrder:     *takerOrder,
-			}
+			})
 		} else if takerOrder.Left != 0 {
 			// The remaining part that can't be executed is inserted into the sell order queue
 			k.insertUnmatchedOrder(takerOrder)
@@ -409,6 +383,7 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 
 	// remove cleared bucket
 	for e := removeBucketKeyList.Front(); e != nil; e = e.Next() {
+		k.markChanged(targetSide, e.Value.(float64))
 		targetSide.Remove(e.Value.(float64))
 	}
 
@@ -433,6 +408,39 @@ func (k *kernel) matchingOrder(targetSide *SkipList, takerOrder *types.KernelOrd
 	}
 }
 
+// placeOrder sends a new accepted order to the book, it rests or matches depending on the best opposite price.
+// Quote-budget orders always go through matchingOrder, which sizes them to their budget.
+func (k *kernel) placeOrder(order *types.KernelOrder) {
+	if order.Type != types.LIMIT && (order.Type != types.MARKET || order.QuoteBudget == 0) {
+		panic("Unsuported OrderType")
+	}
+	refs := k.pegRefs()
+	defer k.repriceIfMoved(refs)
+	if order.PegType != types.NO_PEG {
+		k.pegged.PushBack(order)
+	}
+	if order.Amount > 0 {
+		if order.Price < k.ask1Price && order.QuoteBudget == 0 {
+			k.insertUnmatchedOrder(order)
+		} else {
+			k.matchingOrder(k.ask, order, false)
+		}
+	} else {
+		if order.Price > k.bid1Price {
+			k.insertUnmatchedOrder(order)
+		} else {
+			k.matchingOrder(k.bid, order, true)
+		}
+	}
+	// after the matching goroutines are done, so that every fill is settled before the release
+	if order.Status != types.OPEN {
+		k.releaseFunds(order)
+	}
+	if k.positions != nil {
+		k.positions.flush(order)
+	}
+}
+
 func newKernel() *kernel {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &kernel{
@@ -441,97 +449,20 @@ func newKernel() *kernel {
 		ask1Price:       math.MaxInt64,
 		bid1Price:       math.MinInt64,
 		matchedInfoChan: make(chan *matchedInfo),
-		errorInfoChan:   make(chan *KernelErr),
+		errorInfoChan:   make(chan KernelErr),
 		pauseChan:       make(chan bool),
+		snapshotChan:    make(chan *snapshotRequest),
 		ask1PriceMux:    sync.Mutex{},
 		bid1PriceMux:    sync.Mutex{},
 		ctx:             ctx,
 		cancel:          cancel,
+		tickSize:        1,
+		lotSize:         1,
+		qtyScale:        1,
+		pegged:          list.New(),
 	}
 }
 
-func restoreKernel(path string) (*kernel, bool) {
-	ker := newKernel()
-
-	_, err := os.Stat(path + "finished.log")
-	if os.IsNotExist(err) {
-		log.Println("check file: finished.log not found")
-		return nil, false
-	}
-
-	wg := &sync.WaitGroup{}
-
-	askDir, err := os.ReadDir(path + "ask/")
-	if err != nil {
-		log.Println(err.Error())
-		return nil, false
-	}
-
-	for i := range askDir {
-		wg.Add(1)
-		i := i
-		go func() {
-			defer wg.Done()
-			bytes, err := os.ReadFile(path + "ask/" + askDir[i].Name())
-			//fmt.Println(askDir[i].Name())
-			if err != nil {
-				log.Println(err.Error())
-			}
-			l := readListFromBytes(bytes)
-			price := l.Front().Value.(*types.KernelOrder).Price
-			var left int64
-			for j := l.Front(); j != nil; j = j.Next() {
-				left += j.Value.(*types.KernelOrder).Left
-			}
-			ker.ask.Set(float64(price), &priceBucket{
-				l:    l,
-				Left: left,
-			})
-		}()
-
-	}
-
-	bidDir, err := os.ReadDir(path + "bid/")
-	if err != nil {
-		log.Println(err.Error())
-		return nil, false
-	}
-
-	for i := range bidDir {
-		wg.Add(1)
-		i := i
-		go func() {
-			defer wg.Done()
-			bytes, err := os.ReadFile(path + "bid/" + bidDir[i].Name())
-			if err != nil {
-				log.Println(err.Error())
-			}
-			l := readListFromBytes(bytes)
-			price := l.Front().Value.(*types.KernelOrder).Price
-			var left int64
-			for j := l.Front(); j != nil; j = j.Next() {
-				left += j.Value.(*types.KernelOrder).Left
-			}
-			ker.bid.Set(float64(-price), &priceBucket{
-				l:    l,
-				Left: left,
-			})
-		}()
-	}
-
-	wg.Wait()
-
-	if ker.ask.Length != 0 {
-		ker.ask1Price = ker.ask.Front().value.(*priceBucket).l.Front().Value.(*types.KernelOrder).Price
-	}
-
-	if ker.bid.Length != 0 {
-		ker.bid1Price = ker.bid.Front().value.(*priceBucket).l.Front().Value.(*types.KernelOrder).Price
-	}
-
-	return ker, true
-}
-
 func (k *kernel) startDummyMatchedInfoChan() {
 	go func() {
 		for {
@@ -540,6 +471,14 @@ func (k *kernel) startDummyMatchedInfoChan() {
 	}()
 }
 
+func (k *kernel) startDummyErrorInfoChan() {
+	go func() {
+		for {
+			<-k.errorInfoChan
+		}
+	}()
+}
+
 func (k *kernel) Pause() {
 	k.pauseChan <- true
 }
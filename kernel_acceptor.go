@@ -8,8 +8,6 @@ package ker
 import (
 	"log"
 	"math"
-	"math/rand"
-	"os"
 	"time"
 
 	"github.com/Curton/GoMatchingKernel/types"
@@ -23,11 +21,25 @@ type scheduler struct {
 	redoOrderChan       chan *types.KernelOrder  // redo orders are sending to the channel
 	orderReceivedChan   chan *types.KernelOrder  // get order received confirmation
 	internalRequestChan chan internalRequestCode // reserve
+	requestChan         chan *internalRequest    // commands run by the acceptor between two orders
+	batchChan           chan *orderBatch         // batches of orders handed off at once
 	serverId            uint64
 	serverMask          uint64
 	acceptorDescription string
-	r                   *rand.Rand
-	f                   *[1]*os.File // kernelOrder logger file
+	instrument          *types.Instrument               // reference data orders are validated against, nil to skip
+	symbol              string                          // instrument symbol when hosted by an Exchange
+	sharedLog           *sharedOrderLog                 // WAL shared with the other instruments of an Exchange
+	sessions            *sessionManager                 // liveness of the gateway sessions orders are tagged with
+	risk                *riskControl                    // pre-trade risk checks of new orders
+	limiter             *rateLimiter                    // order rate limits of the accounts and sessions
+	quotes              map[uint64][]*types.KernelOrder // orders of the last mass quote of each account
+	life                *lifecycle                      // intake and shutdown state of the primary acceptor
+	lastOrder           *types.KernelOrder              // last order written to the WAL
+	logged              uint64                          // records of the book written to the WAL, shared or not, counted if it is disabled too
+	group               walGroup                        // orders waiting for the fsync of a group commit
+	ids                 idGenerator                     // KernelOrderIDs of new orders
+	periodic            *snapshotSchedule               // periodic snapshots of the primary kernel, nil if disabled
+	wal                 *orderLog                       // kernelOrder log
 }
 
 type redoKernelStatus uint8
@@ -47,6 +59,83 @@ const (
 // internalRequestCode represents a code for internal requests.
 type internalRequestCode uint16
 
+const (
+	MASS_CANCEL internalRequestCode = iota + 1
+	LEDGER_TRANSFER
+	MASS_QUOTE
+)
+
+// internalRequest is a command executed by the acceptor goroutine between two orders,
+// so that it reads and changes the order book atomically with respect to the order flow.
+type internalRequest struct {
+	code  internalRequestCode
+	args  interface{}
+	reply chan interface{}
+}
+
+// request sends a command to the acceptor and waits for its result, nil if the kernel is stopped.
+func (s *scheduler) request(code internalRequestCode, args interface{}) interface{} {
+	req := &internalRequest{
+		code:  code,
+		args:  args,
+		reply: make(chan interface{}, 1),
+	}
+	if !s.enter() {
+		return nil
+	}
+	defer s.leave()
+	select {
+	case s.requestChan <- req:
+	case <-s.life.closing:
+		return nil
+	case <-s.kernel.ctx.Done():
+		return nil
+	}
+	select {
+	case r := <-req.reply:
+		return r
+	case <-s.kernel.ctx.Done():
+		return nil
+	}
+}
+
+// requestMassCancel runs a mass-cancel in the acceptor, an empty report is returned if the kernel is stopped.
+func (s *scheduler) requestMassCancel(filter *MassCancel) *MassCancelReport {
+	report, ok := s.request(MASS_CANCEL, filter).(*MassCancelReport)
+	if !ok {
+		return &MassCancelReport{Filter: *filter}
+	}
+	return report
+}
+
+// requestTransfer runs a deposit or withdrawal in the acceptor, so that it is journaled in order with the orders.
+func (s *scheduler) requestTransfer(account uint64, asset string, amount int64) error {
+	if s.kernel.ledger == nil {
+		return ErrLedgerDisabled
+	}
+	t, ok := s.request(LEDGER_TRANSFER, &ledgerTransfer{account: account, asset: asset, amount: amount}).(*ledgerTransfer)
+	if !ok {
+		return ErrStopped
+	}
+	return t.err
+}
+
+// handleRequest runs in the acceptor goroutine of the primary kernel, after the pending group commit.
+func (s *scheduler) handleRequest(req *internalRequest) {
+	s.commit()
+	switch req.code {
+	case MASS_CANCEL:
+		req.reply <- s.massCancel(req.args.(*MassCancel))
+	case LEDGER_TRANSFER:
+		req.reply <- s.transfer(req.args.(*ledgerTransfer))
+	case MASS_QUOTE:
+		req.reply <- s.massQuote(req.args.(*MassQuote))
+	default:
+		log.Println("Unknown internal request code: ", req.code)
+		req.reply <- nil
+	}
+}
+
 // orderAcceptor should be run in a goroutine. It processes new orders and checks if they are limit or market orders.
 // classify limit orders and market orders
 func (s *scheduler) orderAcceptor(kernelFlag ...int) {
@@ -59,6 +148,11 @@ func (s *scheduler) orderAcceptor(kernelFlag ...int) {
 	var orderChan chan *types.KernelOrder
 	var kernel *kernel
 	var orderReceivedChan chan *types.KernelOrder
+	var requestChan chan *internalRequest
+	var batchChan chan *orderBatch
+	var closing chan struct{}
+	var group *walGroup
+	var periodic *snapshotSchedule
 
 	if numArgs == 1 {
 		if kernelFlag[0] == REDO_KERNEL {
@@ -80,6 +174,14 @@ func (s *scheduler) orderAcceptor(kernelFlag ...int) {
 		orderChan = s.newOrderChan
 		kernel = s.kernel
 		orderReceivedChan = s.orderReceivedChan
+		requestChan = s.requestChan
+		batchChan = s.batchChan
+		closing = s.life.closing
+		group = &s.group
+		periodic = s.periodic
+		defer s.life.doneOnce.Do(func() { close(s.life.done) })
+		periodic.start()
+		defer periodic.stop()
 	}
 
 	paused := false
@@ -88,6 +190,9 @@ func (s *scheduler) orderAcceptor(kernelFlag ...int) {
 			select {
 			case <-s.kernel.ctx.Done():
 				return
+			case <-closing:
+				s.drain()
+				return
 			case <-kernel.pauseChan:
 				paused = false
 			}
@@ -95,74 +200,258 @@ func (s *scheduler) orderAcceptor(kernelFlag ...int) {
 			select {
 			case <-s.kernel.ctx.Done():
 				return
+			case <-closing:
+				s.drain()
+				return
 			case <-kernel.pauseChan:
+				if group != nil {
+					s.commit()
+				}
 				paused = true
+			case <-group.due():
+				s.commit()
+			case req := <-requestChan:
+				s.handleRequest(req)
 			case order := <-orderChan:
-				if math.Abs(float64(order.Left)) > math.Abs(float64(order.Amount)) && (order.Amount != 0) {
-					log.Println("Invalid order: Left exceeds Amount")
-					continue
-				}
-				if (order.Left < 0 && order.Amount > 0) || (order.Left > 0 && order.Amount < 0) {
-					log.Println("Invalid order: Left and Amount have different signs")
-					continue
-				}
-				kernelOrder := *order
-				kernelOrder.CreateTime = time.Now().UnixNano()
-				uint64R := uint64(s.r.Int63())
-				kernelOrder.KernelOrderID = (uint64R >> (16 - 1)) | s.serverMask
-
-				if saveOrderLog && numArgs == 0 {
-					if !writeOrderLog(s.f, s.acceptorDescription, order) {
-						log.Panicln("Error in writing order log.")
-					}
-				}
+				s.accept(kernel, order, numArgs != 0, orderReceivedChan)
+			case batch := <-batchChan:
+				s.acceptBatch(batch)
+			case req := <-kernel.snapshotChan:
+				s.snapshot(kernel, req, numArgs != 0)
+			case <-periodic.tick():
+			case <-periodic.finished():
+				periodic.busy = false
+			}
+			if periodic != nil {
+				s.periodicSnapshot(kernel)
+			}
+		}
+	}
+}
 
-				if order.Amount == 0 {
-					order.Status = types.CANCELLED
-					orderReceivedChan <- order
-					kernel.cancelOrder(order)
-					continue
-				}
+// accept admits an order and applies it, should sync call.
+func (s *scheduler) accept(kernel *kernel, order *types.KernelOrder, redo bool, orderReceivedChan chan *types.KernelOrder) {
+	if !redo && s.grouped() {
+		s.acceptGrouped(order)
+		return
+	}
+	admitted, reason := s.admit(kernel, order, redo, s.journal(redo))
+	if reason != types.REJECT_NONE {
+		if redo {
+			log.Println("Redo order rejected: ", order.KernelOrderID, reason)
+		} else {
+			rejectOrder(kernel, order, reason)
+		}
+	}
+	if admitted != nil {
+		s.apply(kernel, admitted, orderReceivedChan)
+	}
+}
 
-				orderReceivedChan <- &kernelOrder
-
-				if kernelOrder.Type == types.LIMIT {
-					if kernelOrder.Amount > 0 {
-						if kernelOrder.Price < kernel.ask1Price {
-							kernel.insertUnmatchedOrder(&kernelOrder)
-						} else {
-							kernel.matchingOrder(kernel.ask, &kernelOrder, false)
-						}
-					} else {
-						if kernelOrder.Price > kernel.bid1Price {
-							kernel.insertUnmatchedOrder(&kernelOrder)
-						} else {
-							kernel.matchingOrder(kernel.bid, &kernelOrder, true)
-						}
-					}
-				} else {
-					panic("Unsuported OrderType")
-				}
+// journal returns the function writing admitted orders to the WAL, redo kernels don't write.
+func (s *scheduler) journal(redo bool) func(*types.KernelOrder) {
+	return func(order *types.KernelOrder) {
+		if !redo && !s.logOrder(order) {
+			log.Panicln("Error in writing order log.")
+		}
+	}
+}
+
+// admit runs the checks of an order, assigns its ID and journals it, should sync call. It returns the order
+// to apply, nil if it was dropped or rejected, and the reject reason. Checks and IDs are only done by the
+// primary kernel, redo orders keep the ID assigned by the primary kernel, so that logged cancels still apply.
+func (s *scheduler) admit(kernel *kernel, order *types.KernelOrder, redo bool, journal func(*types.KernelOrder)) (*types.KernelOrder, types.RejectReason) {
+	if order.Type == types.TRANSFER {
+		// transfers are sent as internal requests, only the WAL replay sees them as orders
+		if redo && kernel.ledger != nil {
+			kernel.applyTransfer(order)
+		} else if !redo {
+			log.Println("Invalid order: transfer records are not accepted as orders")
+		}
+		return nil, types.REJECT_NONE
+	}
+	if math.Abs(float64(order.Left)) > math.Abs(float64(order.Amount)) && (order.Amount != 0) {
+		log.Println("Invalid order: Left exceeds Amount")
+		return nil, types.REJECT_NONE
+	}
+	if (order.Left < 0 && order.Amount > 0) || (order.Left > 0 && order.Amount < 0) {
+		log.Println("Invalid order: Left and Amount have different signs")
+		return nil, types.REJECT_NONE
+	}
+	if !redo && order.SessionID != 0 && order.Amount != 0 && !s.sessions.alive(order.SessionID) {
+		return nil, types.REJECT_SESSION_CLOSED
+	}
+	if !redo && order.Amount != 0 && !s.limiter.allow(order) {
+		return nil, types.REJECT_THROTTLED
+	}
+	// redo orders are logged with the price computed here
+	if !redo && order.PegType != types.NO_PEG && order.Amount != 0 {
+		price, ok := kernel.pegPrice(order)
+		if !ok {
+			return nil, types.REJECT_NO_PEG_REFERENCE
+		}
+		pegged := *order
+		pegged.Price = price
+		order = &pegged
+	}
+	if !redo && order.Amount != 0 {
+		if reason := checkQuoteBudget(order); reason != types.REJECT_NONE {
+			return nil, reason
+		}
+	}
+	if !redo && order.Amount != 0 {
+		if reason := kernel.checkNotional(order); reason != types.REJECT_NONE {
+			return nil, reason
+		}
+	}
+	if !redo && s.instrument != nil {
+		if reason := s.instrument.CheckOrder(order); reason != types.REJECT_NONE {
+			return nil, reason
+		}
+	}
+	if !redo && order.Amount != 0 {
+		if reason := s.risk.check(order, kernel.ask1Price, kernel.bid1Price); reason != types.REJECT_NONE {
+			return nil, reason
+		}
+	}
+	if order.Amount == 0 {
+		journal(order)
+		return order, types.REJECT_NONE
+	}
+
+	kernelOrder := *order
+	if !redo {
+		kernelOrder.CreateTime = time.Now().UnixNano()
+		kernelOrder.KernelOrderID = (s.ids.next() >> (16 - 1)) | s.serverMask
+	}
+	if kernel.ledger != nil {
+		if reason := kernel.reserve(&kernelOrder, func() { journal(&kernelOrder) }); reason != types.REJECT_NONE {
+			if !redo {
+				// the IDs drawn are those of the new orders in the WAL
+				s.ids.undo()
 			}
+			return nil, reason
+		}
+	} else {
+		journal(&kernelOrder)
+	}
+	if !redo {
+		s.risk.track(&kernelOrder)
+	}
+	return &kernelOrder, types.REJECT_NONE
+}
+
+// apply acknowledges an admitted order and executes it, should sync call.
+func (s *scheduler) apply(kernel *kernel, order *types.KernelOrder, orderReceivedChan chan *types.KernelOrder) {
+	if order.Amount == 0 {
+		order.Status = types.CANCELLED
+		kernel.sendReceived(orderReceivedChan, order)
+		kernel.cancelOrder(order)
+		return
+	}
+	kernel.sendReceived(orderReceivedChan, order)
+	kernel.placeOrder(order)
+}
+
+// setInstrument sets the reference data orders are validated against, pegged orders follow its tick size,
+// quote-budget orders its lot size and notionals its quantity scale.
+func (s *scheduler) setInstrument(ins *types.Instrument) {
+	s.instrument = ins
+	if ins.TickSize > 0 {
+		s.kernel.tickSize = ins.TickSize
+	}
+	if ins.LotSize > 0 {
+		s.kernel.lotSize = ins.LotSize
+	}
+	if ins.QtyScale > 0 {
+		s.kernel.qtyScale = ins.QtyScale
+		s.risk.scale = ins.QtyScale
+	}
+}
+
+// logOrder writes an accepted order to the WAL, the shared one if the scheduler belongs to an Exchange.
+// With group commit the record is fsynced at once, unless a group collects it. If the WAL is disabled,
+// see SetSaveOrderLog, the record is only counted, so that the periodic snapshots still see the book change.
+func (s *scheduler) logOrder(order *types.KernelOrder) bool {
+	if !saveOrderLog {
+		s.logged++
+		return true
+	}
+	s.lastOrder = order
+	var ok bool
+	if s.sharedLog != nil {
+		ok = s.sharedLog.write(s.symbol, order)
+	} else {
+		ok = writeOrderLog(s.wal, order)
+	}
+	if ok {
+		s.logged++
+	}
+	return ok && (s.group.collecting || s.syncLog())
+}
+
+// logOrders writes a group of accepted orders to the WAL with one write, as quote records if quote is set.
+// If the WAL is disabled the records are only counted, as logOrder does.
+func (s *scheduler) logOrders(orders []*types.KernelOrder, quote bool) bool {
+	if !saveOrderLog {
+		s.logged += uint64(len(orders))
+		return true
+	}
+	s.lastOrder = orders[len(orders)-1]
+	var ok bool
+	if s.sharedLog != nil {
+		ok = s.sharedLog.writeAll(s.symbol, orders, quote)
+	} else {
+		payloads := make([][]byte, len(orders))
+		for i, order := range orders {
+			payloads[i] = getOrderBinary(order)
+		}
+		t := walOrder
+		if quote {
+			t = walQuote
 		}
+		ok = s.wal.write(t, payloads...)
+	}
+	if ok {
+		s.logged += uint64(len(orders))
 	}
+	return ok
 }
 
 func initAcceptor(serverId uint64, acceptorDescription string) *scheduler {
 	return &scheduler{
 		kernel:              newKernel(),
-		newOrderChan:        make(chan *types.KernelOrder, 1),
+		newOrderChan:        make(chan *types.KernelOrder, defaultQueueDepth),
 		orderReceivedChan:   make(chan *types.KernelOrder),
+		requestChan:         make(chan *internalRequest),
+		batchChan:           make(chan *orderBatch),
+		sessions:            newSessionManager(sessionGracePeriod),
+		risk:                newRiskControl(newKillSwitch()),
+		limiter:             newRateLimiter(),
+		quotes:              make(map[uint64][]*types.KernelOrder),
+		life:                newLifecycle(),
 		serverId:            serverId,
 		serverMask:          serverId << (64 - 16 - 1),
-		r:                   rand.New(rand.NewSource(time.Now().UnixNano())),
+		ids:                 newIDGenerator(),
 		acceptorDescription: acceptorDescription,
-		f:                   &[1]*os.File{nil},
+		wal:                 newOrderLog(acceptorDescription),
 	}
 }
 
 func (s *scheduler) startRedoKernel() {
 	s.redoKernel = newKernel()
+	s.redoKernel.tickSize = s.kernel.tickSize
+	s.redoKernel.lotSize = s.kernel.lotSize
+	s.redoKernel.qtyScale = s.kernel.qtyScale
+	s.redoKernel.fees = s.kernel.fees
+	if s.kernel.ledger != nil {
+		s.redoKernel.ledger = newLedger()
+		s.redoKernel.base = s.kernel.base
+		s.redoKernel.quote = s.kernel.quote
+	}
+	if s.kernel.positions != nil {
+		s.redoKernel.positions = newPositionBook()
+	}
 	s.redoOrderChan = make(chan *types.KernelOrder)
 	go s.orderAcceptor(REDO_KERNEL)
 	s.redoKernel.startDummyMatchedInfoChan()
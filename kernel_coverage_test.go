@@ -11,7 +11,6 @@ import (
 	"log"
 	"math"
 	"os"
-	"strconv"
 	"testing"
 	"time"
 
@@ -416,7 +415,7 @@ func Test_takeSnapshot_And_RestoreKernel(t *testing.T) {
 	time.Sleep(20 * time.Millisecond)
 
 	lastOrder := newTestBidOrder(250, 75)
-	acceptor.kernel.takeSnapshot("test_snapshot", lastOrder)
+	acceptor.kernel.takeSnapshot("test_snapshot", lastOrder, snapshotPosition{})
 
 	time.Sleep(20 * time.Millisecond)
 
@@ -425,21 +424,9 @@ func Test_takeSnapshot_And_RestoreKernel(t *testing.T) {
 	assert.NoError(t, err)
 	assert.GreaterOrEqual(t, len(entries), 1)
 
-	latestSnapshot := ""
-	var latestTime int64 = 0
-	for _, entry := range entries {
-		if entry.IsDir() {
-			timeInt, err := strconv.ParseInt(entry.Name(), 10, 64)
-			if err == nil && timeInt > latestTime {
-				latestTime = timeInt
-				latestSnapshot = entry.Name()
-			}
-		}
-	}
-
-	assert.NotEmpty(t, latestSnapshot)
-
-	restorePath := snapshotPath + latestSnapshot + "/"
+	_, restorePath, err := latestSnapshot(snapshotPath)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, restorePath)
 	restoredKernel, ok := restoreKernel(restorePath)
 	assert.True(t, ok)
 	assert.NotNil(t, restoredKernel)
@@ -472,29 +459,14 @@ func Test_restoreKernel_BothSidesWithMultiplePriceLevels(t *testing.T) {
 	time.Sleep(20 * time.Millisecond)
 
 	lastOrder := newTestBidOrder(250, 75)
-	acceptor.kernel.takeSnapshot("test_restore_multi", lastOrder)
+	acceptor.kernel.takeSnapshot("test_restore_multi", lastOrder, snapshotPosition{})
 
 	time.Sleep(20 * time.Millisecond)
 
 	snapshotPath := "./orderbook_snapshot/test_restore_multi/"
-	entries, err := os.ReadDir(snapshotPath)
+	_, restorePath, err := latestSnapshot(snapshotPath)
 	assert.NoError(t, err)
-
-	latestSnapshot := ""
-	var latestTime int64 = 0
-	for _, entry := range entries {
-		if entry.IsDir() {
-			timeInt, err := strconv.ParseInt(entry.Name(), 10, 64)
-			if err == nil && timeInt > latestTime {
-				latestTime = timeInt
-				latestSnapshot = entry.Name()
-			}
-		}
-	}
-
-	assert.NotEmpty(t, latestSnapshot)
-
-	restorePath := snapshotPath + latestSnapshot + "/"
+	assert.NotEmpty(t, restorePath)
 	restoredKernel, ok := restoreKernel(restorePath)
 	assert.True(t, ok)
 	assert.NotNil(t, restoredKernel)
@@ -519,29 +491,14 @@ func Test_restoreKernel_LeftValueRestored(t *testing.T) {
 	time.Sleep(20 * time.Millisecond)
 
 	lastOrder := newTestBidOrder(250, 75)
-	acceptor.kernel.takeSnapshot("test_restore_left", lastOrder)
+	acceptor.kernel.takeSnapshot("test_restore_left", lastOrder, snapshotPosition{})
 
 	time.Sleep(20 * time.Millisecond)
 
 	snapshotPath := "./orderbook_snapshot/test_restore_left/"
-	entries, err := os.ReadDir(snapshotPath)
+	_, restorePath, err := latestSnapshot(snapshotPath)
 	assert.NoError(t, err)
-
-	latestSnapshot := ""
-	var latestTime int64 = 0
-	for _, entry := range entries {
-		if entry.IsDir() {
-			timeInt, err := strconv.ParseInt(entry.Name(), 10, 64)
-			if err == nil && timeInt > latestTime {
-				latestTime = timeInt
-				latestSnapshot = entry.Name()
-			}
-		}
-	}
-
-	assert.NotEmpty(t, latestSnapshot)
-
-	restorePath := snapshotPath + latestSnapshot + "/"
+	assert.NotEmpty(t, restorePath)
 	restoredKernel, ok := restoreKernel(restorePath)
 	assert.True(t, ok)
 	assert.NotNil(t, restoredKernel)
@@ -574,16 +531,16 @@ func Test_writeOrderLog_NewFileCreation(t *testing.T) {
 
 	acceptor := initAcceptor(1, "test_write_log")
 	_ = acceptor
-	var f *[1]*os.File = &[1]*os.File{nil}
+	l := newOrderLog("test_write_log")
 
 	order := newTestBidOrder(200, 100)
 	order.Left = order.Amount
 
-	result := writeOrderLog(f, "test_write_log", order)
+	result := writeOrderLog(l, order)
 	assert.True(t, result)
-	assert.NotNil(t, f[0])
+	assert.NotNil(t, l.f[0])
 
-	f[0].Close()
+	l.f[0].Close()
 	os.RemoveAll(tmpDir)
 }
 
@@ -608,7 +565,7 @@ func Test_writeOrderLog_MkdirAllError(t *testing.T) {
 
 	acceptor := initAcceptor(1, "test_write_log_err")
 	_ = acceptor
-	var f *[1]*os.File = &[1]*os.File{nil}
+	l := newOrderLog("test_write_log_err")
 
 	chmodErr := os.Chmod(tmpDir, 0000)
 	if chmodErr != nil {
@@ -619,7 +576,7 @@ func Test_writeOrderLog_MkdirAllError(t *testing.T) {
 	order := newTestBidOrder(200, 100)
 	order.Left = order.Amount
 
-	result := writeOrderLog(f, "test_write_log_err", order)
+	result := writeOrderLog(l, order)
 	assert.False(t, result)
 }
 
@@ -642,23 +599,24 @@ func Test_writeOrderLog_WriteError(t *testing.T) {
 	saveOrderLog = true
 	defer func() { saveOrderLog = saveOrderLogOrig }()
 
-	var f *[1]*os.File = &[1]*os.File{nil}
+	l := newOrderLog("test_write_err")
 
 	order := newTestBidOrder(200, 100)
 	order.Left = order.Amount
 
-	firstResult := writeOrderLog(f, "test_write_err", order)
+	firstResult := writeOrderLog(l, order)
 	assert.True(t, firstResult)
 
-	if f[0] != nil {
-		f[0].Close()
+	if l.f[0] != nil {
+		l.f[0].Close()
 	}
 
 	os.Chmod(tmpDir, 0555)
 	defer os.Chmod(tmpDir, 0755)
 
-	secondResult := writeOrderLog(f, "test_write_err", order)
+	secondResult := writeOrderLog(l, order)
 	assert.False(t, secondResult)
+	assert.Equal(t, uint64(1), l.seq)
 }
 
 func Test_getBytes_And_bytesToKernelOrder(t *testing.T) {
@@ -945,26 +903,9 @@ func Test_orderAcceptor_InternalRequestChan(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 }
 
-func Test_restoreKernel_BidDirReadError(t *testing.T) {
-	tmpDir, err := os.MkdirTemp("", "kernelorder_log_test_tmp_restore_bid_err_*")
-	if err != nil {
-		t.Fatalf("failed to create temp dir: %v", err)
-	}
-	defer func() {
-		os.Chmod(tmpDir+"/bid/", 0755)
-		os.RemoveAll(tmpDir)
-	}()
-
-	askPath := tmpDir + "/ask/"
-	bidPath := tmpDir + "/bid/"
-	os.MkdirAll(askPath, 0755)
-	os.MkdirAll(bidPath, 0755)
-	os.Chmod(bidPath, 0000)
-
-	f, _ := os.Create(tmpDir + "/finished.log")
-	f.Close()
-
-	ker, ok := restoreKernel(tmpDir + "/")
+func Test_restoreKernel_ReadFileError(t *testing.T) {
+	// a snapshot directory is not a snapshot file
+	ker, ok := restoreKernel(t.TempDir())
 	assert.Nil(t, ker)
 	assert.False(t, ok)
 }
@@ -1090,29 +1031,14 @@ func Test_restoreKernel_OnlyAskSide(t *testing.T) {
 	time.Sleep(20 * time.Millisecond)
 
 	lastOrder := newTestBidOrder(250, 75)
-	acceptor.kernel.takeSnapshot("test_restore_ask_only", lastOrder)
+	acceptor.kernel.takeSnapshot("test_restore_ask_only", lastOrder, snapshotPosition{})
 
 	time.Sleep(20 * time.Millisecond)
 
 	snapshotPath := "./orderbook_snapshot/test_restore_ask_only/"
-	entries, err := os.ReadDir(snapshotPath)
+	_, restorePath, err := latestSnapshot(snapshotPath)
 	assert.NoError(t, err)
-
-	latestSnapshot := ""
-	var latestTime int64 = 0
-	for _, entry := range entries {
-		if entry.IsDir() {
-			timeInt, err := strconv.ParseInt(entry.Name(), 10, 64)
-			if err == nil && timeInt > latestTime {
-				latestTime = timeInt
-				latestSnapshot = entry.Name()
-			}
-		}
-	}
-
-	assert.NotEmpty(t, latestSnapshot)
-
-	restorePath := snapshotPath + latestSnapshot + "/"
+	assert.NotEmpty(t, restorePath)
 	restoredKernel, ok := restoreKernel(restorePath)
 	assert.True(t, ok)
 	assert.NotNil(t, restoredKernel)
@@ -1137,29 +1063,14 @@ func Test_restoreKernel_OnlyBidSide(t *testing.T) {
 	time.Sleep(20 * time.Millisecond)
 
 	lastOrder := newTestBidOrder(250, 75)
-	acceptor.kernel.takeSnapshot("test_restore_bid_only", lastOrder)
+	acceptor.kernel.takeSnapshot("test_restore_bid_only", lastOrder, snapshotPosition{})
 
 	time.Sleep(20 * time.Millisecond)
 
 	snapshotPath := "./orderbook_snapshot/test_restore_bid_only/"
-	entries, err := os.ReadDir(snapshotPath)
+	_, restorePath, err := latestSnapshot(snapshotPath)
 	assert.NoError(t, err)
-
-	latestSnapshot := ""
-	var latestTime int64 = 0
-	for _, entry := range entries {
-		if entry.IsDir() {
-			timeInt, err := strconv.ParseInt(entry.Name(), 10, 64)
-			if err == nil && timeInt > latestTime {
-				latestTime = timeInt
-				latestSnapshot = entry.Name()
-			}
-		}
-	}
-
-	assert.NotEmpty(t, latestSnapshot)
-
-	restorePath := snapshotPath + latestSnapshot + "/"
+	assert.NotEmpty(t, restorePath)
 	restoredKernel, ok := restoreKernel(restorePath)
 	assert.True(t, ok)
 	assert.NotNil(t, restoredKernel)
@@ -1199,7 +1110,7 @@ func Test_takeSnapshot_AskOpenFileError(t *testing.T) {
 	bid.Left = bid.Amount
 	k.insertUnmatchedOrder(bid)
 
-	k.takeSnapshot("test_snap_ask_err", ask)
+	k.takeSnapshot("test_snap_ask_err", ask, snapshotPosition{})
 
 	// Verify files were created
 	entries, err := os.ReadDir(snapshotBase)
@@ -1224,31 +1135,19 @@ func Test_takeSnapshot_BothSides(t *testing.T) {
 	defer os.RemoveAll(snapshotBase)
 
 	lastOrder := newTestBidOrder(250, 75)
-	k.takeSnapshot("test_snap_both", lastOrder)
+	k.takeSnapshot("test_snap_both", lastOrder, snapshotPosition{})
 
 	entries, err := os.ReadDir(snapshotBase)
 	assert.NoError(t, err)
 	assert.GreaterOrEqual(t, len(entries), 1)
 
-	// Find latest snapshot
-	latestSnapshot := ""
-	var latestTime int64
-	for _, entry := range entries {
-		if entry.IsDir() {
-			timeInt, err := strconv.ParseInt(entry.Name(), 10, 64)
-			if err == nil && timeInt > latestTime {
-				latestTime = timeInt
-				latestSnapshot = entry.Name()
-			}
-		}
-	}
-	assert.NotEmpty(t, latestSnapshot)
-
-	// Verify ask and bid files exist
-	_, err = os.ReadDir(snapshotBase + latestSnapshot + "/ask/")
+	_, path, err := latestSnapshot(snapshotBase)
 	assert.NoError(t, err)
-	_, err = os.ReadDir(snapshotBase + latestSnapshot + "/bid/")
+	snap, err := readSnapshot(path)
 	assert.NoError(t, err)
+	assert.Equal(t, int64(300), snap.Asks[0].Price)
+	assert.Equal(t, int64(200), snap.Bids[0].Price)
+	assert.Equal(t, *lastOrder, snap.LastOrder)
 }
 
 // --- FOK bid-side price check break ---
@@ -1302,75 +1201,37 @@ func Test_matchingOrder_FOK_AskSide_PriceBreak(t *testing.T) {
 
 // --- restoreKernel error paths ---
 
-func Test_restoreKernel_AskDirReadError(t *testing.T) {
-	tmpDir := "./orderbook_snapshot/test_restore_ask_err/"
-	os.RemoveAll(tmpDir)
-	defer os.RemoveAll(tmpDir)
-
-	askPath := tmpDir + "ask/"
-	bidPath := tmpDir + "bid/"
-	os.MkdirAll(askPath, 0755)
-	os.MkdirAll(bidPath, 0755)
-
-	// Create a file in ask/ so ReadDir can succeed
-	f, _ := os.Create(askPath + "300.list")
-	order := newTestAskOrder(300, 50)
-	order.Left = order.Amount
-	f.Write(kernelOrderListToBytes(listOf(order)))
-	f.Close()
-
-	// Make ask dir unreadable
-	os.Chmod(askPath, 0000)
-	defer os.Chmod(askPath, 0755)
-
-	f2, _ := os.Create(tmpDir + "finished.log")
-	f2.Close()
-
-	ker, ok := restoreKernel(tmpDir)
-	assert.Nil(t, ker)
-	assert.False(t, ok)
-}
+func Test_restoreKernel_CorruptFile(t *testing.T) {
+	originalPath := kernelSnapshotPath
+	kernelSnapshotPath = t.TempDir() + "/"
+	defer func() { kernelSnapshotPath = originalPath }()
 
-func Test_restoreKernel_ReadFileError(t *testing.T) {
-	tmpDir := "./orderbook_snapshot/test_restore_readfile_err/"
-	os.RemoveAll(tmpDir)
-	defer os.RemoveAll(tmpDir)
-
-	askPath := tmpDir + "ask/"
-	bidPath := tmpDir + "bid/"
-	os.MkdirAll(askPath, 0755)
-	os.MkdirAll(bidPath, 0755)
-
-	// Create ask file with valid data
-	f, _ := os.Create(askPath + "300.list")
-	order := newTestAskOrder(300, 50)
-	order.Left = order.Amount
-	f.Write(kernelOrderListToBytes(listOf(order)))
-	f.Close()
-
-	// Create bid file with valid data too (we can't make it unreadable without nil panic)
-	f2, _ := os.Create(bidPath + "200.list")
-	bidOrder := newTestBidOrder(200, 100)
-	bidOrder.Left = bidOrder.Amount
-	f2.Write(kernelOrderListToBytes(listOf(bidOrder)))
-	f2.Close()
-
-	f3, _ := os.Create(tmpDir + "finished.log")
-	f3.Close()
-
-	ker, ok := restoreKernel(tmpDir)
-	assert.True(t, ok)
-	assert.NotNil(t, ker)
-	assert.Equal(t, 1, ker.ask.Length)
-	assert.Equal(t, 1, ker.bid.Length)
-}
+	k := newKernel()
+	k.insertUnmatchedOrder(newTestAskOrder(300, 50))
+	assert.NoError(t, k.takeSnapshot("corrupt", nil, snapshotPosition{}))
+	_, path, err := latestSnapshot(kernelSnapshotPath + "corrupt/")
+	assert.NoError(t, err)
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
 
-func listOf(orders ...*types.KernelOrder) *list.List {
-	l := list.New()
-	for _, o := range orders {
-		l.PushBack(o)
+	flip := func(i int) []byte {
+		c := append([]byte{}, b...)
+		c[i] ^= 1
+		return c
+	}
+	for name, c := range map[string][]byte{
+		"truncated": b[:snapshotHeaderSize-1],
+		"magic":     flip(0),
+		"version":   flip(4),
+		"payload":   flip(len(b) - 1),
+	} {
+		assert.NoError(t, os.WriteFile(path, c, 0644))
+		_, err := readSnapshot(path)
+		assert.ErrorIs(t, err, ErrCorruptSnapshot, name)
+		ker, ok := restoreKernel(path)
+		assert.Nil(t, ker, name)
+		assert.False(t, ok, name)
 	}
-	return l
 }
 
 // --- orderAcceptor error paths ---
@@ -1417,7 +1278,7 @@ func Test_orderAcceptor_WriteOrderLogFailure(t *testing.T) {
 
 	done := make(chan interface{}, 1)
 	acceptor := initAcceptor(1, "test_log_fail")
-	acceptor.f = &[1]*os.File{nil}
+	acceptor.wal = newOrderLog("test_log_fail")
 	acceptor.kernel.startDummyMatchedInfoChan()
 
 	// Start acceptor in its own goroutine with recover
@@ -1509,11 +1370,10 @@ func Test_writeOrderLog_MkdirAllError_Direct(t *testing.T) {
 	kernelOrderLogPath = "/dev/null/cannot_create_subdir/"
 	defer func() { kernelOrderLogPath = originalPath }()
 
-	var f [1]*os.File = [1]*os.File{nil}
 	order := newTestBidOrder(200, 100)
 	order.Left = order.Amount
 
-	result := writeOrderLog(&f, "test", order)
+	result := writeOrderLog(newOrderLog("test"), order)
 	assert.False(t, result)
 }
 
@@ -417,7 +417,9 @@ func Test_matchingAskOrder_MatchMultipleComplete2(t *testing.T) {
 		askSize += a.Left
 	}
 
-	bid := newTestBidOrder(500000, math.MaxInt64)
+	// the largest bid whose notional can be represented
+	bidSize := int64(maxNotional / 500000)
+	bid := newTestBidOrder(500000, bidSize)
 	acceptor.newOrderChan <- bid
 
 	for acceptor.kernel.ask1Price != math.MaxInt64 {
@@ -427,7 +429,7 @@ func Test_matchingAskOrder_MatchMultipleComplete2(t *testing.T) {
 	assert.Equal(t, int64(500000), acceptor.kernel.bid1Price)
 	assert.Equal(t, 0, acceptor.kernel.ask.Length)
 	assert.Equal(t, 1, acceptor.kernel.bid.Length)
-	assert.Equal(t, math.MaxInt64+askSize, acceptor.kernel.bid.Front().value.(*priceBucket).Left)
+	assert.Equal(t, bidSize+askSize, acceptor.kernel.bid.Front().value.(*priceBucket).Left)
 
 	var takerSum int64
 	for _, v := range takerVolumeMap {
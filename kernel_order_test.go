@@ -104,7 +104,7 @@ func Test_insertPriceCheckedOrder_WithRandomPrice(t *testing.T) {
 	assert.Equal(t, bidSize, checkBidSize)
 
 	st := time.Now().UnixNano()
-	k.takeSnapshot("test_insert", bids[len(bids)-1])
+	k.takeSnapshot("test_insert", bids[len(bids)-1], snapshotPosition{})
 	et := time.Now().UnixNano()
 	fmt.Println("Snapshot finished in ", (et-st)/(1000*1000), " ms")
 }
@@ -124,7 +124,7 @@ func TestRestoreKernel(t *testing.T) {
 	}
 	info := dir[len(dir)-1]
 	st := time.Now().UnixNano()
-	k, b := restoreKernel(baseDir + info.Name() + "/")
+	k, b := restoreKernel(baseDir + info.Name())
 	et := time.Now().UnixNano()
 	fmt.Println("Restore finished in ", (et-st)/(1000*1000), " ms")
 	assert.Equal(t, true, b)
@@ -0,0 +1,358 @@
+package ker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// LEDGER_FEE_ACCOUNT receives the fees of every trade and pays the maker rebates. Orders of this
+// account are rejected, so that they can't spend the fees collected.
+const LEDGER_FEE_ACCOUNT uint64 = 0
+
+var (
+	// ErrLedgerDisabled is returned for transfers of an engine without ledger.
+	ErrLedgerDisabled = errors.New("ledger disabled")
+	// ErrUnknownAsset is returned for transfers of an asset no instrument trades.
+	ErrUnknownAsset = errors.New("unknown asset")
+	// ErrInsufficientFunds is returned for withdrawals above the available balance.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrStopped is returned for commands sent to a stopped engine.
+	ErrStopped = errors.New("engine stopped")
+)
+
+// Balance of one asset of an account, Reserved backs the open orders.
+type Balance struct {
+	Available int64 `json:"available"`
+	Reserved  int64 `json:"reserved"`
+}
+
+// Posting is one entry of the ledger, the postings of a trade or a release sum to zero per asset.
+type Posting struct {
+	Account   uint64
+	Asset     string
+	Available int64
+	Reserved  int64
+}
+
+// reservation is what is left of the funds reserved by an open order.
+type reservation struct {
+	Account uint64 `json:"account"`
+	Asset   string `json:"asset"`
+	Amount  int64  `json:"amount"`
+}
+
+// ledger holds the balances of the accounts. It is shared by the instruments of an Exchange,
+// every method locks it.
+type ledger struct {
+	mux          sync.Mutex
+	balances     map[uint64]map[string]*Balance
+	reservations map[uint64]*reservation // by KernelOrderID
+}
+
+func newLedger() *ledger {
+	return &ledger{
+		balances:     make(map[uint64]map[string]*Balance),
+		reservations: make(map[uint64]*reservation),
+	}
+}
+
+func (l *ledger) balance(account uint64, asset string) *Balance {
+	assets, ok := l.balances[account]
+	if !ok {
+		assets = make(map[string]*Balance)
+		l.balances[account] = assets
+	}
+	b, ok := assets[asset]
+	if !ok {
+		b = &Balance{}
+		assets[asset] = b
+	}
+	return b
+}
+
+func (l *ledger) get(account uint64, asset string) Balance {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if b, ok := l.balances[account][asset]; ok {
+		return *b
+	}
+	return Balance{}
+}
+
+// transfer deposits a positive amount or withdraws a negative one. journal runs under the ledger lock once
+// the transfer is applied, so that the WAL order of ledger operations is the order they were applied in.
+func (l *ledger) transfer(account uint64, asset string, amount int64, journal func()) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	b := l.balance(account, asset)
+	if b.Available+amount < 0 {
+		return ErrInsufficientFunds
+	}
+	b.Available += amount
+	journal()
+	return nil
+}
+
+// reserve moves amount from available to reserved for an order, journal runs under the ledger lock
+// on success. It returns false if the available balance is too low.
+func (l *ledger) reserve(orderID uint64, r reservation, journal func()) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	b := l.balance(r.Account, r.Asset)
+	if b.Available < r.Amount {
+		return false
+	}
+	b.Available -= r.Amount
+	b.Reserved += r.Amount
+	l.reservations[orderID] = &r
+	journal()
+	return true
+}
+
+// release gives back what is left of the reservation of an order that is no longer open.
+func (l *ledger) release(orderID uint64) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.releaseLocked(orderID)
+}
+
+func (l *ledger) releaseLocked(orderID uint64) *Posting {
+	r, ok := l.reservations[orderID]
+	if !ok {
+		return nil
+	}
+	delete(l.reservations, orderID)
+	if r.Amount == 0 {
+		return nil
+	}
+	b := l.balance(r.Account, r.Asset)
+	b.Reserved -= r.Amount
+	b.Available += r.Amount
+	return &Posting{Account: r.Account, Asset: r.Asset, Available: r.Amount, Reserved: -r.Amount}
+}
+
+// take debits an account for an order, from its reservation first. Fees rounded up per fill may exceed
+// the fee reserved for the whole order by a few units, the rest comes from the available balance.
+func (l *ledger) take(orderID, account uint64, asset string, amount int64) Posting {
+	p := Posting{Account: account, Asset: asset}
+	b := l.balance(account, asset)
+	if r, ok := l.reservations[orderID]; ok {
+		reserved := amount
+		if reserved > r.Amount {
+			reserved = r.Amount
+		}
+		r.Amount -= reserved
+		b.Reserved -= reserved
+		p.Reserved = -reserved
+		amount -= reserved
+	}
+	b.Available -= amount
+	p.Available = -amount
+	return p
+}
+
+func (l *ledger) credit(account uint64, asset string, amount int64) Posting {
+	l.balance(account, asset).Available += amount
+	return Posting{Account: account, Asset: asset, Available: amount}
+}
+
+// checkFeeCurrency checks that fees settled by a ledger are charged in the quote asset, the only asset
+// settle posts them in. A schedule without currency is charged in the quote asset.
+func checkFeeCurrency(fs *types.FeeSchedule, quote string) error {
+	if fs != nil && quote != "" && fs.Currency != "" && fs.Currency != quote {
+		return fmt.Errorf("ledger: fees in %s, not in the quote asset %s", fs.Currency, quote)
+	}
+	return nil
+}
+
+// settle posts the trades of a match result: the buyer pays notional and fee in quote and receives base,
+// the seller delivers base and receives notional minus fee, the fee account receives both fees.
+// Makers whose order is closed get the rest of their reservation back.
+func (l *ledger) settle(mi *matchedInfo, fills []Fill, base, quote string) []Posting {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	taker := &mi.takerOrder
+	postings := make([]Posting, 0, 5*len(fills))
+	for i, fill := range fills {
+		maker := &mi.makerOrders[i]
+		buyer, seller := taker, maker
+		buyerFee, sellerFee := fill.TakerFee, fill.MakerFee
+		if taker.Amount < 0 {
+			buyer, seller = maker, taker
+			buyerFee, sellerFee = fill.MakerFee, fill.TakerFee
+		}
+		postings = append(postings,
+			l.take(buyer.KernelOrderID, buyer.AccountID, quote, fill.Notional+buyerFee),
+			l.credit(buyer.AccountID, base, fill.Size),
+			l.take(seller.KernelOrderID, seller.AccountID, base, fill.Size),
+			l.credit(seller.AccountID, quote, fill.Notional-sellerFee))
+		if fees := buyerFee + sellerFee; fees != 0 {
+			postings = append(postings, l.credit(LEDGER_FEE_ACCOUNT, quote, fees))
+		}
+		if maker.Status != types.OPEN {
+			if p := l.releaseLocked(maker.KernelOrderID); p != nil {
+				postings = append(postings, *p)
+			}
+		}
+	}
+	return postings
+}
+
+type ledgerState struct {
+	Balances     map[uint64]map[string]*Balance `json:"balances"`
+	Reservations map[uint64]*reservation        `json:"reservations"`
+}
+
+// state copies the balances and reservations, the copy shares no memory with the ledger.
+func (l *ledger) state() ledgerState {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	state := ledgerState{
+		Balances:     make(map[uint64]map[string]*Balance, len(l.balances)),
+		Reservations: make(map[uint64]*reservation, len(l.reservations)),
+	}
+	for account, assets := range l.balances {
+		copied := make(map[string]*Balance, len(assets))
+		for asset, b := range assets {
+			balance := *b
+			copied[asset] = &balance
+		}
+		state.Balances[account] = copied
+	}
+	for id, r := range l.reservations {
+		copied := *r
+		state.Reservations[id] = &copied
+	}
+	return state
+}
+
+func (l *ledger) MarshalJSON() ([]byte, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return json.Marshal(ledgerState{Balances: l.balances, Reservations: l.reservations})
+}
+
+func (l *ledger) UnmarshalJSON(b []byte) error {
+	var state ledgerState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.balances = state.Balances
+	l.reservations = state.Reservations
+	if l.balances == nil {
+		l.balances = make(map[uint64]map[string]*Balance)
+	}
+	if l.reservations == nil {
+		l.reservations = make(map[uint64]*reservation)
+	}
+	return nil
+}
+
+// reserve reserves the funds of a new order, quote for bids and base for asks, then journals it.
+// Bids reserve the fee at the highest rate of the account, pegged bids reserve at their limit price.
+func (k *kernel) reserve(order *types.KernelOrder, journal func()) types.RejectReason {
+	if order.AccountID == LEDGER_FEE_ACCOUNT {
+		return types.REJECT_NO_ACCOUNT
+	}
+	r := reservation{Account: order.AccountID}
+	if order.Amount > 0 {
+		price := order.Price
+		if order.PegType != types.NO_PEG {
+			if order.PegLimit == 0 {
+				return types.REJECT_PEG_LIMIT_REQUIRED
+			}
+			price = order.PegLimit
+		}
+		notional := k.notional(order.Left, price)
+		if order.Type == types.MARKET || (order.QuoteBudget != 0 && order.QuoteBudget < notional) {
+			notional = order.QuoteBudget
+		}
+		var rate int64
+		if k.fees != nil {
+			tier := k.fees.Tier(order.AccountID)
+			rate = max(tier.Maker, tier.Taker)
+		}
+		r.Asset = k.quote
+		r.Amount = notional + types.Fee(notional, rate)
+	} else {
+		r.Asset = k.base
+		r.Amount = -order.Left
+	}
+	if !k.ledger.reserve(order.KernelOrderID, r, journal) {
+		return types.REJECT_INSUFFICIENT_FUNDS
+	}
+	return types.REJECT_NONE
+}
+
+// releaseFunds gives back the rest of the reservation of an order that is no longer open.
+func (k *kernel) releaseFunds(order *types.KernelOrder) {
+	if k.ledger != nil {
+		k.ledger.release(order.KernelOrderID)
+	}
+}
+
+// applyTransfer replays a transfer record of the WAL, Amount is the base and FilledTotal the quote change.
+func (k *kernel) applyTransfer(order *types.KernelOrder) {
+	if order.Amount != 0 {
+		_ = k.ledger.transfer(order.AccountID, k.base, order.Amount, func() {})
+	}
+	if order.FilledTotal != 0 {
+		_ = k.ledger.transfer(order.AccountID, k.quote, order.FilledTotal, func() {})
+	}
+}
+
+// newTransferRecord is the WAL record of a transfer.
+func (k *kernel) newTransferRecord(account uint64, asset string, amount int64) *types.KernelOrder {
+	order := &types.KernelOrder{Type: types.TRANSFER, AccountID: account}
+	if asset == k.base {
+		order.Amount = amount
+	} else {
+		order.FilledTotal = amount
+	}
+	return order
+}
+
+// recordTrades attaches the fills of a trade to a match result, settles them and buffers them for the
+// positions, should be called before sending it. Can be called from the clearBucket goroutines.
+func (k *kernel) recordTrades(mi *matchedInfo) {
+	mi.fills = k.fillsOf(mi)
+	if k.ledger != nil {
+		mi.postings = k.ledger.settle(mi, mi.fills, k.base, k.quote)
+	}
+	if k.positions != nil {
+		k.positions.record(mi, mi.fills, k.qtyScale)
+	}
+}
+
+// ledgerTransfer is the LEDGER_TRANSFER request, err is set by the acceptor.
+type ledgerTransfer struct {
+	account uint64
+	asset   string
+	amount  int64
+	err     error
+}
+
+// transfer applies a deposit or withdrawal and writes its record to the WAL, should sync call.
+func (s *scheduler) transfer(t *ledgerTransfer) *ledgerTransfer {
+	k := s.kernel
+	if t.asset == "" || (t.asset != k.base && t.asset != k.quote) {
+		t.err = ErrUnknownAsset
+		return t
+	}
+	t.err = k.ledger.transfer(t.account, t.asset, t.amount, func() {
+		record := k.newTransferRecord(t.account, t.asset, t.amount)
+		record.CreateTime = time.Now().UnixNano()
+		if !s.logOrder(record) {
+			log.Panicln("Error in writing order log.")
+		}
+	})
+	return t
+}
@@ -0,0 +1,244 @@
+package ker
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func newTestLedgerAcceptor() *scheduler {
+	acceptor := newTestAcceptor()
+	acceptor.kernel.ledger = newLedger()
+	acceptor.kernel.base = "BTC"
+	acceptor.kernel.quote = "USDT"
+	return acceptor
+}
+
+// assertBalanced checks that the postings of a trade move no money in or out of the ledger
+func assertBalanced(t *testing.T, postings []Posting) {
+	sums := make(map[string]int64)
+	for _, p := range postings {
+		sums[p.Asset] += p.Available + p.Reserved
+	}
+	for asset, sum := range sums {
+		assert.Equal(t, int64(0), sum, asset)
+	}
+}
+
+func Test_orderAcceptor_LedgerReserveAndSettle(t *testing.T) {
+	acceptor := newTestLedgerAcceptor()
+	acceptor.kernel.fees = newTestFeeSchedule()
+	events := collectMatchedInfo(acceptor)
+	l := acceptor.kernel.ledger
+
+	assert.Nil(t, acceptor.requestTransfer(2, "USDT", 100000))
+	assert.Nil(t, acceptor.requestTransfer(3, "BTC", 100))
+	assert.ErrorIs(t, acceptor.requestTransfer(3, "ETH", 1), ErrUnknownAsset)
+	assert.ErrorIs(t, acceptor.requestTransfer(3, "BTC", -101), ErrInsufficientFunds)
+
+	// bids reserve the notional and the fee at the highest rate of the account
+	bid := submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 1000, Left: 10, AccountID: 2})
+	assert.Equal(t, Balance{Available: 89980, Reserved: 10020}, l.get(2, "USDT"))
+	submitAndWait(acceptor, &types.KernelOrder{KernelOrderID: bid.KernelOrderID, Price: 1000})
+	assert.Equal(t, Balance{Available: 100000}, l.get(2, "USDT"))
+
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 200, Price: 1000, Left: 200, AccountID: 2}
+	expectReject(t, acceptor.kernel.errorInfoChan, types.REJECT_INSUFFICIENT_FUNDS)
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: -1, Price: 1000, Left: -1, AccountID: 4}
+	expectReject(t, acceptor.kernel.errorInfoChan, types.REJECT_INSUFFICIENT_FUNDS)
+
+	// asks reserve the size in base
+	submitAndWait(acceptor, &types.KernelOrder{Amount: -10, Price: 1000, Left: -10, AccountID: 3})
+	assert.Equal(t, Balance{Available: 90, Reserved: 10}, l.get(3, "BTC"))
+	// pegged bids can only reserve up to their limit
+	pegged := &types.KernelOrder{Amount: 1, Left: 1, PegType: types.MARKET_PEG}
+	pegged.AccountID = 2
+	acceptor.newOrderChan <- pegged
+	expectReject(t, acceptor.kernel.errorInfoChan, types.REJECT_PEG_LIMIT_REQUIRED)
+
+	taker := submitAndWait(acceptor, &types.KernelOrder{Amount: 15, Price: 1000, Left: 15, AccountID: 2})
+	ofTaker := func(mi *matchedInfo) bool { return mi.takerOrder.KernelOrderID == taker.KernelOrderID }
+	mi := nextMatchedInfo(t, events, ofTaker)
+	assertBalanced(t, mi.postings)
+	assert.Equal(t, Balance{Available: 84970, Reserved: 5010}, l.get(2, "USDT"))
+	assert.Equal(t, Balance{Available: 10}, l.get(2, "BTC"))
+	assert.Equal(t, Balance{Available: 90}, l.get(3, "BTC"))
+	assert.Equal(t, Balance{Available: 9990}, l.get(3, "USDT"))
+	assert.Equal(t, Balance{Available: 30}, l.get(LEDGER_FEE_ACCOUNT, "USDT"))
+
+	// orders without account can't spend the fees collected
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 1, Price: 1000, Left: 1, AccountID: LEDGER_FEE_ACCOUNT}
+	expectReject(t, acceptor.kernel.errorInfoChan, types.REJECT_NO_ACCOUNT)
+	assert.Equal(t, Balance{Available: 30}, l.get(LEDGER_FEE_ACCOUNT, "USDT"))
+
+	// the rest of the taker reservation comes back on cancel
+	submitAndWait(acceptor, &types.KernelOrder{KernelOrderID: taker.KernelOrderID, Price: 1000})
+	assert.Equal(t, Balance{Available: 89980}, l.get(2, "USDT"))
+	assert.Empty(t, l.reservations)
+	acceptor.kernel.Stop()
+}
+
+func Test_MatchingEngine_LedgerFeeCurrency(t *testing.T) {
+	fees := newTestFeeSchedule()
+	fees.Currency = "BTC"
+	engine := NewMatchingEngine(1, "test_ledger_fee_currency")
+	assert.Nil(t, engine.EnableLedger("BTC", "USDT"))
+	assert.NotNil(t, engine.SetFeeSchedule(fees))
+	assert.Nil(t, engine.SetFeeSchedule(newTestFeeSchedule()))
+
+	engine = NewMatchingEngine(1, "test_ledger_fee_currency")
+	assert.Nil(t, engine.SetFeeSchedule(fees))
+	assert.NotNil(t, engine.EnableLedger("BTC", "USDT"))
+	assert.Nil(t, engine.EnableLedger("ETH", "BTC"))
+}
+
+func Test_ledger_JSON(t *testing.T) {
+	l := newLedger()
+	assert.Nil(t, l.transfer(1, "USDT", 1000, func() {}))
+	assert.True(t, l.reserve(7, reservation{Account: 1, Asset: "USDT", Amount: 400}, func() {}))
+	assert.False(t, l.reserve(8, reservation{Account: 1, Asset: "USDT", Amount: 601}, func() {}))
+
+	originalPath := kernelSnapshotPath
+	kernelSnapshotPath = t.TempDir() + "/"
+	defer func() { kernelSnapshotPath = originalPath }()
+	k := newKernel()
+	k.ledger = l
+	assert.Nil(t, k.takeSnapshot("ledger", newTestBidOrder(100, 1), snapshotPosition{}))
+	entries, err := os.ReadDir(kernelSnapshotPath + "ledger/")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	restored, ok := restoreKernel(kernelSnapshotPath + "ledger/" + entries[0].Name())
+	assert.True(t, ok)
+	assert.Equal(t, Balance{Available: 600, Reserved: 400}, restored.ledger.get(1, "USDT"))
+	restored.ledger.release(7)
+	assert.Equal(t, Balance{Available: 1000}, restored.ledger.get(1, "USDT"))
+}
+
+func Test_Exchange_LedgerReplay(t *testing.T) {
+	originalPath := kernelOrderLogPath
+	kernelOrderLogPath = t.TempDir() + "/"
+	defer func() { kernelOrderLogPath = originalPath }()
+	saveOrderLogOrig := saveOrderLog
+	saveOrderLog = true
+	defer func() { saveOrderLog = saveOrderLogOrig }()
+
+	newInstruments := func() map[string]*types.Instrument {
+		instruments := newTestInstruments("BTCUSDT", "ETHUSDT")
+		instruments["BTCUSDT"].BaseAsset, instruments["BTCUSDT"].QuoteAsset = "BTC", "USDT"
+		instruments["ETHUSDT"].BaseAsset, instruments["ETHUSDT"].QuoteAsset = "ETH", "USDT"
+		return instruments
+	}
+	x, err := NewExchange(1, "test_exchange_ledger_0", newTestInstruments("AAA"))
+	assert.Nil(t, err)
+	assert.NotNil(t, x.EnableLedger())
+
+	x, err = NewExchange(1, "test_exchange_ledger", newInstruments())
+	assert.Nil(t, err)
+	assert.Nil(t, x.EnableLedger())
+	x.Start()
+	go func() {
+		for range x.Events() {
+		}
+	}()
+
+	// the quote balance is shared by both instruments
+	assert.Nil(t, x.Deposit(1, "USDT", 50000))
+	assert.Nil(t, x.Deposit(2, "BTC", 10))
+	assert.Nil(t, x.Deposit(2, "ETH", 10))
+	assert.ErrorIs(t, x.Deposit(2, "XRP", 10), ErrUnknownAsset)
+	assert.Nil(t, x.SubmitOrder("BTCUSDT", &types.KernelOrder{Amount: -5, Price: 3000, Left: -5, AccountID: 2}))
+	assert.Nil(t, x.SubmitOrder("ETHUSDT", &types.KernelOrder{Amount: -5, Price: 2000, Left: -5, AccountID: 2}))
+	assert.Nil(t, x.SubmitOrder("BTCUSDT", &types.KernelOrder{Amount: 4, Price: 3000, Left: 4, AccountID: 1}))
+	assert.Nil(t, x.SubmitOrder("ETHUSDT", &types.KernelOrder{Amount: 10, Price: 2100, Left: 10, AccountID: 1}))
+	assert.Nil(t, x.Deposit(1, "USDT", -1000))
+	assert.Eventually(t, func() bool {
+		return x.Balance(1, "ETH") == Balance{Available: 5} && x.Balance(1, "BTC") == Balance{Available: 4}
+	}, time.Second, 5*time.Millisecond)
+	// the bid filled below its price keeps what it reserved
+	assert.Equal(t, Balance{Available: 50000 - 12000 - 21000 - 1000, Reserved: 11000}, x.Balance(1, "USDT"))
+	assert.Equal(t, Balance{Available: 22000}, x.Balance(2, "USDT"))
+
+	accounts := []uint64{1, 2}
+	assets := []string{"BTC", "ETH", "USDT"}
+	expect := make(map[uint64]map[string]Balance)
+	for _, account := range accounts {
+		expect[account] = make(map[string]Balance)
+		for _, asset := range assets {
+			expect[account][asset] = x.Balance(account, asset)
+		}
+	}
+	path := x.log.f[0].Name()
+	x.Stop()
+
+	x2, err := NewExchange(1, "test_exchange_ledger_2", newInstruments())
+	assert.Nil(t, err)
+	assert.Nil(t, x2.EnableLedger())
+	assert.Nil(t, x2.Recover(path))
+	for _, account := range accounts {
+		for _, asset := range assets {
+			assert.Equal(t, expect[account][asset], x2.Balance(account, asset), asset)
+		}
+	}
+	bid, _ := x2.BestBid("ETHUSDT")
+	assert.Equal(t, int64(2100), bid)
+}
+
+func Test_Exchange_LedgerRecoverSnapshots(t *testing.T) {
+	dir := setTestWAL(t, 0)
+	setTestSnapshots(t)
+	newExchange := func(desc string) *Exchange {
+		instruments := newTestInstruments("BTCUSDT", "ETHUSDT")
+		instruments["BTCUSDT"].BaseAsset, instruments["BTCUSDT"].QuoteAsset = "BTC", "USDT"
+		instruments["ETHUSDT"].BaseAsset, instruments["ETHUSDT"].QuoteAsset = "ETH", "USDT"
+		x, err := NewExchange(1, desc, instruments)
+		assert.Nil(t, err)
+		assert.Nil(t, x.EnableLedger())
+		return x
+	}
+	cases := []struct {
+		name     string
+		shutdown bool
+		restored bool
+	}{
+		// the ledger of the snapshot of BTCUSDT already holds the reservation of the ETHUSDT bid
+		{"partial", false, false},
+		{"shutdown", true, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			desc := "test_exchange_ledger_snapshots_" + c.name
+			x := newExchange(desc)
+			x.EnableShutdownSnapshot()
+			x.Start()
+			go func() {
+				for range x.Events() {
+				}
+			}()
+			assert.Nil(t, x.Deposit(1, "USDT", 10000))
+			assert.Nil(t, x.SubmitOrder("ETHUSDT", &types.KernelOrder{Amount: 1, Price: 2000, Left: 1, AccountID: 1}))
+			assert.Eventually(t, func() bool { return x.log.seq == 2 }, time.Second, time.Millisecond)
+			_, err := x.books["BTCUSDT"].requestSnapshot()
+			assert.Nil(t, err)
+			assert.Nil(t, x.SubmitOrder("BTCUSDT", &types.KernelOrder{Amount: 2, Price: 3000, Left: 2, AccountID: 1}))
+			assert.Eventually(t, func() bool { return x.log.seq == 3 }, time.Second, time.Millisecond)
+			time.Sleep(10 * time.Millisecond)
+			expect := x.Balance(1, "USDT")
+			assert.Equal(t, Balance{Available: 2000, Reserved: 8000}, expect)
+			if c.shutdown {
+				assert.Nil(t, x.Shutdown(t.Context()))
+			} else {
+				x.Stop()
+			}
+
+			x2 := newExchange(desc)
+			assert.Nil(t, x2.Recover(dir+desc+walManifestExt))
+			assert.Equal(t, expect, x2.Balance(1, "USDT"))
+			assert.Equal(t, c.restored, x2.books["ETHUSDT"].lastOrder != nil)
+		})
+	}
+}
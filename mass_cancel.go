@@ -0,0 +1,189 @@
+package ker
+
+import (
+	"container/list"
+	"log"
+	"math"
+	"time"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+type MassCancelSide uint8
+
+const (
+	CANCEL_BOTH_SIDES MassCancelSide = iota
+	CANCEL_BID_SIDE
+	CANCEL_ASK_SIDE
+)
+
+// MassCancel selects the resting orders removed by a mass-cancel request.
+// The zero value selects every order in the book.
+type MassCancel struct {
+	Side MassCancelSide
+	// Only orders of this account, 0 matches every account
+	AccountID uint64
+	// Only orders of this gateway session, 0 matches every session
+	SessionID uint64
+	// Price range, inclusive, 0 means unbounded
+	MinPrice int64
+	MaxPrice int64
+}
+
+func (m *MassCancel) matches(order *types.KernelOrder) bool {
+	return (m.AccountID == 0 || order.AccountID == m.AccountID) &&
+		(m.SessionID == 0 || order.SessionID == m.SessionID)
+}
+
+func (m *MassCancel) belowRange(price int64) bool {
+	return m.MinPrice != 0 && price < m.MinPrice
+}
+
+func (m *MassCancel) aboveRange(price int64) bool {
+	return m.MaxPrice != 0 && price > m.MaxPrice
+}
+
+// MassCancelReport summarizes a mass-cancel request. It is published on the match result
+// stream after the cancellation of every affected order.
+type MassCancelReport struct {
+	Filter    MassCancel
+	Cancelled int
+	// Total Left of the cancelled bids
+	BidSize int64
+	// Total Left of the cancelled asks, negative like the Left of ask orders
+	AskSize    int64
+	UpdateTime int64
+}
+
+// restingOrder locates an order in the book.
+type restingOrder struct {
+	side   *SkipList
+	key    float64
+	bucket *priceBucket
+	e      *list.Element
+}
+
+// findOrders returns the resting orders selected by a mass-cancel filter, best price first.
+func (k *kernel) findOrders(filter *MassCancel) []restingOrder {
+	var found []restingOrder
+	collect := func(side *SkipList, isAsk bool) {
+		for e := side.Front(); e != nil; e = e.Next() {
+			bucket := e.value.(*priceBucket)
+			price := bucket.l.Front().Value.(*types.KernelOrder).Price
+			// asks are sorted by ascending price, bids by descending price
+			if (isAsk && filter.aboveRange(price)) || (!isAsk && filter.belowRange(price)) {
+				break
+			}
+			if filter.belowRange(price) || filter.aboveRange(price) {
+				continue
+			}
+			// oldest order first
+			for le := bucket.l.Back(); le != nil; le = le.Prev() {
+				if !filter.matches(le.Value.(*types.KernelOrder)) {
+					continue
+				}
+				found = append(found, restingOrder{side: side, key: e.key, bucket: bucket, e: le})
+			}
+		}
+	}
+	if filter.Side != CANCEL_ASK_SIDE {
+		collect(k.bid, false)
+	}
+	if filter.Side != CANCEL_BID_SIDE {
+		collect(k.ask, true)
+	}
+	return found
+}
+
+// removeOrders takes found orders out of the book, should sync call.
+func (k *kernel) removeOrders(orders []restingOrder) {
+	for _, o := range orders {
+		order := o.e.Value.(*types.KernelOrder)
+		k.markChanged(o.side, o.key)
+		o.bucket.Left -= order.Left
+		order.Status = types.CANCELLED
+		k.releaseFunds(order)
+		o.bucket.l.Remove(o.e)
+		if o.bucket.l.Len() == 0 {
+			o.side.Remove(o.key)
+		}
+	}
+	k.refreshBestPrices()
+}
+
+// refreshBestPrices reads ask1Price and bid1Price from the heads of both sides.
+func (k *kernel) refreshBestPrices() {
+	ask1Price := int64(math.MaxInt64)
+	if k.ask.Length != 0 {
+		ask1Price = k.ask.Front().value.(*priceBucket).l.Front().Value.(*types.KernelOrder).Price
+	}
+	bid1Price := int64(math.MinInt64)
+	if k.bid.Length != 0 {
+		bid1Price = k.bid.Front().value.(*priceBucket).l.Front().Value.(*types.KernelOrder).Price
+	}
+	k.ask1PriceMux.Lock()
+	k.ask1Price = ask1Price
+	k.ask1PriceMux.Unlock()
+	k.bid1PriceMux.Lock()
+	k.bid1Price = bid1Price
+	k.bid1PriceMux.Unlock()
+}
+
+// massCancel runs in the acceptor goroutine. Every affected order is journaled as a single cancel
+// before the book changes, so replaying the WAL removes exactly the same orders. The cancels are written
+// with one write and fsynced once.
+func (s *scheduler) massCancel(filter *MassCancel) *MassCancelReport {
+	k := s.kernel
+	found := k.findOrders(filter)
+
+	if len(found) != 0 {
+		records := make([]*types.KernelOrder, len(found))
+		for i, o := range found {
+			order := o.e.Value.(*types.KernelOrder)
+			records[i] = &types.KernelOrder{
+				KernelOrderID: order.KernelOrderID,
+				Price:         order.Price,
+				AccountID:     order.AccountID,
+			}
+		}
+		if !s.logOrders(records, false) {
+			log.Panicln("Error in writing order log.")
+		}
+		if !s.syncLog() {
+			log.Panicln("Error in syncing order log.")
+		}
+	}
+
+	cancelled := make([]types.KernelOrder, len(found))
+	for i, o := range found {
+		cancelled[i] = *o.e.Value.(*types.KernelOrder)
+	}
+	refs := k.pegRefs()
+	k.removeOrders(found)
+
+	report := &MassCancelReport{
+		Filter:     *filter,
+		Cancelled:  len(cancelled),
+		UpdateTime: time.Now().UnixNano(),
+	}
+	for i := range cancelled {
+		order := &cancelled[i]
+		if order.Left > 0 {
+			report.BidSize += order.Left
+		} else {
+			report.AskSize += order.Left
+		}
+		order.Status = types.CANCELLED
+		order.UpdateTime = report.UpdateTime
+		k.sendMatchedInfo(&matchedInfo{
+			makerOrders:    nil,
+			matchedSizeMap: nil,
+			takerOrder:     *order,
+		})
+	}
+	k.sendMatchedInfo(&matchedInfo{
+		massCancelReport: report,
+	})
+	k.repriceIfMoved(refs)
+	return report
+}
@@ -0,0 +1,237 @@
+package ker
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// submitAndWait returns once the acceptor confirmed the order, requests sent afterwards see it in the book
+func submitAndWait(acceptor *scheduler, order *types.KernelOrder) *types.KernelOrder {
+	acceptor.newOrderChan <- order
+	return <-acceptor.orderReceivedChan
+}
+
+// fills a book with bids at 100..104 and asks at 110..114, accounts 1 and 2 alternate
+func fillTestBook(acceptor *scheduler) {
+	for i := int64(0); i < 5; i++ {
+		submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 100 + i, Left: 10, AccountID: uint64(i%2 + 1)})
+		submitAndWait(acceptor, &types.KernelOrder{Amount: -10, Price: 110 + i, Left: -10, AccountID: uint64(i%2 + 1)})
+	}
+}
+
+func collectMassCancelResults(t *testing.T, acceptor *scheduler) ([]types.KernelOrder, *MassCancelReport) {
+	var cancelled []types.KernelOrder
+	for {
+		select {
+		case mi := <-acceptor.kernel.matchedInfoChan:
+			if mi.massCancelReport != nil {
+				return cancelled, mi.massCancelReport
+			}
+			cancelled = append(cancelled, mi.takerOrder)
+		case <-time.After(time.Second):
+			t.Fatal("expected mass-cancel summary")
+			return nil, nil
+		}
+	}
+}
+
+func Test_massCancel_Filters(t *testing.T) {
+	cases := []struct {
+		name      string
+		filter    MassCancel
+		cancelled int
+		bidLen    int
+		askLen    int
+		ask1      int64
+		bid1      int64
+	}{
+		{"all", MassCancel{}, 10, 0, 0, math.MaxInt64, math.MinInt64},
+		{"bid side", MassCancel{Side: CANCEL_BID_SIDE}, 5, 0, 5, 110, math.MinInt64},
+		{"ask side", MassCancel{Side: CANCEL_ASK_SIDE}, 5, 5, 0, math.MaxInt64, 104},
+		{"account", MassCancel{AccountID: 2}, 4, 3, 3, 110, 104},
+		{"price range", MassCancel{MinPrice: 103, MaxPrice: 111}, 4, 3, 3, 112, 102},
+		{"max price", MassCancel{MaxPrice: 102}, 3, 2, 5, 110, 104},
+		{"min price", MassCancel{MinPrice: 113}, 2, 5, 3, 110, 104},
+		{"account bids in range", MassCancel{Side: CANCEL_BID_SIDE, AccountID: 1, MinPrice: 101}, 2, 3, 5, 110, 103},
+		{"nothing", MassCancel{AccountID: 3}, 0, 5, 5, 110, 104},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			acceptor := newTestAcceptor()
+			fillTestBook(acceptor)
+
+			done := make(chan *MassCancelReport, 1)
+			go func() {
+				done <- acceptor.request(MASS_CANCEL, &c.filter).(*MassCancelReport)
+			}()
+			cancelled, report := collectMassCancelResults(t, acceptor)
+			returned := <-done
+
+			assert.Equal(t, report, returned)
+			assert.Equal(t, c.cancelled, report.Cancelled)
+			assert.Equal(t, c.cancelled, len(cancelled))
+			var bidSize, askSize int64
+			for _, order := range cancelled {
+				assert.Equal(t, types.CANCELLED, order.Status)
+				assert.NotEqual(t, uint64(0), order.KernelOrderID)
+				if order.Left > 0 {
+					bidSize += order.Left
+				} else {
+					askSize += order.Left
+				}
+			}
+			assert.Equal(t, bidSize, report.BidSize)
+			assert.Equal(t, askSize, report.AskSize)
+			assert.Equal(t, c.filter, report.Filter)
+
+			assert.Equal(t, c.bidLen, acceptor.kernel.bid.Length)
+			assert.Equal(t, c.askLen, acceptor.kernel.ask.Length)
+			assert.Equal(t, c.ask1, acceptor.kernel.ask1Price)
+			assert.Equal(t, c.bid1, acceptor.kernel.bid1Price)
+			acceptor.kernel.Stop()
+		})
+	}
+}
+
+func Test_massCancel_SamePriceLevel(t *testing.T) {
+	acceptor := newTestAcceptor()
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 1})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 20, Price: 100, Left: 20, AccountID: 2})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 30, Price: 100, Left: 30, AccountID: 1})
+
+	go acceptor.request(MASS_CANCEL, &MassCancel{AccountID: 1})
+	cancelled, report := collectMassCancelResults(t, acceptor)
+	assert.Equal(t, 2, report.Cancelled)
+	// oldest order first
+	assert.Equal(t, int64(10), cancelled[0].Left)
+	assert.Equal(t, int64(30), cancelled[1].Left)
+	assert.Equal(t, int64(40), report.BidSize)
+
+	assert.Equal(t, 1, acceptor.kernel.bid.Length)
+	assert.Equal(t, int64(20), getBucketLeft(acceptor, false))
+	assert.Equal(t, int64(100), acceptor.kernel.bid1Price)
+	acceptor.kernel.Stop()
+}
+
+func Test_MatchingEngine_MassCancel(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_mass_cancel")
+	engine.Start()
+
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 7})
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 101, Left: 10, AccountID: 8})
+	engine.SubmitOrder(&types.KernelOrder{Amount: -10, Price: 120, Left: -10, AccountID: 7})
+	assert.Eventually(t, func() bool {
+		return engine.BidLength() == 2 && engine.AskLength() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	report := engine.MassCancel(MassCancel{AccountID: 7})
+	assert.Equal(t, 2, report.Cancelled)
+	assert.Equal(t, int64(10), report.BidSize)
+	assert.Equal(t, int64(-10), report.AskSize)
+	assert.Equal(t, int64(101), engine.BestBid())
+	assert.Equal(t, int64(math.MaxInt64), engine.BestAsk())
+
+	var results []MatchResult
+	for len(results) < 3 {
+		select {
+		case r := <-engine.MatchedInfoChan():
+			results = append(results, r)
+		case <-time.After(time.Second):
+			t.Fatal("expected mass-cancel results")
+		}
+	}
+	assert.Nil(t, results[0].MassCancel)
+	assert.Equal(t, types.CANCELLED, results[0].TakerOrder.Status)
+	assert.Nil(t, results[1].MassCancel)
+	assert.Equal(t, report, *results[2].MassCancel)
+
+	engine.Stop()
+}
+
+func Test_MatchingEngine_MassCancelGroupCommit(t *testing.T) {
+	setTestDurability(t, WAL_GROUP_COMMIT, 100, time.Hour)
+	setTestSnapshots(t)
+	const desc = "test_engine_mass_cancel_group"
+	engine := NewMatchingEngine(1, desc)
+	assert.Nil(t, engine.SetQueueDepth(10))
+	engine.Start()
+	go func() {
+		for range engine.MatchedInfoChan() {
+		}
+	}()
+	for i := int64(0); i < 3; i++ {
+		engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100 + i, Left: 10, AccountID: 7})
+	}
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 90, Left: 10, AccountID: 8})
+	assert.Eventually(t, func() bool { return engine.s.wal.seq == 4 }, time.Second, time.Millisecond)
+
+	// the cancels are written and fsynced by the time the report is returned
+	assert.Equal(t, 3, engine.MassCancel(MassCancel{AccountID: 7}).Cancelled)
+	assert.Equal(t, uint64(7), engine.s.wal.seq)
+	expected := engine.OrderBook()
+	crashTestEngine(t, engine)
+
+	recovered := NewMatchingEngine(1, desc)
+	assert.Nil(t, recovered.Recover(kernelSnapshotPath+desc))
+	assert.Equal(t, expected, recovered.OrderBook())
+	assert.Equal(t, []PriceLevel{{Price: 90, Size: 10}}, recovered.OrderBook().Bids)
+}
+
+func Test_Exchange_MassCancel_ReplayIsExact(t *testing.T) {
+	originalPath := kernelOrderLogPath
+	kernelOrderLogPath = t.TempDir() + "/"
+	defer func() { kernelOrderLogPath = originalPath }()
+	saveOrderLogOrig := saveOrderLog
+	saveOrderLog = true
+	defer func() { saveOrderLog = saveOrderLogOrig }()
+
+	x, err := NewExchange(1, "test_exchange_mass_cancel", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	x.Start()
+	go func() {
+		for range x.Events() {
+		}
+	}()
+
+	for _, symbol := range []string{"AAA", "BBB"} {
+		assert.Nil(t, x.SubmitOrder(symbol, &types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 1}))
+		assert.Nil(t, x.SubmitOrder(symbol, &types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 2}))
+		assert.Nil(t, x.SubmitOrder(symbol, &types.KernelOrder{Amount: -10, Price: 110, Left: -10, AccountID: 1}))
+	}
+	assert.Eventually(t, func() bool {
+		askA, _ := x.BestAsk("AAA")
+		askB, _ := x.BestAsk("BBB")
+		return askA == 110 && askB == 110
+	}, time.Second, 10*time.Millisecond)
+
+	n, err := x.MassCancel(MassCancel{AccountID: 1}, "AAA")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	n, err = x.MassCancel(MassCancel{Side: CANCEL_ASK_SIDE})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	_, err = x.MassCancel(MassCancel{}, "CCC")
+	assert.ErrorIs(t, err, ErrUnknownSymbol)
+
+	expectA, _ := x.OrderBook("AAA")
+	expectB, _ := x.OrderBook("BBB")
+	assert.Equal(t, []PriceLevel{{Price: 100, Size: 10}}, expectA.Bids)
+	assert.Equal(t, 0, len(expectA.Asks))
+	assert.Equal(t, []PriceLevel{{Price: 100, Size: 20}}, expectB.Bids)
+	assert.Equal(t, 0, len(expectB.Asks))
+	path := x.log.f[0].Name()
+	x.Stop()
+
+	x2, err := NewExchange(1, "test_exchange_mass_cancel_2", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.Nil(t, x2.Recover(path))
+	gotA, _ := x2.OrderBook("AAA")
+	gotB, _ := x2.OrderBook("BBB")
+	assert.Equal(t, expectA, gotA)
+	assert.Equal(t, expectB, gotB)
+}
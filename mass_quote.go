@@ -0,0 +1,219 @@
+package ker
+
+import (
+	"errors"
+	"log"
+	"math"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+var (
+	// ErrInvalidQuote is returned for mass quotes without account or with an invalid or duplicate level.
+	ErrInvalidQuote = errors.New("invalid quote")
+	// ErrCrossedQuote is returned for mass quotes whose best bid is not below their best ask.
+	ErrCrossedQuote = errors.New("crossed quote")
+)
+
+// Quote is one price level of a mass quote, a positive Size is a bid and a negative one an ask.
+type Quote struct {
+	Price int64
+	Size  int64
+}
+
+// MassQuote replaces every quote of an account with the given levels. An empty Quotes pulls them all.
+type MassQuote struct {
+	AccountID uint64
+	// Gateway session of the new quotes, 0 for none
+	SessionID uint64
+	Quotes    []Quote
+}
+
+// MassQuoteReport is the result of a mass quote.
+type MassQuoteReport struct {
+	// One ack per level of MassQuote.Quotes, a kept quote is acked with its resting order
+	Acks []OrderAck
+	// Number of quotes left untouched, they keep their queue priority
+	Kept int
+	// KernelOrderIDs of the previous quotes that were cancelled
+	Cancelled []uint64
+}
+
+// validate checks the levels of a mass quote before the book is touched.
+func (m *MassQuote) validate() error {
+	if m.AccountID == 0 {
+		return ErrInvalidQuote
+	}
+	bestBid, bestAsk := int64(math.MinInt64), int64(math.MaxInt64)
+	seen := make(map[Quote]bool, len(m.Quotes))
+	for _, q := range m.Quotes {
+		if q.Price <= 0 || q.Size == 0 {
+			return ErrInvalidQuote
+		}
+		// one level per price and side
+		level := Quote{Price: q.Price, Size: q.Size / abs(q.Size)}
+		if seen[level] {
+			return ErrInvalidQuote
+		}
+		seen[level] = true
+		if q.Size > 0 {
+			bestBid = max(bestBid, q.Price)
+		} else {
+			bestAsk = min(bestAsk, q.Price)
+		}
+	}
+	if bestBid >= bestAsk {
+		return ErrCrossedQuote
+	}
+	return nil
+}
+
+// requestMassQuote runs a mass quote in the acceptor.
+func (s *scheduler) requestMassQuote(quote *MassQuote) (*MassQuoteReport, error) {
+	if err := quote.validate(); err != nil {
+		return nil, err
+	}
+	report, ok := s.request(MASS_QUOTE, quote).(*MassQuoteReport)
+	if !ok {
+		return nil, ErrStopped
+	}
+	return report, nil
+}
+
+// massQuote runs in the acceptor goroutine, so that no order is matched while the quotes are replaced.
+// The quotes that change are cancelled first, then the new levels are placed like new orders. The cancels
+// and orders are written as quote records with one write and fsynced once, their events are held until
+// then. As for a batch, with a ledger the records are written one by one as the funds are reserved.
+func (s *scheduler) massQuote(quote *MassQuote) *MassQuoteReport {
+	k := s.kernel
+	report := &MassQuoteReport{Acks: make([]OrderAck, len(quote.Quotes))}
+	var records []*types.KernelOrder
+	journal := func(order *types.KernelOrder) {
+		records = append(records, order)
+	}
+	if k.ledger != nil {
+		journal = func(order *types.KernelOrder) {
+			if !s.logOrders([]*types.KernelOrder{order}, true) {
+				log.Panicln("Error in writing order log.")
+			}
+		}
+	}
+	k.hold()
+	s.group.collecting = true
+	defer func() { s.group.collecting = false }()
+
+	// the quotes still resting, by level
+	resting := make(map[Quote]*types.KernelOrder)
+	for _, order := range s.quotes[quote.AccountID] {
+		if order.Status == types.OPEN && order.Left != 0 {
+			resting[Quote{Price: order.Price, Size: order.Left}] = order
+		}
+	}
+	quotes := make([]*types.KernelOrder, 0, len(quote.Quotes))
+	place := make([]int, 0, len(quote.Quotes))
+	for i, q := range quote.Quotes {
+		if order, ok := resting[q]; ok {
+			delete(resting, q)
+			quotes = append(quotes, order)
+			report.Acks[i] = OrderAck{Accepted: true, Order: *order}
+			continue
+		}
+		place = append(place, i)
+	}
+	report.Kept = len(quotes)
+
+	for _, order := range s.quotes[quote.AccountID] {
+		if resting[Quote{Price: order.Price, Size: order.Left}] != order {
+			continue
+		}
+		cancel := &types.KernelOrder{KernelOrderID: order.KernelOrderID, Price: order.Price, AccountID: order.AccountID}
+		if admitted, _ := s.admit(k, cancel, false, journal); admitted != nil {
+			s.apply(k, admitted, s.orderReceivedChan)
+			report.Cancelled = append(report.Cancelled, order.KernelOrderID)
+		}
+	}
+
+	for _, i := range place {
+		q := quote.Quotes[i]
+		order := &types.KernelOrder{
+			Amount:      q.Size,
+			Price:       q.Price,
+			Left:        q.Size,
+			Type:        types.LIMIT,
+			TimeInForce: types.GTC,
+			AccountID:   quote.AccountID,
+			SessionID:   quote.SessionID,
+		}
+		admitted, reason := s.admit(k, order, false, journal)
+		if reason != types.REJECT_NONE {
+			rejectOrder(k, order, reason)
+		}
+		report.Acks[i].Reason = reason
+		if admitted == nil {
+			continue
+		}
+		report.Acks[i].Accepted = true
+		report.Acks[i].Order = *admitted
+		s.apply(k, admitted, s.orderReceivedChan)
+		quotes = append(quotes, admitted)
+	}
+	if len(records) != 0 && !s.logOrders(records, true) {
+		log.Panicln("Error in writing order log.")
+	}
+	if !s.syncLog() {
+		log.Panicln("Error in syncing order log.")
+	}
+	s.group.collecting = false
+	k.release()
+
+	if len(quotes) == 0 {
+		delete(s.quotes, quote.AccountID)
+	} else {
+		s.quotes[quote.AccountID] = quotes
+	}
+	return report
+}
+
+// trackQuote adds a quote placed by the WAL replay to the quotes of its account, the ones no longer
+// resting are dropped.
+func (s *scheduler) trackQuote(order *types.KernelOrder) {
+	var quotes []*types.KernelOrder
+	for _, q := range s.quotes[order.AccountID] {
+		if q.Status == types.OPEN && q.Left != 0 {
+			quotes = append(quotes, q)
+		}
+	}
+	s.quotes[order.AccountID] = append(quotes, order)
+}
+
+// quoteIDs returns the KernelOrderIDs of the resting quotes of each account, for a snapshot.
+func (s *scheduler) quoteIDs() map[uint64][]uint64 {
+	ids := make(map[uint64][]uint64, len(s.quotes))
+	for account, quotes := range s.quotes {
+		for _, q := range quotes {
+			if q.Status == types.OPEN && q.Left != 0 {
+				ids[account] = append(ids[account], q.KernelOrderID)
+			}
+		}
+	}
+	return ids
+}
+
+// restoreQuotes tracks the quotes of a snapshot again, once its book is restored.
+func (s *scheduler) restoreQuotes(ids map[uint64][]uint64) {
+	if len(ids) == 0 {
+		return
+	}
+	resting := make(map[uint64]*types.KernelOrder)
+	for _, o := range s.kernel.findOrders(&MassCancel{}) {
+		order := o.e.Value.(*types.KernelOrder)
+		resting[order.KernelOrderID] = order
+	}
+	for account, quotes := range ids {
+		for _, id := range quotes {
+			if order, ok := resting[id]; ok {
+				s.quotes[account] = append(s.quotes[account], order)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package ker
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_MassQuote_validate(t *testing.T) {
+	cases := []struct {
+		name  string
+		quote MassQuote
+		err   error
+	}{
+		{"two sided", MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {99, 5}, {101, -10}}}, nil},
+		{"pull all", MassQuote{AccountID: 1}, nil},
+		{"no account", MassQuote{Quotes: []Quote{{100, 10}}}, ErrInvalidQuote},
+		{"zero price", MassQuote{AccountID: 1, Quotes: []Quote{{0, 10}}}, ErrInvalidQuote},
+		{"zero size", MassQuote{AccountID: 1, Quotes: []Quote{{100, 0}}}, ErrInvalidQuote},
+		{"duplicate level", MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {100, 5}}}, ErrInvalidQuote},
+		{"crossed", MassQuote{AccountID: 1, Quotes: []Quote{{101, 10}, {100, -10}}}, ErrCrossedQuote},
+		{"locked", MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {100, -10}}}, ErrCrossedQuote},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.err, c.quote.validate())
+		})
+	}
+}
+
+func Test_MatchingEngine_MassQuote(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_mass_quote")
+	engine.Start()
+	results := make(chan MatchResult, 100)
+	go func() {
+		for r := range engine.MatchedInfoChan() {
+			results <- r
+		}
+	}()
+
+	report, err := engine.MassQuote(MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {99, 10}, {110, -10}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Kept)
+	assert.Empty(t, report.Cancelled)
+	for _, ack := range report.Acks {
+		assert.True(t, ack.Accepted)
+		assert.Equal(t, types.OPEN, ack.Order.Status)
+	}
+	bid := report.Acks[0].Order.KernelOrderID
+	assert.Equal(t, int64(100), engine.BestBid())
+	assert.Equal(t, int64(110), engine.BestAsk())
+
+	// another order joins the quote level, behind it. Mass quotes run in the acceptor after the
+	// orders submitted before them.
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 2})
+
+	// the unchanged bid keeps its priority, the other levels are replaced
+	report, err = engine.MassQuote(MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {98, 10}, {109, -5}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Kept)
+	assert.Equal(t, bid, report.Acks[0].Order.KernelOrderID)
+	assert.Equal(t, 2, len(report.Cancelled))
+	assert.NotContains(t, report.Cancelled, bid)
+	assert.Equal(t, int64(109), engine.BestAsk())
+	book := engine.OrderBook()
+	assert.Equal(t, []PriceLevel{{Price: 100, Size: 20}, {Price: 98, Size: 10}}, book.Bids)
+	assert.Equal(t, []PriceLevel{{Price: 109, Size: -5}}, book.Asks)
+
+	engine.SubmitOrder(&types.KernelOrder{Amount: -10, Price: 100, Left: -10, AccountID: 3})
+	var filled uint64
+	for filled == 0 {
+		select {
+		case r := <-results:
+			if len(r.MakerOrders) > 0 {
+				filled = r.MakerOrders[0].KernelOrderID
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected a trade")
+		}
+	}
+	assert.Equal(t, bid, filled)
+
+	// the filled quote is placed again
+	report, err = engine.MassQuote(MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {98, 10}, {109, -5}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Kept)
+	assert.NotEqual(t, bid, report.Acks[0].Order.KernelOrderID)
+	assert.Equal(t, int64(20), engine.OrderBook().Bids[0].Size)
+
+	// an empty quote pulls every quote, the orders of the other accounts stay
+	report, err = engine.MassQuote(MassQuote{AccountID: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(report.Cancelled))
+	assert.Equal(t, []PriceLevel{{Price: 100, Size: 10}}, engine.OrderBook().Bids)
+	assert.Equal(t, int64(math.MaxInt64), engine.BestAsk())
+
+	_, err = engine.MassQuote(MassQuote{AccountID: 1, Quotes: []Quote{{110, 10}, {105, -10}}})
+	assert.ErrorIs(t, err, ErrCrossedQuote)
+	engine.Stop()
+	_, err = engine.MassQuote(MassQuote{AccountID: 1})
+	assert.ErrorIs(t, err, ErrStopped)
+}
+
+func Test_MatchingEngine_MassQuote_Rejects(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_mass_quote_rejects")
+	assert.Nil(t, engine.SetRiskLimits(RiskLimits{MaxQty: 10}))
+	engine.Start()
+	go func() {
+		for range engine.MatchedInfoChan() {
+		}
+	}()
+
+	report, err := engine.MassQuote(MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {110, -20}}})
+	assert.Nil(t, err)
+	assert.True(t, report.Acks[0].Accepted)
+	assert.False(t, report.Acks[1].Accepted)
+	assert.Equal(t, types.REJECT_RISK_MAX_QTY, report.Acks[1].Reason)
+	select {
+	case err := <-engine.ErrorInfoChan():
+		assert.ErrorContains(t, err, types.REJECT_RISK_MAX_QTY.String())
+	case <-time.After(time.Second):
+		t.Fatal("expected an order reject")
+	}
+	assert.Equal(t, int64(math.MaxInt64), engine.BestAsk())
+	engine.Stop()
+
+	x, err := NewExchange(1, "test_exchange_mass_quote", newTestInstruments("AAA"))
+	assert.Nil(t, err)
+	_, err = x.MassQuote("BBB", MassQuote{AccountID: 1})
+	assert.ErrorIs(t, err, ErrUnknownSymbol)
+}
+
+func Test_MatchingEngine_MassQuoteRecover(t *testing.T) {
+	setTestDurability(t, WAL_GROUP_COMMIT, 100, time.Hour)
+	setTestSnapshots(t)
+	const desc = "test_engine_mass_quote_recover"
+	engine := NewMatchingEngine(1, desc)
+	engine.Start()
+	go func() {
+		for range engine.MatchedInfoChan() {
+		}
+	}()
+
+	// the quotes are written and fsynced by the time the report is returned
+	_, err := engine.MassQuote(MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {99, 10}, {110, -10}}})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), engine.s.wal.seq)
+	assert.Nil(t, engine.Snapshot())
+	report, err := engine.MassQuote(MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {98, 10}, {110, -10}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Kept)
+	assert.Equal(t, uint64(5), engine.s.wal.seq)
+	crashTestEngine(t, engine)
+
+	b, err := os.ReadFile(engine.s.wal.f[0].Name())
+	assert.Nil(t, err)
+	r := newWALReader(bytes.NewReader(b))
+	for rec, err := r.next(); err == nil; rec, err = r.next() {
+		assert.True(t, rec.quote())
+	}
+
+	// the quotes of the snapshot and the ones replayed from the WAL are replaced by the next mass quote
+	recovered := NewMatchingEngine(1, desc)
+	assert.Nil(t, recovered.Recover(kernelSnapshotPath+desc))
+	recovered.Start()
+	go func() {
+		for range recovered.MatchedInfoChan() {
+		}
+	}()
+	report, err = recovered.MassQuote(MassQuote{AccountID: 1, Quotes: []Quote{{100, 10}, {97, 10}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Kept)
+	assert.Equal(t, 2, len(report.Cancelled))
+	assert.Equal(t, []PriceLevel{{Price: 100, Size: 10}, {Price: 97, Size: 10}}, recovered.OrderBook().Bids)
+	assert.Equal(t, 0, len(recovered.OrderBook().Asks))
+	recovered.Stop()
+}
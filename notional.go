@@ -0,0 +1,38 @@
+package ker
+
+import (
+	"math"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// maxNotional is the largest worst-case notional of an accepted order, so that a fee or a reservation
+// of up to 100% on top of it still fits in an int64.
+const maxNotional = math.MaxInt64 / 2
+
+// notional returns size * price / qtyScale in the units of FilledTotal. Accepted orders never exceed
+// maxNotional, so it never overflows.
+func (k *kernel) notional(size, price int64) int64 {
+	n, _ := types.Notional(size, price, k.qtyScale)
+	return n
+}
+
+// checkNotional rejects an order whose worst-case notional can't be represented, should sync call.
+// A buy fills at its price or better, a sell at up to the best bid it crosses, a pegged order up to its
+// limit. Quote-budget orders are bounded by their budget.
+func (k *kernel) checkNotional(order *types.KernelOrder) types.RejectReason {
+	if order.QuoteBudget != 0 {
+		if order.QuoteBudget > maxNotional {
+			return types.REJECT_NOTIONAL_OVERFLOW
+		}
+		return types.REJECT_NONE
+	}
+	price := max(order.Price, order.PegLimit)
+	if order.Amount < 0 {
+		price = max(price, k.bid1Price)
+	}
+	if n, ok := types.Notional(order.Amount, price, k.qtyScale); !ok || n > maxNotional || n < -maxNotional {
+		return types.REJECT_NOTIONAL_OVERFLOW
+	}
+	return types.REJECT_NONE
+}
@@ -0,0 +1,85 @@
+package ker
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_kernel_checkNotional(t *testing.T) {
+	k := newKernel()
+	k.qtyScale = types.ONE
+	cases := []struct {
+		name   string
+		order  *types.KernelOrder
+		bid1   int64
+		reason types.RejectReason
+	}{
+		{"fits", newTestBidOrder(1000*types.ONE, 10*types.ONE), math.MinInt64, types.REJECT_NONE},
+		{"at the limit", newTestBidOrder(maxNotional, types.ONE), math.MinInt64, types.REJECT_NONE},
+		{"above the limit", newTestBidOrder(maxNotional+1, types.ONE), math.MinInt64, types.REJECT_NOTIONAL_OVERFLOW},
+		{"product overflows", newTestBidOrder(math.MaxInt64, math.MaxInt64), math.MinInt64, types.REJECT_NOTIONAL_OVERFLOW},
+		{"sell at its price", newTestAskOrder(1, 2*types.ONE), math.MinInt64, types.REJECT_NONE},
+		{"sell through a high bid", newTestAskOrder(1, 2*types.ONE), maxNotional/2 + 1, types.REJECT_NOTIONAL_OVERFLOW},
+		{"smallest size", newTestAskOrder(math.MaxInt64, math.MinInt64), math.MinInt64, types.REJECT_NOTIONAL_OVERFLOW},
+		{"peg limit", &types.KernelOrder{Amount: types.ONE, Price: 1, PegLimit: maxNotional + 1}, math.MinInt64, types.REJECT_NOTIONAL_OVERFLOW},
+		{"budget", &types.KernelOrder{Amount: types.ONE, Type: types.MARKET, QuoteBudget: maxNotional}, math.MinInt64, types.REJECT_NONE},
+		{"budget too large", &types.KernelOrder{Amount: types.ONE, Type: types.MARKET, QuoteBudget: maxNotional + 1}, math.MinInt64, types.REJECT_NOTIONAL_OVERFLOW},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			k.bid1Price = c.bid1
+			assert.Equal(t, c.reason, k.checkNotional(c.order))
+		})
+	}
+}
+
+func Test_MatchingEngine_ScaledNotional(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_scaled_notional")
+	assert.Nil(t, engine.SetInstrument(&types.Instrument{
+		Symbol:   "BTC_USDT",
+		TickSize: types.ONE / 100,
+		LotSize:  types.ONE / 1000,
+		QtyScale: types.ONE,
+	}))
+	assert.Nil(t, engine.SetRiskLimits(RiskLimits{MaxNotional: 20000 * types.ONE}))
+	engine.EnablePositions()
+	engine.Start()
+
+	// 10 units at 1,000: the raw product is 1e22, the notional 10,000
+	engine.SubmitOrder(&types.KernelOrder{Amount: -10 * types.ONE, Price: 1000 * types.ONE, Left: -10 * types.ONE, AccountID: 2})
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10 * types.ONE, Price: 1000 * types.ONE, Left: 10 * types.ONE, AccountID: 1})
+	select {
+	case r := <-engine.MatchedInfoChan():
+		assert.Equal(t, int64(10000*types.ONE), r.TakerOrder.FilledTotal)
+		assert.Equal(t, int64(10000*types.ONE), r.Fills[0].Notional)
+		assert.Equal(t, int64(10*types.ONE), r.Fills[0].Size)
+	case <-time.After(time.Second):
+		t.Fatal("expected a trade")
+	}
+	// the mass quote runs after the orders, once their fills are applied
+	_, err := engine.MassQuote(MassQuote{AccountID: 9})
+	assert.Nil(t, err)
+	p := engine.Position(1)
+	assert.Equal(t, Position{Account: 1, Size: 10 * types.ONE, EntryNotional: 10000 * types.ONE, QtyScale: types.ONE}, p)
+	assert.Equal(t, int64(1000*types.ONE), p.AvgPrice())
+	assert.Equal(t, int64(1000*types.ONE), p.UnrealizedPnL(1100*types.ONE))
+	assert.Equal(t, int64(1000*types.ONE), engine.Position(2).UnrealizedPnL(900*types.ONE))
+
+	// the risk limit compares scaled notionals
+	engine.SubmitOrder(&types.KernelOrder{Amount: 30 * types.ONE, Price: 1000 * types.ONE, Left: 30 * types.ONE, AccountID: 1})
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10 * types.ONE, Price: 1e18, Left: 10 * types.ONE, AccountID: 1})
+	for _, reason := range []types.RejectReason{types.REJECT_RISK_MAX_NOTIONAL, types.REJECT_NOTIONAL_OVERFLOW} {
+		select {
+		case err := <-engine.ErrorInfoChan():
+			assert.ErrorContains(t, err, reason.String())
+		case <-time.After(time.Second):
+			t.Fatal("expected an order reject")
+		}
+	}
+	engine.Stop()
+}
@@ -0,0 +1,30 @@
+package ker
+
+import "time"
+
+// idGenerator draws the KernelOrderIDs of new orders from a splitmix64 stream. Its state is saved in
+// snapshots and advanced by the WAL replay, so that a recovered engine doesn't draw the IDs of the
+// orders in its book again.
+type idGenerator struct {
+	Seed uint64
+	// IDs drawn by the orders written to the WAL
+	Drawn uint64
+}
+
+func newIDGenerator() idGenerator {
+	return idGenerator{Seed: uint64(time.Now().UnixNano())}
+}
+
+// next draws a 63-bit random number.
+func (g *idGenerator) next() uint64 {
+	g.Drawn++
+	z := g.Seed + g.Drawn*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return (z ^ (z >> 31)) >> 1
+}
+
+// undo gives back the last number drawn, for an order that is not written to the WAL.
+func (g *idGenerator) undo() {
+	g.Drawn--
+}
@@ -10,41 +10,101 @@ import (
 	"container/list"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"io"
 	"log"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Curton/GoMatchingKernel/types"
 )
 
-// writeOrderLog writes new orders to a log file. It creates a new file if one doesn't exist.
+// writeOrderLog writes new orders to a log. It creates a new segment file if none is active.
 // It returns a bool indicating success or failure.
-func writeOrderLog(f *[1]*os.File, acceptorDescription string, kernelOrder *types.KernelOrder) bool {
-	// Check if the file is nil. If it is, create the directory and the file.
-	if f[0] == nil {
-		// Create the directory if it doesn't exist.
-		if err := os.MkdirAll(kernelOrderLogPath, 0755); err != nil {
-			log.Println(err.Error())
-			return false
-		}
-		f2, err := os.OpenFile(kernelOrderLogPath+acceptorDescription+"_"+strconv.FormatInt(time.Now().Unix(), 10)+".log",
-			os.O_APPEND|os.O_CREATE|os.O_RDWR|os.O_SYNC, 0644)
-		if err != nil {
-			log.Println(err.Error())
-			return false
-		}
-		f[0] = f2
+func writeOrderLog(l *orderLog, kernelOrder *types.KernelOrder) bool {
+	return l.write(walOrder, getOrderBinary(kernelOrder))
+}
+
+// maximum length of an instrument symbol in the shared order log
+const symbolSize = 16
+
+// sharedOrderLog is an order log shared by the acceptors of all instruments of an Exchange.
+// Its records are walSymbolOrder or walSymbolQuote records, the symbol tells the instrument of the order.
+type sharedOrderLog struct {
+	mux sync.Mutex
+	*orderLog
+}
+
+func newSharedOrderLog(description string) *sharedOrderLog {
+	return &sharedOrderLog{orderLog: newOrderLog(description)}
+}
+
+// write appends an order of symbol, it is safe to call from several acceptor goroutines.
+func (l *sharedOrderLog) write(symbol string, kernelOrder *types.KernelOrder) bool {
+	return l.writeAll(symbol, []*types.KernelOrder{kernelOrder}, false)
+}
+
+// writeAll appends the records of a group of orders of one symbol with one write, as quote records if
+// quote is set.
+func (l *sharedOrderLog) writeAll(symbol string, orders []*types.KernelOrder, quote bool) bool {
+	payloads := make([][]byte, len(orders))
+	for i, order := range orders {
+		payloads[i] = make([]byte, symbolSize, symbolSize+orderBinarySize)
+		copy(payloads[i], symbol)
+		payloads[i] = append(payloads[i], getOrderBinary(order)...)
 	}
 
-	// Write the binary representation of the order to the file.
-	if _, err := f[0].Write(getOrderBinary(kernelOrder)); err != nil {
-		log.Println(err.Error())
-		return false
+	t := walSymbolOrder
+	if quote {
+		t = walSymbolQuote
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.orderLog.write(t, payloads...)
+}
+
+// sync fsyncs the active segment.
+func (l *sharedOrderLog) sync() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.orderLog.sync()
+}
+
+// close fsyncs, seals and closes the active segment, once every acceptor writing to it returned.
+func (l *sharedOrderLog) close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.orderLog.close()
+}
+
+// readSharedOrderLog calls fn with every record of a shared order log, in write order. path is a segment
+// file or the manifest of the log, its segments are then read in sequence order.
+// A truncated record at the end of a segment is ignored, a corrupted record stops the replay with an
+// error wrapping ErrCorruptWAL.
+func readSharedOrderLog(path string, fn func(rec walRecord)) error {
+	if strings.HasSuffix(path, walManifestExt) {
+		return readManifest(path, walPosition{}, fn)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	return true
+	r := newWALReader(f)
+	for {
+		rec, err := r.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		fn(rec)
+	}
 }
 
 // getBytes returns the byte slice representation of the order.
@@ -157,57 +217,106 @@ func readOrderBinary(b []byte) *types.KernelOrder {
 	return order
 }
 
-// orderLogReader reads orders from a file to the redo order channel.
+// orderLogReader reads orders from the log to the redo order channel, until the kernel stops.
+// It follows the log from the segment active when it starts to the segments replacing it.
 func orderLogReader(s *scheduler) {
 	// Loop until we can open the file properly.
-	for s.f[0] == nil {
+	for s.wal.f[0] == nil {
+		if s.kernel.ctx.Err() != nil {
+			return
+		}
 		log.Println("Failed to read file in orderLogReader : FD is <nil>, retry after ", redoSnapshotInterval, " second.")
 		time.Sleep(redoSnapshotInterval)
 	}
 
-	// Build a sample order to determine the size of each order in the file.
-	sample := getOrderBinary(&types.KernelOrder{})
-	size := len(sample)
-
-	// Temporary buffer for reading orders.
-	tmp := make([]byte, size)
-
-	// Offset for reading
-	var off int64 = 0
+	seg := s.wal.active()
+	f, err := os.Open(filepath.Join(s.wal.dir, seg.File))
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	defer func() { _ = f.Close() }()
+	r := resumeWALReader(f, seg.FirstSeq-1)
 	var lastKernelOrder *types.KernelOrder
+	ids := idGenerator{Seed: s.ids.Seed}
+
+	// the redo acceptor copies its book between two orders and keeps replaying while it is written
+	schedule := newSnapshotSchedule()
+	snapshot := func() {
+		st := time.Now().UnixNano()
+		req := newSnapshotRequest("redo", lastKernelOrder, snapshotPosition{
+			WAL: walPosition{Seq: r.seq, File: seg.File, Offset: r.off},
+			IDs: ids,
+		})
+		req.parent = schedule.parent
+		err := schedule.settle(req, s.sendSnapshot(s.redoKernel, req))
+		et := time.Now().UnixNano()
+		if err == nil {
+			schedule.taken(r.seq, time.Now())
+			err = schedule.prune(kernelSnapshotPath + req.description)
+		}
+		if err != nil {
+			log.Println("orderLogReader() :redo snapshot failed: ", err.Error())
+			return
+		}
+		log.Println("orderLogReader() :redo snapshot finished in ", (et-st)/(1000*1000), " ms")
+		if walRetention {
+			if err := s.wal.retain(r.seq); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
 
-	// Loop reading orders from the file.
-	for {
-		_, err := s.f[0].ReadAt(tmp, off)
+	// Loop reading orders from the file, the file is closed once the kernel stops.
+	for s.kernel.ctx.Err() == nil {
+		rec, err := r.next()
 		if err != nil {
 			if err == io.EOF {
-				// time.Sleep(time.Second)
-
-				// pause redokernel
-				s.redoKernel.Pause()
-				// ensure matching work done
-				time.Sleep(time.Microsecond)
-				st := time.Now().UnixNano()
-				s.redoKernel.takeSnapshot("redo", lastKernelOrder)
-				et := time.Now().UnixNano()
-				s.redoKernel.Resume()
-				log.Println("orderLogReader() :redo snapshot finished in ", (et-st)/(1000*1000), " ms")
+				// a sealed segment is complete, move on to the next one once the records appended to it
+				// since the last EOF are read
+				if next, ok := s.wal.segmentAfter(seg.File, r.seq); ok {
+					nf, err := os.Open(filepath.Join(s.wal.dir, next.File))
+					if err != nil {
+						log.Println(err.Error())
+						time.Sleep(time.Second)
+						continue
+					}
+					_ = f.Close()
+					seg, f = next, nf
+					r = resumeWALReader(f, r.seq)
+					continue
+				}
+				if schedule.due(r.seq, time.Now()) {
+					snapshot()
+				}
 				time.Sleep(redoSnapshotInterval)
 				continue
 			}
+			if errors.Is(err, ErrCorruptWAL) {
+				// replaying past it would build a wrong book
+				log.Println("orderLogReader() :", err.Error())
+				return
+			}
 			log.Println(err.Error())
 			time.Sleep(time.Second)
 			continue
 		}
 
-		// Increment the offset for the next read.
-		off += int64(size)
-
-		// Convert the bytes back to a KernelOrder.
-		o := readOrderBinary(tmp)
+		// Convert the record back to a KernelOrder.
+		_, o := rec.order()
+		if o.Type != types.TRANSFER && o.Amount != 0 {
+			ids.Drawn++
+		}
 
 		// Send the KernelOrder to the redo order channel.
-		s.redoOrderChan <- o
+		select {
+		case s.redoOrderChan <- o:
+		case <-s.kernel.ctx.Done():
+			return
+		}
 		lastKernelOrder = o
+		if schedule.due(r.seq, time.Now()) {
+			snapshot()
+		}
 	}
 }
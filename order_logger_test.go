@@ -10,7 +10,6 @@ import (
 	_ "fmt"
 	"github.com/stretchr/testify/assert"
 	"math"
-	"os"
 	"testing"
 
 	"github.com/Curton/GoMatchingKernel/types"
@@ -18,9 +17,9 @@ import (
 
 // GOMAXPROCS=1 go test -bench=BenchmarkWrite -run=none -benchtime=1s -benchmem
 func BenchmarkWriteOrderLog(b *testing.B) {
-	var f = &[1]*os.File{nil}
+	l := newOrderLog("test")
 	for i := 0; i < b.N; i++ {
-		writeOrderLog(f, "test", &types.KernelOrder{
+		writeOrderLog(l, &types.KernelOrder{
 			KernelOrderID: 0,
 			CreateTime:    0,
 			UpdateTime:    0,
@@ -37,9 +36,9 @@ func BenchmarkWriteOrderLog(b *testing.B) {
 }
 
 func TestWriteOrderLog(t *testing.T) {
-	var f = &[1]*os.File{nil}
+	l := newOrderLog("test")
 	for i := 0; i < 10_000; i++ {
-		if writeOrderLog(f, "test", &types.KernelOrder{
+		if writeOrderLog(l, &types.KernelOrder{
 			KernelOrderID: 0,
 			CreateTime:    0,
 			UpdateTime:    0,
@@ -168,7 +167,7 @@ func Test_bytesToKernelOrder(t *testing.T) {
 }
 
 func Test_getBytes(t *testing.T) {
-	bytes := getBytes(&types.KernelOrder{
+	order := &types.KernelOrder{
 		KernelOrderID: math.MaxUint64,
 		CreateTime:    math.MinInt64,
 		UpdateTime:    math.MinInt64,
@@ -180,9 +179,10 @@ func Test_getBytes(t *testing.T) {
 		Type:          math.MaxUint8,
 		TimeInForce:   math.MaxUint8,
 		Id:            math.MaxUint64,
-	})
-	assert.Equal(t, len(bytes), 256)
-	assert.Equal(t, cap(bytes), 352)
+	}
+	bytes := getBytes(order)
+	assert.Equal(t, order, bytesToKernelOrder(bytes))
+	assert.Equal(t, cap(bytes), 512)
 	// fmt.Println(len(bytes))
 	// fmt.Println(cap(bytes))
 }
@@ -0,0 +1,197 @@
+package ker
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// PegReprice is published when a pegged order moves, the TakerOrder of the result holds the order at NewPrice.
+type PegReprice struct {
+	OldPrice int64
+	NewPrice int64
+}
+
+// bestUnpegged returns the best price of a side ignoring pegged orders, so that pegs never reference each other.
+func bestUnpegged(side *SkipList) (int64, bool) {
+	for e := side.Front(); e != nil; e = e.Next() {
+		for le := e.value.(*priceBucket).l.Front(); le != nil; le = le.Next() {
+			order := le.Value.(*types.KernelOrder)
+			if order.PegType == types.NO_PEG {
+				return order.Price, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// pegPrice computes the price of a pegged order from the current book.
+// It returns false if the reference price is missing.
+func (k *kernel) pegPrice(order *types.KernelOrder) (int64, bool) {
+	isBid := order.Amount > 0
+	bestBid, hasBid := bestUnpegged(k.bid)
+	bestAsk, hasAsk := bestUnpegged(k.ask)
+
+	var price int64
+	switch order.PegType {
+	case types.PRIMARY_PEG:
+		if isBid && hasBid {
+			price = bestBid
+		} else if !isBid && hasAsk {
+			price = bestAsk
+		} else {
+			return 0, false
+		}
+	case types.MARKET_PEG:
+		if isBid && hasAsk {
+			price = bestAsk
+		} else if !isBid && hasBid {
+			price = bestBid
+		} else {
+			return 0, false
+		}
+	case types.MIDPOINT_PEG:
+		if !hasBid || !hasAsk {
+			return 0, false
+		}
+		price = bestBid + (bestAsk-bestBid)/2
+	default:
+		return 0, false
+	}
+	price += order.PegOffset
+
+	// bids are rounded down to the tick, asks up
+	if mod := price % k.tickSize; mod != 0 {
+		if mod < 0 {
+			mod += k.tickSize
+		}
+		price -= mod
+		if !isBid {
+			price += k.tickSize
+		}
+	}
+
+	if order.PegLimit != 0 {
+		if isBid && price > order.PegLimit {
+			price = order.PegLimit
+		} else if !isBid && price < order.PegLimit {
+			price = order.PegLimit
+		}
+	}
+
+	// stay one tick away from the opposite side, a pegged order never takes liquidity
+	if isBid && k.ask1Price != math.MaxInt64 && price >= k.ask1Price {
+		price = k.ask1Price - k.tickSize
+	} else if !isBid && k.bid1Price != math.MinInt64 && price <= k.bid1Price {
+		price = k.bid1Price + k.tickSize
+	}
+
+	if price <= 0 {
+		return 0, false
+	}
+	return price, true
+}
+
+// pegRefs are the prices pegged orders depend on.
+type pegRefs struct {
+	ask1, bid1       int64
+	bestAsk, bestBid int64
+}
+
+// pegRefs returns the current reference prices, it is cheap for books without pegged orders.
+func (k *kernel) pegRefs() pegRefs {
+	if k.pegged.Len() == 0 {
+		return pegRefs{}
+	}
+	bestAsk, _ := bestUnpegged(k.ask)
+	bestBid, _ := bestUnpegged(k.bid)
+	return pegRefs{ask1: k.ask1Price, bid1: k.bid1Price, bestAsk: bestAsk, bestBid: bestBid}
+}
+
+// repriceIfMoved reprices the pegged orders if the reference prices moved since before, should sync call.
+// Each book change triggers one pass over the pegged orders, reprices don't trigger another pass.
+func (k *kernel) repriceIfMoved(before pegRefs) {
+	if k.pegged.Len() == 0 || k.pegRefs() == before {
+		return
+	}
+	for e := k.pegged.Front(); e != nil; {
+		next := e.Next()
+		order := e.Value.(*types.KernelOrder)
+		// filled or cancelled since the last pass
+		if order.Status != types.OPEN || order.Left == 0 {
+			k.pegged.Remove(e)
+			e = next
+			continue
+		}
+		if price, ok := k.pegPrice(order); ok && price != order.Price {
+			oldPrice := order.Price
+			k.moveOrder(order, price)
+			k.sendMatchedInfo(&matchedInfo{
+				takerOrder: *order,
+				reprice: &PegReprice{
+					OldPrice: oldPrice,
+					NewPrice: price,
+				},
+			})
+		}
+		e = next
+	}
+}
+
+// findPegged returns the resting pegged order with the given ID, nil if there is none.
+func (k *kernel) findPegged(id uint64) *types.KernelOrder {
+	for e := k.pegged.Front(); e != nil; e = e.Next() {
+		if order := e.Value.(*types.KernelOrder); order.KernelOrderID == id && order.Status == types.OPEN {
+			return order
+		}
+	}
+	return nil
+}
+
+// moveOrder moves a resting order to a new price, it goes to the back of the queue of the new price level.
+func (k *kernel) moveOrder(order *types.KernelOrder, price int64) {
+	side, key := k.ask, float64(order.Price)
+	if order.Amount > 0 {
+		side, key = k.bid, float64(-order.Price)
+	}
+	if e := side.Get(key); e != nil {
+		k.markChanged(side, key)
+		bucket := e.Value().(*priceBucket)
+		for le := bucket.l.Front(); le != nil; le = le.Next() {
+			if le.Value.(*types.KernelOrder) == order {
+				bucket.Left -= order.Left
+				bucket.l.Remove(le)
+				break
+			}
+		}
+		if bucket.l.Len() == 0 {
+			side.Remove(key)
+		}
+	}
+	order.Price = price
+	order.UpdateTime = time.Now().UnixNano()
+	k.insertUnmatchedOrder(order)
+	k.refreshBestPrices()
+}
+
+// rebuildPegs tracks the pegged orders of a restored book, oldest first.
+func (k *kernel) rebuildPegs() {
+	var pegged []*types.KernelOrder
+	for _, side := range []*SkipList{k.ask, k.bid} {
+		for e := side.Front(); e != nil; e = e.Next() {
+			for le := e.value.(*priceBucket).l.Back(); le != nil; le = le.Prev() {
+				if order := le.Value.(*types.KernelOrder); order.PegType != types.NO_PEG {
+					pegged = append(pegged, order)
+				}
+			}
+		}
+	}
+	sort.SliceStable(pegged, func(i, j int) bool {
+		return pegged[i].CreateTime < pegged[j].CreateTime
+	})
+	for _, order := range pegged {
+		k.pegged.PushBack(order)
+	}
+}
@@ -0,0 +1,166 @@
+package ker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_pegPrice(t *testing.T) {
+	k := newKernel()
+	k.tickSize = 4
+	k.insertUnmatchedOrder(newTestBidOrder(100, 10))
+	k.insertUnmatchedOrder(newTestAskOrder(110, 10))
+
+	cases := []struct {
+		name    string
+		pegType types.PegType
+		offset  int64
+		limit   int64
+		amount  int64
+		price   int64
+	}{
+		{"primary bid", types.PRIMARY_PEG, 0, 0, 10, 100},
+		{"primary bid rounds down", types.PRIMARY_PEG, 3, 0, 10, 100},
+		{"primary ask rounds up", types.PRIMARY_PEG, -3, 0, -10, 108},
+		{"market bid rounds down", types.MARKET_PEG, 0, 0, 10, 108},
+		{"market ask stays above bid1", types.MARKET_PEG, 0, 0, -10, 104},
+		{"market bid with offset", types.MARKET_PEG, -8, 0, 10, 100},
+		{"market bid stays below ask1", types.MARKET_PEG, 4, 0, 10, 106},
+		{"midpoint bid", types.MIDPOINT_PEG, 0, 0, 10, 104},
+		{"midpoint ask", types.MIDPOINT_PEG, 0, 0, -10, 108},
+		{"bid capped by limit", types.PRIMARY_PEG, 20, 102, 10, 102},
+		{"ask capped by limit", types.PRIMARY_PEG, -8, 112, -10, 112},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			order := &types.KernelOrder{Amount: c.amount, Left: c.amount, PegOffset: c.offset, PegType: c.pegType}
+			order.PegLimit = c.limit
+			price, ok := k.pegPrice(order)
+			assert.True(t, ok)
+			assert.Equal(t, c.price, price)
+		})
+	}
+
+	// pegged orders are never a reference price
+	pegged := &types.KernelOrder{Amount: 10, Left: 10, PegType: types.PRIMARY_PEG}
+	pegged.Price = 104
+	k.insertUnmatchedOrder(pegged)
+	price, ok := k.pegPrice(&types.KernelOrder{Amount: 10, Left: 10, PegType: types.PRIMARY_PEG})
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), price)
+
+	empty := newKernel()
+	empty.insertUnmatchedOrder(newTestBidOrder(100, 10))
+	_, ok = empty.pegPrice(&types.KernelOrder{Amount: 10, Left: 10, PegType: types.MIDPOINT_PEG})
+	assert.False(t, ok)
+	_, ok = empty.pegPrice(&types.KernelOrder{Amount: -10, Left: -10, PegType: types.PRIMARY_PEG})
+	assert.False(t, ok)
+	_, ok = empty.pegPrice(&types.KernelOrder{Amount: 10, Left: 10, PegOffset: -100, PegType: types.PRIMARY_PEG})
+	assert.False(t, ok)
+}
+
+func Test_orderAcceptor_PegReprice(t *testing.T) {
+	acceptor := newTestAcceptor()
+	events := collectMatchedInfo(acceptor)
+	submitAndWait(acceptor, newTestBidOrder(100, 10))
+	submitAndWait(acceptor, newTestAskOrder(110, 10))
+
+	peg := submitAndWait(acceptor, &types.KernelOrder{Amount: 5, Left: 5, PegOffset: 1, PegType: types.PRIMARY_PEG})
+	assert.Equal(t, int64(101), peg.Price)
+
+	// a better bid moves the peg
+	better := submitAndWait(acceptor, newTestBidOrder(103, 10))
+	repriced := func(mi *matchedInfo) bool { return mi.reprice != nil }
+	mi := nextMatchedInfo(t, events, repriced)
+	assert.Equal(t, PegReprice{OldPrice: 101, NewPrice: 104}, *mi.reprice)
+	assert.Equal(t, peg.KernelOrderID, mi.takerOrder.KernelOrderID)
+	assert.Equal(t, int64(104), mi.takerOrder.Price)
+	assert.True(t, waitForPriceUpdate(acceptor, 110, 104, time.Second))
+
+	// cancelling the reference moves it back
+	submitAndWait(acceptor, &types.KernelOrder{KernelOrderID: better.KernelOrderID, Price: 103})
+	mi = nextMatchedInfo(t, events, repriced)
+	assert.Equal(t, PegReprice{OldPrice: 104, NewPrice: 101}, *mi.reprice)
+
+	mid := submitAndWait(acceptor, &types.KernelOrder{Amount: 5, Left: 5, PegType: types.MIDPOINT_PEG})
+	assert.Equal(t, int64(105), mid.Price)
+
+	// a lower ask moves the midpoint peg, the primary peg doesn't move
+	submitAndWait(acceptor, newTestAskOrder(107, 10))
+	mi = nextMatchedInfo(t, events, repriced)
+	assert.Equal(t, mid.KernelOrderID, mi.takerOrder.KernelOrderID)
+	assert.Equal(t, PegReprice{OldPrice: 105, NewPrice: 103}, *mi.reprice)
+
+	// the client may cancel with the price it last saw
+	submitAndWait(acceptor, &types.KernelOrder{KernelOrderID: mid.KernelOrderID, Price: 105})
+	assert.True(t, waitForPriceUpdate(acceptor, 107, 101, time.Second))
+
+	// the peg gets filled and is no longer tracked
+	submitAndWait(acceptor, newTestAskOrder(101, 5))
+	assert.True(t, waitForPriceUpdate(acceptor, 107, 100, time.Second))
+	assert.Eventually(t, func() bool {
+		return acceptor.kernel.pegged.Len() == 0
+	}, time.Second, 5*time.Millisecond)
+	acceptor.kernel.Stop()
+}
+
+func Test_orderAcceptor_RejectPegWithoutReference(t *testing.T) {
+	acceptor := newTestAcceptor()
+	acceptor.startDummyOrderReceivedChan()
+	acceptor.kernel.startDummyMatchedInfoChan()
+
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 10, Left: 10, PegType: types.PRIMARY_PEG}
+	kerr := <-acceptor.kernel.errorInfoChan
+	var reject *OrderRejectErr
+	assert.True(t, errors.As(kerr, &reject))
+	assert.Equal(t, types.REJECT_NO_PEG_REFERENCE, reject.Reason)
+	assert.Equal(t, 0, acceptor.kernel.bid.Length)
+	acceptor.kernel.Stop()
+}
+
+func Test_Exchange_PegReplayIsExact(t *testing.T) {
+	originalPath := kernelOrderLogPath
+	kernelOrderLogPath = t.TempDir() + "/"
+	defer func() { kernelOrderLogPath = originalPath }()
+	saveOrderLogOrig := saveOrderLog
+	saveOrderLog = true
+	defer func() { saveOrderLog = saveOrderLogOrig }()
+
+	x, err := NewExchange(1, "test_exchange_peg", newTestInstruments("AAA"))
+	assert.Nil(t, err)
+	x.Start()
+	go func() {
+		for range x.Events() {
+		}
+	}()
+
+	assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(100, 10)))
+	assert.Nil(t, x.SubmitOrder("AAA", newTestAskOrder(110, 10)))
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: 5, Left: 5, PegType: types.MIDPOINT_PEG}))
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: -5, Left: -5, PegType: types.PRIMARY_PEG}))
+	assert.Nil(t, x.SubmitOrder("AAA", newTestAskOrder(108, 10)))
+	assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(102, 10)))
+	assert.Eventually(t, func() bool {
+		bid, _ := x.BestBid("AAA")
+		ask, _ := x.BestAsk("AAA")
+		return bid == 105 && ask == 108
+	}, time.Second, 5*time.Millisecond)
+
+	expect, _ := x.OrderBook("AAA")
+	assert.Equal(t, []PriceLevel{{Price: 105, Size: 5}, {Price: 102, Size: 10}, {Price: 100, Size: 10}}, expect.Bids)
+	assert.Equal(t, []PriceLevel{{Price: 108, Size: -15}, {Price: 110, Size: -10}}, expect.Asks)
+	path := x.log.f[0].Name()
+	x.Stop()
+
+	x2, err := NewExchange(1, "test_exchange_peg_2", newTestInstruments("AAA"))
+	assert.Nil(t, err)
+	assert.Nil(t, x2.Recover(path))
+	got, _ := x2.OrderBook("AAA")
+	assert.Equal(t, expect, got)
+	assert.Equal(t, 2, x2.books["AAA"].kernel.pegged.Len())
+}
@@ -0,0 +1,236 @@
+package ker
+
+import (
+	"encoding/json"
+	"math/bits"
+	"sort"
+	"sync"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// Position is the net position of an account in one instrument, built from its fills.
+type Position struct {
+	Account uint64 `json:"account"`
+	// Net size, positive for a long and negative for a short position
+	Size int64 `json:"size"`
+	// Entry cost of the open size, in the units of KernelOrder.FilledTotal, always positive
+	EntryNotional int64 `json:"entry_notional"`
+	// PnL of the closed size, fees excluded
+	RealizedPnL int64 `json:"realized_pnl"`
+	// Fees paid, rebates are negative
+	Fees int64 `json:"fees"`
+	// Quantity scale of the instrument, 0 means 1
+	QtyScale int64 `json:"qty_scale,omitempty"`
+}
+
+// AvgPrice returns the average entry price of the open size, 0 if flat.
+func (p Position) AvgPrice() int64 {
+	if p.Size == 0 {
+		return 0
+	}
+	return mulDiv(p.EntryNotional, max(p.QtyScale, 1), abs(p.Size))
+}
+
+// UnrealizedPnL returns the PnL of the open size marked at the given price.
+func (p Position) UnrealizedPnL(mark int64) int64 {
+	value, _ := types.Notional(p.Size, mark, max(p.QtyScale, 1))
+	if p.Size > 0 {
+		return value - p.EntryNotional
+	}
+	return p.EntryNotional + value
+}
+
+// positionFill is the side of a fill of one account, size is positive for a buy.
+type positionFill struct {
+	account uint64
+	size    int64
+	price   int64
+	fee     int64
+	scale   int64 // quantity scale, 0 means 1
+}
+
+// positionBook tracks the positions of the accounts trading an instrument. The fills of an order are
+// applied once it is placed, in price priority, so that positions don't depend on the order in which
+// the clearBucket goroutines finish.
+type positionBook struct {
+	mux       sync.Mutex
+	positions map[uint64]*Position
+	mark      int64            // set by the operator, 0 to mark at the last trade price
+	last      int64            // last trade price
+	pending   [][]positionFill // fills of the order being placed, one slice per match result
+}
+
+func newPositionBook() *positionBook {
+	return &positionBook{positions: make(map[uint64]*Position)}
+}
+
+// record buffers the fills of a match result, can be called from the clearBucket goroutines.
+// Fills of orders without account are not tracked.
+func (pb *positionBook) record(mi *matchedInfo, fills []Fill, scale int64) {
+	batch := make([]positionFill, 0, 2*len(fills))
+	for i, fill := range fills {
+		maker := &mi.makerOrders[i]
+		size := fill.Size
+		if mi.takerOrder.Amount < 0 {
+			size = -size
+		}
+		if mi.takerOrder.AccountID != 0 {
+			batch = append(batch, positionFill{mi.takerOrder.AccountID, size, fill.Price, fill.TakerFee, scale})
+		}
+		if maker.AccountID != 0 {
+			batch = append(batch, positionFill{maker.AccountID, -size, fill.Price, fill.MakerFee, scale})
+		}
+	}
+	pb.mux.Lock()
+	pb.pending = append(pb.pending, batch)
+	pb.mux.Unlock()
+}
+
+// flush applies the buffered fills of a taker order, should sync call once it is placed.
+func (pb *positionBook) flush(taker *types.KernelOrder) {
+	pb.mux.Lock()
+	defer pb.mux.Unlock()
+	if len(pb.pending) == 0 {
+		return
+	}
+	// every match result is one price level, the levels are applied best price first
+	sort.SliceStable(pb.pending, func(i, j int) bool {
+		if len(pb.pending[i]) == 0 || len(pb.pending[j]) == 0 {
+			return false
+		}
+		if taker.Amount > 0 {
+			return pb.pending[i][0].price < pb.pending[j][0].price
+		}
+		return pb.pending[i][0].price > pb.pending[j][0].price
+	})
+	for _, batch := range pb.pending {
+		for _, fill := range batch {
+			pb.apply(fill)
+		}
+	}
+	pb.pending = pb.pending[:0]
+}
+
+func (pb *positionBook) apply(fill positionFill) {
+	p, ok := pb.positions[fill.account]
+	if !ok {
+		p = &Position{Account: fill.account}
+		pb.positions[fill.account] = p
+	}
+	pb.last = fill.price
+	p.Fees += fill.fee
+	if fill.scale > 1 {
+		p.QtyScale = fill.scale
+	}
+	notional, _ := types.Notional(abs(fill.size), fill.price, max(fill.scale, 1))
+	if p.Size == 0 || (p.Size > 0) == (fill.size > 0) {
+		p.Size += fill.size
+		p.EntryNotional += notional
+		return
+	}
+	// reduce the position at its average cost, then open the rest on the other side
+	closing := min(abs(fill.size), abs(p.Size))
+	cost := mulDiv(p.EntryNotional, closing, abs(p.Size))
+	value := mulDiv(notional, closing, abs(fill.size))
+	if p.Size > 0 {
+		p.RealizedPnL += value - cost
+		p.Size -= closing
+	} else {
+		p.RealizedPnL += cost - value
+		p.Size += closing
+	}
+	p.EntryNotional -= cost
+	if rest := abs(fill.size) - closing; rest > 0 {
+		p.Size = fill.size / abs(fill.size) * rest
+		p.EntryNotional = notional - value
+	}
+}
+
+func (pb *positionBook) get(account uint64) Position {
+	pb.mux.Lock()
+	defer pb.mux.Unlock()
+	if p, ok := pb.positions[account]; ok {
+		return *p
+	}
+	return Position{Account: account}
+}
+
+// all returns the positions sorted by account.
+func (pb *positionBook) all() []Position {
+	pb.mux.Lock()
+	defer pb.mux.Unlock()
+	positions := make([]Position, 0, len(pb.positions))
+	for _, p := range pb.positions {
+		positions = append(positions, *p)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].Account < positions[j].Account
+	})
+	return positions
+}
+
+func (pb *positionBook) setMark(price int64) {
+	pb.mux.Lock()
+	pb.mark = price
+	pb.mux.Unlock()
+}
+
+// markPrice returns the mark price, the last trade price if none is set.
+func (pb *positionBook) markPrice() int64 {
+	pb.mux.Lock()
+	defer pb.mux.Unlock()
+	if pb.mark != 0 {
+		return pb.mark
+	}
+	return pb.last
+}
+
+type positionBookState struct {
+	Positions []Position `json:"positions"`
+	Mark      int64      `json:"mark"`
+	Last      int64      `json:"last"`
+}
+
+// state copies the positions and prices, the copy shares no memory with the book.
+func (pb *positionBook) state() positionBookState {
+	positions := pb.all()
+	pb.mux.Lock()
+	defer pb.mux.Unlock()
+	return positionBookState{Positions: positions, Mark: pb.mark, Last: pb.last}
+}
+
+func (pb *positionBook) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pb.state())
+}
+
+func (pb *positionBook) UnmarshalJSON(b []byte) error {
+	var state positionBookState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	pb.mux.Lock()
+	defer pb.mux.Unlock()
+	pb.positions = make(map[uint64]*Position, len(state.Positions))
+	for i := range state.Positions {
+		pb.positions[state.Positions[i].Account] = &state.Positions[i]
+	}
+	pb.mark = state.Mark
+	pb.last = state.Last
+	return nil
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// mulDiv returns a * b / c for non-negative values with a * b / c fitting in 64 bits,
+// the product is computed in 128 bits.
+func mulDiv(a, b, c int64) int64 {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	q, _ := bits.Div64(hi, lo, uint64(c))
+	return int64(q)
+}
@@ -0,0 +1,149 @@
+package ker
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_positionBook_apply(t *testing.T) {
+	pb := newPositionBook()
+	cases := []struct {
+		name        string
+		size, price int64
+		expect      Position
+		avgPrice    int64
+	}{
+		{"open long", 10, 100, Position{Account: 1, Size: 10, EntryNotional: 1000}, 100},
+		{"add", 10, 110, Position{Account: 1, Size: 20, EntryNotional: 2100}, 105},
+		{"reduce", -5, 120, Position{Account: 1, Size: 15, EntryNotional: 1575, RealizedPnL: 75}, 105},
+		{"flip", -20, 100, Position{Account: 1, Size: -5, EntryNotional: 500}, 100},
+		{"close", 5, 95, Position{Account: 1, RealizedPnL: 25}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pb.apply(positionFill{account: 1, size: c.size, price: c.price, fee: 1})
+			p := pb.get(1)
+			c.expect.Fees = p.Fees
+			assert.Equal(t, c.expect, p)
+			assert.Equal(t, c.avgPrice, p.AvgPrice())
+		})
+	}
+	assert.Equal(t, int64(5), pb.get(1).Fees)
+	assert.Equal(t, int64(95), pb.markPrice())
+	pb.setMark(90)
+	assert.Equal(t, int64(90), pb.markPrice())
+
+	assert.Equal(t, int64(50), Position{Size: -5, EntryNotional: 500}.UnrealizedPnL(90))
+	assert.Equal(t, int64(-50), Position{Size: 5, EntryNotional: 500}.UnrealizedPnL(90))
+	assert.Equal(t, int64(0), Position{}.UnrealizedPnL(90))
+}
+
+func Test_orderAcceptor_Positions(t *testing.T) {
+	acceptor := newTestAcceptor()
+	acceptor.kernel.fees = newTestFeeSchedule()
+	acceptor.kernel.positions = newPositionBook()
+	acceptor.kernel.startDummyMatchedInfoChan()
+
+	// account 2 goes short 10, then the taker sweeps two levels and flips it long
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 3})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: -10, Price: 100, Left: -10, AccountID: 2})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: -10, Price: 100, Left: -10, AccountID: 1})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: -10, Price: 101, Left: -10, AccountID: 1})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 20, Price: 101, Left: 20, AccountID: 2})
+	// orders are placed one at a time, the sweep is done once the next order is received
+	submitAndWait(acceptor, newTestBidOrder(50, 1))
+
+	// the 100 level is applied first whatever goroutine finished first
+	p := acceptor.kernel.positions.get(2)
+	assert.Equal(t, int64(10), p.Size)
+	assert.Equal(t, int64(1010), p.EntryNotional)
+	assert.Equal(t, int64(0), p.RealizedPnL)
+	assert.Equal(t, int64(2+2+3), p.Fees)
+	assert.Equal(t, int64(101), acceptor.kernel.positions.markPrice())
+	assert.Equal(t, int64(0), p.UnrealizedPnL(101))
+
+	// account 1 was short from 100 and 101
+	p = acceptor.kernel.positions.get(1)
+	assert.Equal(t, Position{Account: 1, Size: -20, EntryNotional: 2010}, p)
+	assert.Equal(t, []uint64{1, 2, 3}, func() []uint64 {
+		var accounts []uint64
+		for _, p := range acceptor.kernel.positions.all() {
+			accounts = append(accounts, p.Account)
+		}
+		return accounts
+	}())
+	acceptor.kernel.Stop()
+}
+
+func Test_positionBook_JSON(t *testing.T) {
+	pb := newPositionBook()
+	pb.apply(positionFill{account: 1, size: 10, price: 100, fee: 3})
+	pb.apply(positionFill{account: 2, size: -10, price: 100, fee: -1})
+	pb.setMark(105)
+	b, err := json.Marshal(pb)
+	assert.Nil(t, err)
+
+	restored := newPositionBook()
+	assert.Nil(t, json.Unmarshal(b, restored))
+	assert.Equal(t, pb.all(), restored.all())
+	assert.Equal(t, int64(105), restored.markPrice())
+	restored.setMark(0)
+	assert.Equal(t, int64(100), restored.markPrice())
+
+	// positions survive a snapshot
+	originalPath := kernelSnapshotPath
+	kernelSnapshotPath = t.TempDir() + "/"
+	defer func() { kernelSnapshotPath = originalPath }()
+	k := newKernel()
+	k.positions = pb
+	assert.Nil(t, k.takeSnapshot("positions", newTestBidOrder(100, 1), snapshotPosition{}))
+	entries, err := os.ReadDir(kernelSnapshotPath + "positions/")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	restoredKernel, ok := restoreKernel(kernelSnapshotPath + "positions/" + entries[0].Name())
+	assert.True(t, ok)
+	assert.Equal(t, pb.all(), restoredKernel.positions.all())
+	assert.Nil(t, restoredKernel.ledger)
+}
+
+func Test_MatchingEngine_Positions(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_positions")
+	engine.EnablePositions()
+	engine.Start()
+	go func() {
+		for range engine.MatchedInfoChan() {
+		}
+	}()
+
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 1000, Left: 10, AccountID: 1})
+	engine.SubmitOrder(&types.KernelOrder{Amount: -10, Price: 1000, Left: -10, AccountID: 2})
+	assert.Eventually(t, func() bool {
+		return engine.Position(1).Size == 10
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, Position{Account: 2, Size: -10, EntryNotional: 10000}, engine.Position(2))
+	assert.Equal(t, 2, len(engine.Positions()))
+	assert.Equal(t, int64(1000), engine.MarkPrice())
+	engine.SetMarkPrice(1100)
+	assert.Equal(t, int64(1000), engine.Position(1).UnrealizedPnL(engine.MarkPrice()))
+	engine.Stop()
+
+	x, err := NewExchange(1, "test_exchange_positions", newTestInstruments("AAA"))
+	assert.Nil(t, err)
+	_, err = x.Position("BBB", 1)
+	assert.ErrorIs(t, err, ErrUnknownSymbol)
+	assert.ErrorIs(t, x.SetMarkPrice("BBB", 1), ErrUnknownSymbol)
+	x.EnablePositions()
+	assert.Nil(t, x.SetMarkPrice("AAA", 7))
+	mark, err := x.MarkPrice("AAA")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), mark)
+	positions, err := x.Positions("AAA")
+	assert.Nil(t, err)
+	assert.Empty(t, positions)
+}
@@ -0,0 +1,57 @@
+package ker
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// ErrQueueFull is returned by TrySubmit when the inbound queue of the acceptor is full.
+var ErrQueueFull = errors.New("queue full")
+
+// setQueueDepth replaces the inbound queue, must be called before the acceptor starts.
+func (s *scheduler) setQueueDepth(depth int) error {
+	if depth < 1 {
+		return errors.New("queue depth must be at least 1")
+	}
+	s.newOrderChan = make(chan *types.KernelOrder, depth)
+	return nil
+}
+
+// trySubmit queues an order without blocking.
+func (s *scheduler) trySubmit(order *types.KernelOrder) error {
+	if !s.enter() {
+		return ErrStopped
+	}
+	defer s.leave()
+	select {
+	case s.newOrderChan <- order:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// submitContext queues an order, waiting for room until ctx is done or the intake stops.
+func (s *scheduler) submitContext(ctx context.Context, order *types.KernelOrder) error {
+	if !s.enter() {
+		return ErrStopped
+	}
+	defer s.leave()
+	select {
+	case s.newOrderChan <- order:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.life.closing:
+		return ErrStopped
+	case <-s.kernel.ctx.Done():
+		return ErrStopped
+	}
+}
+
+// submit queues an order, waiting for room until the intake stops.
+func (s *scheduler) submit(order *types.KernelOrder) error {
+	return s.submitContext(context.Background(), order)
+}
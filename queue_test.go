@@ -0,0 +1,62 @@
+package ker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MatchingEngine_Queue(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_queue")
+	assert.NotNil(t, engine.SetQueueDepth(0))
+	assert.Nil(t, engine.SetQueueDepth(3))
+
+	// not started yet, nothing drains the queue
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, engine.TrySubmit(newTestBidOrder(100, 1)))
+	}
+	assert.ErrorIs(t, engine.TrySubmit(newTestBidOrder(100, 1)), ErrQueueFull)
+	assert.Equal(t, 3, engine.QueueDepth())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, engine.SubmitOrderContext(ctx, newTestBidOrder(100, 1)), context.DeadlineExceeded)
+
+	engine.Start()
+	assert.Nil(t, engine.SubmitOrderContext(context.Background(), newTestBidOrder(100, 1)))
+	assert.Eventually(t, func() bool {
+		return engine.QueueDepth() == 0
+	}, time.Second, 5*time.Millisecond)
+	engine.Stop()
+	assert.ErrorIs(t, engine.TrySubmit(newTestBidOrder(100, 1)), ErrStopped)
+	assert.ErrorIs(t, engine.SubmitOrderContext(context.Background(), newTestBidOrder(100, 1)), ErrStopped)
+}
+
+func Test_Exchange_Queue(t *testing.T) {
+	x, err := NewExchange(1, "test_exchange_queue", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.NotNil(t, x.SetQueueDepth(-1))
+	assert.Nil(t, x.SetQueueDepth(2))
+	assert.ErrorIs(t, x.TrySubmit("CCC", newTestBidOrder(100, 1)), ErrUnknownSymbol)
+	assert.ErrorIs(t, x.SubmitOrderContext(context.Background(), "CCC", newTestBidOrder(100, 1)), ErrUnknownSymbol)
+	_, err = x.QueueDepth("CCC")
+	assert.ErrorIs(t, err, ErrUnknownSymbol)
+
+	// the queues are per instrument
+	assert.Nil(t, x.TrySubmit("AAA", newTestBidOrder(100, 1)))
+	assert.Nil(t, x.TrySubmit("AAA", newTestBidOrder(100, 1)))
+	assert.ErrorIs(t, x.TrySubmit("AAA", newTestBidOrder(100, 1)), ErrQueueFull)
+	assert.Nil(t, x.TrySubmit("BBB", newTestBidOrder(100, 1)))
+	depth, err := x.QueueDepth("AAA")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, depth)
+
+	x.Start()
+	assert.Eventually(t, func() bool {
+		bid, _ := x.BestBid("AAA")
+		depth, _ := x.QueueDepth("AAA")
+		return bid == 100 && depth == 0
+	}, time.Second, 5*time.Millisecond)
+	x.Stop()
+}
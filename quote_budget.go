@@ -0,0 +1,130 @@
+package ker
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// checkQuoteBudget validates the quote budget of a new order. Market orders are only supported as
+// quote-budget buys, they never rest. A quote-budget order always goes through matching, which cancels
+// a post-only order, so post-only orders can't have a budget.
+func checkQuoteBudget(order *types.KernelOrder) types.RejectReason {
+	if order.QuoteBudget < 0 {
+		return types.REJECT_INVALID_QUOTE_BUDGET
+	}
+	if order.QuoteBudget == 0 {
+		if order.Type == types.MARKET {
+			return types.REJECT_INVALID_QUOTE_BUDGET
+		}
+		return types.REJECT_NONE
+	}
+	if order.TimeInForce == types.POC {
+		return types.REJECT_POC_QUOTE_BUDGET
+	}
+	if order.Amount < 0 || order.TimeInForce == types.FOK || order.PegType != types.NO_PEG {
+		return types.REJECT_INVALID_QUOTE_BUDGET
+	}
+	return types.REJECT_NONE
+}
+
+// affordable returns how much a quote-budget order can still buy at price, in whole lots.
+func (k *kernel) affordable(order *types.KernelOrder, price int64) int64 {
+	// saturated when the budget buys more than an int64 of units, Left bounds it anyway
+	size, _ := types.Notional(order.QuoteBudget-order.FilledTotal, k.qtyScale, price)
+	return size - size%k.lotSize
+}
+
+// matchWithinBudget matches a quote-budget buy order, the fills stop when the next maker fill would
+// exceed the remaining budget, that maker is filled down to the lot size. One matchedInfo is sent per
+// price level. A limit order rests with the size its remaining budget buys at its price, other orders
+// get cancelled, so a final execution report is sent with the leftover budget.
+func (k *kernel) matchWithinBudget(targetSide *SkipList, takerOrder *types.KernelOrder, removeBucketKeyList *list.List) {
+	exhausted := false
+	for skipListElement := targetSide.Front(); skipListElement != nil && takerOrder.Left > 0 && !exhausted; skipListElement = skipListElement.Next() {
+		bucket := skipListElement.Value().(*priceBucket)
+		price := bucket.l.Front().Value.(*types.KernelOrder).Price
+		if takerOrder.Type != types.MARKET && price > takerOrder.Price {
+			break
+		}
+		matchingInfo := &matchedInfo{
+			makerOrders:    make([]types.KernelOrder, 0, bucket.l.Len()),
+			matchedSizeMap: make(map[uint64]int64),
+		}
+		var took int64
+		for listElement := bucket.l.Back(); listElement != nil && takerOrder.Left > 0; {
+			matchedOrder := listElement.Value.(*types.KernelOrder)
+			size := -matchedOrder.Left
+			if size > takerOrder.Left {
+				size = takerOrder.Left
+			}
+			if afford := k.affordable(takerOrder, price); size > afford {
+				size = afford
+				exhausted = true
+			}
+			if size == 0 {
+				break
+			}
+			unixNano := time.Now().UnixNano()
+			notional := k.notional(size, price)
+			matchedOrder.Left += size
+			matchedOrder.FilledTotal -= notional
+			matchedOrder.UpdateTime = unixNano
+			bucket.Left += size
+			takerOrder.Left -= size
+			takerOrder.FilledTotal += notional
+			took += size
+			matchingInfo.matchedSizeMap[matchedOrder.KernelOrderID] = -size
+
+			prev := listElement.Prev()
+			if matchedOrder.Left == 0 {
+				matchedOrder.Status = types.CLOSED
+				bucket.l.Remove(listElement)
+			}
+			matchingInfo.makerOrders = append(matchingInfo.makerOrders, *matchedOrder)
+			if exhausted {
+				break
+			}
+			listElement = prev
+		}
+		if took != 0 {
+			k.markChanged(targetSide, skipListElement.key)
+		}
+		if bucket.l.Len() == 0 {
+			removeBucketKeyList.PushBack(skipListElement.key)
+		}
+		if took == 0 {
+			break
+		}
+		matchingInfo.matchedSizeMap[takerOrder.KernelOrderID] = took
+		takerOrder.UpdateTime = time.Now().UnixNano()
+		if takerOrder.Left == 0 {
+			takerOrder.Status = types.CLOSED
+		}
+		matchingInfo.takerOrder = *takerOrder
+		k.recordTrades(matchingInfo)
+		k.sendMatchedInfo(matchingInfo)
+	}
+	if takerOrder.Left == 0 {
+		return
+	}
+
+	if takerOrder.Type == types.LIMIT && takerOrder.TimeInForce == types.GTC {
+		if afford := k.affordable(takerOrder, takerOrder.Price); afford > 0 {
+			// as a maker it fills at its own price, so it can never spend more than the budget
+			if takerOrder.Left > afford {
+				takerOrder.Left = afford
+			}
+			k.insertUnmatchedOrder(takerOrder)
+			return
+		}
+	}
+	takerOrder.UpdateTime = time.Now().UnixNano()
+	takerOrder.Status = types.CANCELLED
+	k.sendMatchedInfo(&matchedInfo{
+		makerOrders:    nil,
+		matchedSizeMap: nil,
+		takerOrder:     *takerOrder,
+	})
+}
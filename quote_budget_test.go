@@ -0,0 +1,130 @@
+package ker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_checkQuoteBudget(t *testing.T) {
+	fok := &types.KernelOrder{Amount: 10, Price: 100, Left: 10, QuoteBudget: 1000}
+	fok.TimeInForce = types.FOK
+	pegged := &types.KernelOrder{Amount: 10, Price: 100, Left: 10, QuoteBudget: 1000}
+	pegged.PegType = types.PRIMARY_PEG
+	poc := &types.KernelOrder{Amount: 10, Price: 100, Left: 10, QuoteBudget: 1000}
+	poc.TimeInForce = types.POC
+	pocWithoutBudget := newTestBidOrder(100, 10)
+	pocWithoutBudget.TimeInForce = types.POC
+
+	cases := []struct {
+		name   string
+		order  *types.KernelOrder
+		reason types.RejectReason
+	}{
+		{"limit without budget", newTestBidOrder(100, 10), types.REJECT_NONE},
+		{"limit buy", &types.KernelOrder{Amount: 10, Price: 100, Left: 10, QuoteBudget: 1000}, types.REJECT_NONE},
+		{"market buy", &types.KernelOrder{Amount: 10, Left: 10, QuoteBudget: 1000, Type: types.MARKET}, types.REJECT_NONE},
+		{"market without budget", &types.KernelOrder{Amount: 10, Left: 10, Type: types.MARKET}, types.REJECT_INVALID_QUOTE_BUDGET},
+		{"negative budget", &types.KernelOrder{Amount: 10, Price: 100, Left: 10, QuoteBudget: -1}, types.REJECT_INVALID_QUOTE_BUDGET},
+		{"sell", &types.KernelOrder{Amount: -10, Price: 100, Left: -10, QuoteBudget: 1000}, types.REJECT_INVALID_QUOTE_BUDGET},
+		{"fok", fok, types.REJECT_INVALID_QUOTE_BUDGET},
+		{"pegged", pegged, types.REJECT_INVALID_QUOTE_BUDGET},
+		{"poc", poc, types.REJECT_POC_QUOTE_BUDGET},
+		{"poc without budget", pocWithoutBudget, types.REJECT_NONE},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.reason, checkQuoteBudget(c.order))
+		})
+	}
+}
+
+func Test_orderAcceptor_MarketBuyWithinBudget(t *testing.T) {
+	acceptor := newTestAcceptor()
+	events := collectMatchedInfo(acceptor)
+	submitAndWait(acceptor, newTestAskOrder(100, 10))
+	submitAndWait(acceptor, newTestAskOrder(101, 10))
+	submitAndWait(acceptor, newTestAskOrder(102, 10))
+
+	taker := submitAndWait(acceptor, &types.KernelOrder{Amount: 100, Left: 100, QuoteBudget: 100*10 + 101*5 + 50, Type: types.MARKET})
+	ofTaker := func(mi *matchedInfo) bool { return mi.takerOrder.KernelOrderID == taker.KernelOrderID }
+	mi := nextMatchedInfo(t, events, ofTaker)
+	assert.Equal(t, int64(10), mi.matchedSizeMap[taker.KernelOrderID])
+	assert.Equal(t, int64(1000), mi.takerOrder.FilledTotal)
+
+	// the next maker is filled down to what the budget buys
+	mi = nextMatchedInfo(t, events, ofTaker)
+	assert.Equal(t, int64(5), mi.matchedSizeMap[taker.KernelOrderID])
+	assert.Equal(t, 1, len(mi.makerOrders))
+	assert.Equal(t, int64(-5), mi.makerOrders[0].Left)
+	assert.Equal(t, types.OPEN, mi.makerOrders[0].Status)
+
+	mi = nextMatchedInfo(t, events, ofTaker)
+	assert.Equal(t, types.CANCELLED, mi.takerOrder.Status)
+	assert.Equal(t, int64(85), mi.takerOrder.Left)
+	assert.Equal(t, int64(50), newMatchResult(mi).BudgetLeft)
+
+	assert.True(t, waitForPriceUpdate(acceptor, 101, testBid1PriceEmpty, time.Second))
+	assert.Equal(t, int64(-5), getBucketLeft(acceptor, true))
+	acceptor.kernel.Stop()
+}
+
+func Test_orderAcceptor_BudgetLotSize(t *testing.T) {
+	acceptor := initAcceptor(1, "test")
+	acceptor.setInstrument(&types.Instrument{Symbol: "TEST", TickSize: 1, LotSize: 5})
+	go acceptor.orderAcceptor()
+	events := collectMatchedInfo(acceptor)
+	submitAndWait(acceptor, newTestAskOrder(100, 20))
+
+	taker := submitAndWait(acceptor, &types.KernelOrder{Amount: 20, Left: 20, QuoteBudget: 1299, Type: types.MARKET})
+	ofTaker := func(mi *matchedInfo) bool { return mi.takerOrder.KernelOrderID == taker.KernelOrderID }
+	mi := nextMatchedInfo(t, events, ofTaker)
+	assert.Equal(t, int64(10), mi.matchedSizeMap[taker.KernelOrderID])
+	mi = nextMatchedInfo(t, events, ofTaker)
+	assert.Equal(t, types.CANCELLED, mi.takerOrder.Status)
+	assert.Equal(t, int64(299), newMatchResult(mi).BudgetLeft)
+	acceptor.kernel.Stop()
+}
+
+func Test_orderAcceptor_LimitBuyWithinBudget(t *testing.T) {
+	acceptor := newTestAcceptor()
+	events := collectMatchedInfo(acceptor)
+	submitAndWait(acceptor, newTestAskOrder(105, 10))
+
+	// rests with the size its budget buys at its price
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 50, Price: 104, Left: 50, QuoteBudget: 1000})
+	assert.True(t, waitForPriceUpdate(acceptor, 105, 104, time.Second))
+	assert.Equal(t, int64(9), getBucketLeft(acceptor, false))
+
+	taker := submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 105, Left: 10, QuoteBudget: 630})
+	ofTaker := func(mi *matchedInfo) bool { return mi.takerOrder.KernelOrderID == taker.KernelOrderID }
+	mi := nextMatchedInfo(t, events, ofTaker)
+	assert.Equal(t, int64(6), mi.matchedSizeMap[taker.KernelOrderID])
+	mi = nextMatchedInfo(t, events, ofTaker)
+	assert.Equal(t, types.CANCELLED, mi.takerOrder.Status)
+	assert.Equal(t, int64(0), newMatchResult(mi).BudgetLeft)
+	assert.Equal(t, int64(-4), getBucketLeft(acceptor, true))
+	acceptor.kernel.Stop()
+}
+
+func Test_orderAcceptor_RejectInvalidBudget(t *testing.T) {
+	acceptor := newTestAcceptor()
+	acceptor.startDummyOrderReceivedChan()
+	acceptor.kernel.startDummyMatchedInfoChan()
+
+	for _, order := range []*types.KernelOrder{
+		{Amount: 10, Left: 10, Type: types.MARKET},
+		{Amount: -10, Price: 100, Left: -10, QuoteBudget: 1000},
+	} {
+		acceptor.newOrderChan <- order
+		kerr := <-acceptor.kernel.errorInfoChan
+		var reject *OrderRejectErr
+		assert.True(t, errors.As(kerr, &reject))
+		assert.Equal(t, types.REJECT_INVALID_QUOTE_BUDGET, reject.Reason)
+	}
+	acceptor.kernel.Stop()
+}
@@ -0,0 +1,169 @@
+package ker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// RateLimit is a token bucket: up to Burst orders at once, refilled at Rate orders per second.
+// A zero Rate means unlimited.
+type RateLimit struct {
+	Rate  int64
+	Burst int64
+}
+
+// Validate checks that the limit is usable.
+func (l RateLimit) Validate() error {
+	if l.Rate < 0 || l.Burst < 0 {
+		return errors.New("rate limit: rate and burst must not be negative")
+	}
+	if l.Rate != 0 && l.Burst == 0 {
+		return errors.New("rate limit: burst must be at least 1")
+	}
+	if l.Burst > maxBurst {
+		return errors.New("rate limit: burst too large")
+	}
+	return nil
+}
+
+// ThrottleStats counts the orders rejected with types.REJECT_THROTTLED, by the bucket that was empty.
+type ThrottleStats struct {
+	Account uint64
+	Session uint64
+}
+
+// tokens are counted in nano-tokens, so that refills are exact integers
+const (
+	tokenCost = int64(time.Second)
+	maxBurst  = (1 << 62) / tokenCost
+)
+
+type tokenBucket struct {
+	tokens int64 // nano-tokens
+	last   int64 // unix nano of the last refill
+}
+
+// refill adds the tokens earned since the last refill, up to the burst.
+func (b *tokenBucket) refill(l RateLimit, now int64) {
+	elapsed := now - b.last
+	if elapsed <= 0 {
+		return
+	}
+	// elapsed * Rate could overflow after a long idle time, but then the bucket is full anyway
+	if elapsed > l.Burst*tokenCost/l.Rate {
+		b.tokens = l.Burst * tokenCost
+	} else {
+		b.tokens = min(b.tokens+elapsed*l.Rate, l.Burst*tokenCost)
+	}
+	b.last = now
+}
+
+// take takes one token if there is one.
+func (b *tokenBucket) take(l RateLimit, now int64) bool {
+	b.refill(l, now)
+	if b.tokens < tokenCost {
+		return false
+	}
+	b.tokens -= tokenCost
+	return true
+}
+
+// rateLimiter throttles the new orders of each account and each gateway session, shared by the
+// instruments of an Exchange. Cancels are never throttled, so that a throttled client can still
+// pull its quotes.
+type rateLimiter struct {
+	mux       sync.Mutex
+	account   RateLimit
+	session   RateLimit
+	accounts  map[uint64]*tokenBucket
+	sessions  map[uint64]*tokenBucket
+	pruneAt   int // prune idle buckets once there are that many
+	throttled ThrottleStats
+	now       func() int64
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		accounts: make(map[uint64]*tokenBucket),
+		sessions: make(map[uint64]*tokenBucket),
+		pruneAt:  1024,
+		now:      func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+// setLimits changes the limits, the buckets start over full.
+func (r *rateLimiter) setLimits(account, session RateLimit) {
+	r.mux.Lock()
+	r.account = account
+	r.session = session
+	r.accounts = make(map[uint64]*tokenBucket)
+	r.sessions = make(map[uint64]*tokenBucket)
+	r.mux.Unlock()
+}
+
+// allow takes a token from the buckets of the account and the session of a new order, orders without
+// account or session are only limited by the other one.
+func (r *rateLimiter) allow(order *types.KernelOrder) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.account.Rate == 0 && r.session.Rate == 0 {
+		return true
+	}
+	now := r.now()
+	// a throttled order costs nothing, the account token is given back if the session throttles it
+	account := r.bucket(r.accounts, r.account, order.AccountID, now)
+	session := r.bucket(r.sessions, r.session, order.SessionID, now)
+	if account != nil && !account.take(r.account, now) {
+		r.throttled.Account++
+		return false
+	}
+	if session != nil && !session.take(r.session, now) {
+		if account != nil {
+			account.tokens += tokenCost
+		}
+		r.throttled.Session++
+		return false
+	}
+	if len(r.accounts)+len(r.sessions) >= r.pruneAt {
+		r.prune(now)
+	}
+	return true
+}
+
+func (r *rateLimiter) bucket(buckets map[uint64]*tokenBucket, l RateLimit, id uint64, now int64) *tokenBucket {
+	if id == 0 || l.Rate == 0 {
+		return nil
+	}
+	b, ok := buckets[id]
+	if !ok {
+		b = &tokenBucket{tokens: l.Burst * tokenCost, last: now}
+		buckets[id] = b
+	}
+	return b
+}
+
+// prune drops the buckets that refilled to full, a new bucket starts full anyway. Amortized,
+// the next prune waits for twice as many buckets.
+func (r *rateLimiter) prune(now int64) {
+	pruneBuckets(r.accounts, r.account, now)
+	pruneBuckets(r.sessions, r.session, now)
+	r.pruneAt = max(1024, 2*(len(r.accounts)+len(r.sessions)))
+}
+
+func pruneBuckets(buckets map[uint64]*tokenBucket, l RateLimit, now int64) {
+	for id, b := range buckets {
+		b.refill(l, now)
+		if b.tokens == l.Burst*tokenCost {
+			delete(buckets, id)
+		}
+	}
+}
+
+func (r *rateLimiter) stats() ThrottleStats {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.throttled
+}
@@ -0,0 +1,141 @@
+package ker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_RateLimit_Validate(t *testing.T) {
+	assert.Nil(t, RateLimit{}.Validate())
+	assert.Nil(t, RateLimit{Rate: 10, Burst: 5}.Validate())
+	assert.NotNil(t, RateLimit{Rate: -1, Burst: 5}.Validate())
+	assert.NotNil(t, RateLimit{Rate: 10}.Validate())
+	assert.NotNil(t, RateLimit{Rate: 10, Burst: maxBurst + 1}.Validate())
+}
+
+func Test_rateLimiter_allow(t *testing.T) {
+	r := newRateLimiter()
+	var now int64 = 1000
+	r.now = func() int64 { return now }
+	r.setLimits(RateLimit{Rate: 10, Burst: 2}, RateLimit{Rate: 1, Burst: 3})
+
+	order := &types.KernelOrder{Amount: 1, Price: 100, Left: 1, SessionID: 0}
+	order.AccountID = 1
+	assert.True(t, r.allow(order))
+	assert.True(t, r.allow(order))
+	assert.False(t, r.allow(order))
+	// one token every 100ms
+	now += int64(99 * time.Millisecond)
+	assert.False(t, r.allow(order))
+	now += int64(time.Millisecond)
+	assert.True(t, r.allow(order))
+	assert.False(t, r.allow(order))
+	// accounts are limited apart, orders without account or session are not limited
+	order.AccountID = 2
+	assert.True(t, r.allow(order))
+	order.AccountID = 0
+	for i := 0; i < 10; i++ {
+		assert.True(t, r.allow(order))
+	}
+	assert.Equal(t, ThrottleStats{Account: 3}, r.stats())
+
+	// the session throttles before the account, the account token is given back
+	order = &types.KernelOrder{Amount: 1, Price: 100, Left: 1, SessionID: 7}
+	order.AccountID = 3
+	now += int64(time.Second)
+	for i := 0; i < 3; i++ {
+		now += int64(100 * time.Millisecond)
+		assert.True(t, r.allow(order))
+	}
+	assert.False(t, r.allow(order))
+	assert.Equal(t, ThrottleStats{Account: 3, Session: 1}, r.stats())
+	order.SessionID = 8
+	assert.True(t, r.allow(order))
+
+	// a long idle time refills to the burst only
+	now += int64(100 * 365 * 24 * time.Hour)
+	order.AccountID = 1
+	assert.True(t, r.allow(order))
+	assert.True(t, r.allow(order))
+	assert.False(t, r.allow(order))
+}
+
+func Test_rateLimiter_prune(t *testing.T) {
+	r := newRateLimiter()
+	var now int64
+	r.now = func() int64 { return now }
+	r.setLimits(RateLimit{Rate: 1, Burst: 1}, RateLimit{})
+	r.pruneAt = 4
+	for account := uint64(1); account <= 3; account++ {
+		assert.True(t, r.allow(&types.KernelOrder{AccountID: account, Amount: 1}))
+	}
+	assert.Equal(t, 3, len(r.accounts))
+	// refilled buckets are dropped, they start over full anyway
+	now += int64(time.Second)
+	assert.True(t, r.allow(&types.KernelOrder{AccountID: 4, Amount: 1}))
+	assert.Equal(t, 1, len(r.accounts))
+	assert.Equal(t, 1024, r.pruneAt)
+	assert.False(t, r.allow(&types.KernelOrder{AccountID: 4, Amount: 1}))
+}
+
+func Test_orderAcceptor_Throttle(t *testing.T) {
+	acceptor := newTestAcceptor()
+	acceptor.kernel.startDummyMatchedInfoChan()
+	acceptor.limiter.setLimits(RateLimit{Rate: 1, Burst: 2}, RateLimit{})
+
+	first := submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 1})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 101, Left: 10, AccountID: 1})
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 10, Price: 102, Left: 10, AccountID: 1}
+	expectReject(t, acceptor.kernel.errorInfoChan, types.REJECT_THROTTLED)
+	// cancels are never throttled
+	cancelled := submitAndWait(acceptor, &types.KernelOrder{KernelOrderID: first.KernelOrderID, Price: 100, AccountID: 1})
+	assert.Equal(t, types.CANCELLED, cancelled.Status)
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 102, Left: 10, AccountID: 2})
+	assert.Equal(t, ThrottleStats{Account: 1}, acceptor.limiter.stats())
+	acceptor.kernel.Stop()
+}
+
+func Test_MatchingEngine_RateLimits(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_rate_limits")
+	assert.NotNil(t, engine.SetRateLimits(RateLimit{Rate: 1}, RateLimit{}))
+	assert.NotNil(t, engine.SetRateLimits(RateLimit{}, RateLimit{Rate: -1}))
+	assert.Nil(t, engine.SetRateLimits(RateLimit{}, RateLimit{Rate: 1, Burst: 1}))
+	engine.Start()
+	engine.OpenSession(5)
+
+	engine.SubmitOrder(&types.KernelOrder{Amount: 1, Price: 100, Left: 1, SessionID: 5})
+	engine.SubmitOrder(&types.KernelOrder{Amount: 1, Price: 100, Left: 1, SessionID: 5})
+	select {
+	case err := <-engine.ErrorInfoChan():
+		assert.ErrorContains(t, err, types.REJECT_THROTTLED.String())
+	case <-time.After(time.Second):
+		t.Fatal("expected an order reject")
+	}
+	assert.Equal(t, ThrottleStats{Session: 1}, engine.ThrottleStats())
+	engine.Stop()
+
+	x, err := NewExchange(1, "test_exchange_rate_limits", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.NotNil(t, x.SetRateLimits(RateLimit{Rate: 1}, RateLimit{}))
+	assert.Nil(t, x.SetRateLimits(RateLimit{Rate: 1, Burst: 1}, RateLimit{}))
+	x.Start()
+	go func() {
+		for range x.Events() {
+		}
+	}()
+	// the buckets are shared by the instruments
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: 1, Price: 100, Left: 1, AccountID: 9}))
+	assert.Nil(t, x.SubmitOrder("BBB", &types.KernelOrder{Amount: 1, Price: 100, Left: 1, AccountID: 9}))
+	select {
+	case err := <-x.ErrorInfoChan():
+		assert.ErrorContains(t, err, types.REJECT_THROTTLED.String())
+	case <-time.After(time.Second):
+		t.Fatal("expected an order reject")
+	}
+	assert.Equal(t, ThrottleStats{Account: 1}, x.ThrottleStats())
+	x.Stop()
+}
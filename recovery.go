@@ -0,0 +1,91 @@
+package ker
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// replay applies an order read from the WAL to the book without checks, keeping the ID it was logged with.
+// An order placed by a mass quote is tracked again as a quote of its account.
+func (s *scheduler) replay(order *types.KernelOrder, quote bool) {
+	k := s.kernel
+	if order.Type != types.TRANSFER && order.Amount != 0 {
+		// the order drew its ID when it was accepted
+		s.ids.Drawn++
+	}
+	switch {
+	case order.Type == types.TRANSFER:
+		if k.ledger != nil {
+			k.applyTransfer(order)
+		}
+	case order.Amount == 0:
+		k.cancelOrder(order)
+	case k.ledger != nil && k.reserve(order, func() {}) != types.REJECT_NONE:
+		log.Println("Recovered order rejected by the ledger: ", order.KernelOrderID)
+	default:
+		k.placeOrder(order)
+		if quote {
+			s.trackQuote(order)
+		}
+	}
+}
+
+// restoreSnapshot restores a snapshot read from path with the ID generator state, the last order and
+// the quotes it was taken with.
+func (s *scheduler) restoreSnapshot(snap *snapshotFile, path string) error {
+	if !s.kernel.restore(snap) {
+		return fmt.Errorf("snapshot %s could not be restored", path)
+	}
+	if snap.Position.IDs.Seed != 0 {
+		s.ids = snap.Position.IDs
+	}
+	s.lastOrder = &snap.LastOrder
+	s.restoreQuotes(snap.Quotes)
+	return nil
+}
+
+// recover restores the newest snapshot of dir passing its checks, then replays the records of the WAL
+// written after it. Match results of the replay are not published. The WAL continues after its last record.
+func (s *scheduler) recover(dir string) error {
+	snap, path, err := latestSnapshot(dir)
+	if err != nil {
+		return err
+	}
+	var from walPosition
+	if snap != nil {
+		if err := s.restoreSnapshot(snap, path); err != nil {
+			return err
+		}
+		from = snap.Position.WAL
+	}
+	if err := s.wal.resume(); err != nil {
+		return err
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case <-s.kernel.matchedInfoChan:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	err = readManifest(s.wal.manifestPath(), from, func(rec walRecord) {
+		_, order := rec.order()
+		s.replay(order, rec.quote())
+		s.lastOrder = order
+	})
+	if os.IsNotExist(err) {
+		// nothing was written since the snapshot
+		err = nil
+	}
+	s.risk.trackBook(s.kernel)
+	return err
+}
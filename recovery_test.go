@@ -0,0 +1,188 @@
+package ker
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// setTestSnapshots takes snapshots in a temporary directory.
+func setTestSnapshots(t *testing.T) {
+	originalSnapshotPath := kernelSnapshotPath
+	kernelSnapshotPath = t.TempDir() + "/"
+	t.Cleanup(func() { kernelSnapshotPath = originalSnapshotPath })
+}
+
+// crashTestEngine stops an engine the way a crash does, without sealing its WAL.
+func crashTestEngine(t *testing.T, engine *MatchingEngine) {
+	engine.s.kernel.Stop()
+	<-engine.s.life.done
+	assert.Nil(t, engine.s.wal.f[0].Close())
+}
+
+func Test_MatchingEngine_Recover(t *testing.T) {
+	setTestWAL(t, 3)
+	setTestSnapshots(t)
+	const desc = "test_engine_recover"
+	engine := NewMatchingEngine(1, desc)
+	engine.Start()
+	engine.SubmitOrder(newTestBidOrder(100, 10))
+	engine.SubmitOrder(newTestBidOrder(101, 10))
+	engine.SubmitOrder(newTestAskOrder(110, 10))
+	assert.Eventually(t, func() bool { return engine.BidLength() == 2 && engine.AskLength() == 1 }, time.Second, time.Millisecond)
+
+	// snapshot taken while the engine runs, then more orders are written
+	assert.Nil(t, engine.Snapshot())
+	bid := *engine.s.kernel.bid.Front().value.(*priceBucket).l.Front().Value.(*types.KernelOrder)
+	engine.SubmitOrder(&types.KernelOrder{KernelOrderID: bid.KernelOrderID, Price: bid.Price})
+	engine.SubmitOrder(newTestAskOrder(100, 4))
+	engine.SubmitOrder(newTestBidOrder(105, 3))
+	assert.Eventually(t, func() bool { return engine.s.wal.seq == 6 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	expected := engine.OrderBook()
+	assert.Equal(t, []PriceLevel{{Price: 105, Size: 3}, {Price: 100, Size: 6}}, expected.Bids)
+	crashTestEngine(t, engine)
+
+	// a torn write of the crash
+	torn := appendWALRecord(nil, walOrder, 7, getOrderBinary(newTestBidOrder(100, 1)))
+	f, err := os.OpenFile(engine.s.wal.dir+engine.s.wal.active().File, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(torn[:walHeaderSize+1])
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	recovered := NewMatchingEngine(1, desc)
+	assert.Nil(t, recovered.Recover(kernelSnapshotPath+desc))
+	assert.Equal(t, expected, recovered.OrderBook())
+	assert.Equal(t, uint64(6), recovered.s.wal.seq)
+
+	// new orders continue the WAL
+	recovered.EnableShutdownSnapshot()
+	recovered.Start()
+	recovered.SubmitOrder(newTestAskOrder(120, 1))
+	assert.Nil(t, recovered.Shutdown(t.Context()))
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7}, replayTestSeqs(t, recovered.s.wal))
+
+	// the snapshot written by Shutdown is the newest, nothing is left to replay
+	again := NewMatchingEngine(1, desc)
+	assert.Nil(t, again.Recover(kernelSnapshotPath+desc))
+	assert.Equal(t, recovered.OrderBook(), again.OrderBook())
+}
+
+func Test_MatchingEngine_RecoverWithoutSnapshot(t *testing.T) {
+	setTestWAL(t, 0)
+	setTestSnapshots(t)
+	const desc = "test_engine_recover_wal"
+	engine := NewMatchingEngine(1, desc)
+	engine.Start()
+	engine.SubmitOrder(newTestAskOrder(110, 10))
+	engine.SubmitOrder(newTestBidOrder(110, 4))
+	engine.SubmitOrder(newTestBidOrder(90, 5))
+	assert.Eventually(t, func() bool { return engine.s.wal.seq == 3 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	expected := engine.OrderBook()
+	crashTestEngine(t, engine)
+
+	// the whole WAL is replayed
+	recovered := NewMatchingEngine(1, desc)
+	assert.Nil(t, recovered.Recover(kernelSnapshotPath+desc))
+	assert.Equal(t, expected, recovered.OrderBook())
+
+	// an engine that never wrote recovers an empty book
+	empty := NewMatchingEngine(1, "test_engine_recover_empty")
+	assert.Nil(t, empty.Recover(kernelSnapshotPath+"test_engine_recover_empty"))
+	assert.Equal(t, 0, empty.AskLength()+empty.BidLength())
+}
+
+func Test_MatchingEngine_RecoverGroups(t *testing.T) {
+	// the first bid reserves 1000 and fills at 90, the second one is only backed by what the fill gave back
+	orders := func() []*types.KernelOrder {
+		return []*types.KernelOrder{
+			{Amount: -20, Price: 90, Left: -20, AccountID: 2},
+			{Amount: 10, Price: 100, Left: 10, AccountID: 1},
+			{Amount: 1, Price: 100, Left: 1, AccountID: 1},
+		}
+	}
+	cases := []struct {
+		name   string
+		submit func(t *testing.T, engine *MatchingEngine)
+	}{
+		{"group commit", func(t *testing.T, engine *MatchingEngine) {
+			for _, order := range orders() {
+				engine.SubmitOrder(order)
+			}
+			assert.Eventually(t, func() bool { return engine.s.wal.seq == 5 }, time.Second, time.Millisecond)
+			// a transfer commits the pending group
+			assert.Nil(t, engine.Deposit(3, "USDT", 1))
+		}},
+		{"batch", func(t *testing.T, engine *MatchingEngine) {
+			acks, err := engine.SubmitBatch(t.Context(), orders())
+			assert.Nil(t, err)
+			for _, ack := range acks {
+				assert.True(t, ack.Accepted)
+			}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setTestDurability(t, WAL_GROUP_COMMIT, 100, time.Hour)
+			setTestSnapshots(t)
+			const desc = "test_engine_recover_groups"
+			engine := NewMatchingEngine(1, desc)
+			assert.Nil(t, engine.EnableLedger("BTC", "USDT"))
+			assert.Nil(t, engine.SetQueueDepth(10))
+			engine.Start()
+			assert.Nil(t, engine.Deposit(1, "USDT", 1000))
+			assert.Nil(t, engine.Deposit(2, "BTC", 20))
+			c.submit(t, engine)
+			assert.Equal(t, Balance{Available: 10}, engine.Balance(1, "USDT"))
+			assert.Equal(t, Balance{Available: 11}, engine.Balance(1, "BTC"))
+			expected := engine.OrderBook()
+			crashTestEngine(t, engine)
+
+			// the orders of a group are replayed as they were applied
+			recovered := NewMatchingEngine(1, desc)
+			assert.Nil(t, recovered.EnableLedger("BTC", "USDT"))
+			assert.Nil(t, recovered.Recover(kernelSnapshotPath+desc))
+			assert.Equal(t, expected, recovered.OrderBook())
+			for _, account := range []uint64{1, 2} {
+				for _, asset := range []string{"BTC", "USDT"} {
+					assert.Equal(t, engine.Balance(account, asset), recovered.Balance(account, asset), account, asset)
+				}
+			}
+		})
+	}
+}
+
+func Test_MatchingEngine_RecoverGap(t *testing.T) {
+	dir := setTestWAL(t, 1)
+	setTestSnapshots(t)
+	const desc = "test_engine_recover_gap"
+	engine := NewMatchingEngine(1, desc)
+	engine.Start()
+	for i := int64(0); i < 3; i++ {
+		engine.SubmitOrder(newTestBidOrder(100+i, 1))
+	}
+	assert.Eventually(t, func() bool { return engine.s.wal.seq == 3 }, time.Second, time.Millisecond)
+	engine.s.kernel.Pause()
+	assert.Nil(t, engine.s.kernel.takeSnapshot(desc, engine.s.lastOrder, snapshotPosition{WAL: walPosition{Seq: 1}}))
+	engine.s.kernel.Resume()
+	crashTestEngine(t, engine)
+
+	// the segment of the second record is gone
+	m := readTestManifest(t, dir+desc+walManifestExt)
+	assert.Nil(t, os.Remove(dir+m.Segments[1].File))
+	m.Segments = m.Segments[2:]
+	engine.s.wal.manifest = m
+	assert.Nil(t, engine.s.wal.saveManifest())
+
+	recovered := NewMatchingEngine(1, desc)
+	assert.ErrorIs(t, recovered.Recover(kernelSnapshotPath+desc), ErrCorruptWAL)
+	// the snapshot was restored, nothing after the gap was replayed
+	assert.Equal(t, 3, recovered.BidLength())
+	assert.Equal(t, int64(102), recovered.s.kernel.bid1Price)
+}
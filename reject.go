@@ -0,0 +1,33 @@
+package ker
+
+import (
+	"fmt"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// OrderRejectErr is reported on errorInfoChan when the acceptor refuses an order.
+// Rejected orders never reach the WAL or the order book.
+type OrderRejectErr struct {
+	Order  types.KernelOrder
+	Reason types.RejectReason
+}
+
+func (e *OrderRejectErr) Error() string {
+	return fmt.Sprintf("order %d rejected: %s", e.Order.Id, e.Reason)
+}
+
+// rejectOrder reports a refused order, should be called in the acceptor goroutine.
+func rejectOrder(k *kernel, order *types.KernelOrder, reason types.RejectReason) {
+	rejected := *order
+	rejected.Status = types.REJECTED
+	err := &OrderRejectErr{
+		Order:  rejected,
+		Reason: reason,
+	}
+	if k.held != nil {
+		k.held.add(func() { k.errorInfoChan <- err })
+		return
+	}
+	k.errorInfoChan <- err
+}
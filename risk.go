@@ -0,0 +1,199 @@
+package ker
+
+import (
+	"errors"
+	"math"
+	"sync"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// RiskLimits are the limits of the built-in pre-trade risk check, 0 means unlimited.
+type RiskLimits struct {
+	// Maximum size of an order
+	MaxQty int64
+	// Maximum size * price of an order, the quote budget of a market order, in the units of KernelOrder.FilledTotal
+	MaxNotional int64
+	// How far a bid may be above ask1 and an ask below bid1, as a fraction of that price, ONE is 100%
+	PriceCollar int64
+	// Maximum number of open orders of an account, orders without account are not counted
+	MaxOpenOrders int
+}
+
+// Validate checks that the limits are usable.
+func (l RiskLimits) Validate() error {
+	if l.MaxQty < 0 || l.MaxNotional < 0 || l.PriceCollar < 0 || l.MaxOpenOrders < 0 {
+		return errors.New("risk limits: limits must not be negative")
+	}
+	if l.PriceCollar > types.ONE {
+		return errors.New("risk limits: price collar above 100%")
+	}
+	return nil
+}
+
+// RiskCheck is a custom pre-trade check, it runs in the acceptor goroutine after the built-in checks
+// and before the WAL write. ask1 and bid1 are the current best prices, math.MaxInt64 and math.MinInt64
+// if there is none. Returning anything but types.REJECT_NONE rejects the order.
+type RiskCheck func(order *types.KernelOrder, ask1, bid1 int64) types.RejectReason
+
+// killSwitch holds the accounts that may not send new orders, shared by the instruments of an Exchange.
+type killSwitch struct {
+	mux    sync.Mutex
+	killed map[uint64]bool
+}
+
+func newKillSwitch() *killSwitch {
+	return &killSwitch{killed: make(map[uint64]bool)}
+}
+
+func (ks *killSwitch) set(account uint64, on bool) {
+	ks.mux.Lock()
+	if on {
+		ks.killed[account] = true
+	} else {
+		delete(ks.killed, account)
+	}
+	ks.mux.Unlock()
+}
+
+func (ks *killSwitch) on(account uint64) bool {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	return ks.killed[account]
+}
+
+// riskControl is the pre-trade risk layer of an acceptor. Limits and checks can be changed at any time,
+// the open orders are only tracked by the acceptor goroutine.
+type riskControl struct {
+	mux    sync.Mutex
+	limits RiskLimits
+	checks []RiskCheck
+	kills  *killSwitch
+	open   map[uint64]*openOrders
+	scale  int64 // quantity scale of the instrument, notionals are size * price / scale
+}
+
+// openOrders are the accepted orders of an account, the ones no longer open are pruned lazily.
+type openOrders struct {
+	orders []*types.KernelOrder
+	live   int // number of orders after the last prune
+}
+
+func newRiskControl(kills *killSwitch) *riskControl {
+	return &riskControl{
+		kills: kills,
+		open:  make(map[uint64]*openOrders),
+		scale: 1,
+	}
+}
+
+func (r *riskControl) setLimits(limits RiskLimits) {
+	r.mux.Lock()
+	r.limits = limits
+	r.mux.Unlock()
+}
+
+func (r *riskControl) addCheck(check RiskCheck) {
+	r.mux.Lock()
+	r.checks = append(r.checks, check)
+	r.mux.Unlock()
+}
+
+// check runs the pre-trade checks of a new order, should sync call.
+func (r *riskControl) check(order *types.KernelOrder, ask1, bid1 int64) types.RejectReason {
+	if order.AccountID != 0 && r.kills.on(order.AccountID) {
+		return types.REJECT_RISK_ACCOUNT_KILLED
+	}
+	r.mux.Lock()
+	limits := r.limits
+	checks := r.checks
+	r.mux.Unlock()
+
+	size := order.Amount
+	if size < 0 {
+		size = -size
+	}
+	if limits.MaxQty != 0 && size > limits.MaxQty {
+		return types.REJECT_RISK_MAX_QTY
+	}
+	if limits.MaxNotional != 0 {
+		notional := order.QuoteBudget
+		if order.Type != types.MARKET {
+			notional, _ = types.Notional(size, order.Price, r.scale)
+		}
+		if notional > limits.MaxNotional {
+			return types.REJECT_RISK_MAX_NOTIONAL
+		}
+	}
+	if limits.PriceCollar != 0 && order.Type != types.MARKET {
+		if order.Amount > 0 && ask1 != math.MaxInt64 && order.Price > ask1+types.Fee(ask1, limits.PriceCollar) {
+			return types.REJECT_RISK_PRICE_COLLAR
+		}
+		if order.Amount < 0 && bid1 != math.MinInt64 && order.Price < bid1-types.Fee(bid1, limits.PriceCollar) {
+			return types.REJECT_RISK_PRICE_COLLAR
+		}
+	}
+	if limits.MaxOpenOrders != 0 && order.AccountID != 0 && r.openCount(order.AccountID) >= limits.MaxOpenOrders {
+		return types.REJECT_RISK_MAX_OPEN_ORDERS
+	}
+	for _, check := range checks {
+		if reason := check(order, ask1, bid1); reason != types.REJECT_NONE {
+			return reason
+		}
+	}
+	return types.REJECT_NONE
+}
+
+// track counts an accepted order as open until it is filled or cancelled, should sync call.
+func (r *riskControl) track(order *types.KernelOrder) {
+	if order.AccountID == 0 || order.Status != types.OPEN || order.Left == 0 {
+		return
+	}
+	o, ok := r.open[order.AccountID]
+	if !ok {
+		o = &openOrders{}
+		r.open[order.AccountID] = o
+	}
+	o.orders = append(o.orders, order)
+	// amortized, each order is pruned once
+	if len(o.orders) >= 2*o.live+8 {
+		r.prune(order.AccountID, o)
+	}
+}
+
+func (r *riskControl) openCount(account uint64) int {
+	o, ok := r.open[account]
+	if !ok {
+		return 0
+	}
+	return r.prune(account, o)
+}
+
+func (r *riskControl) prune(account uint64, o *openOrders) int {
+	live := o.orders[:0]
+	for _, order := range o.orders {
+		if order.Status == types.OPEN && order.Left != 0 {
+			live = append(live, order)
+		}
+	}
+	for i := len(live); i < len(o.orders); i++ {
+		o.orders[i] = nil
+	}
+	o.orders = live
+	o.live = len(live)
+	if o.live == 0 {
+		delete(r.open, account)
+	}
+	return o.live
+}
+
+// trackBook tracks the resting orders of a recovered book, should sync call.
+func (r *riskControl) trackBook(k *kernel) {
+	for _, side := range []*SkipList{k.ask, k.bid} {
+		for e := side.Front(); e != nil; e = e.Next() {
+			for le := e.value.(*priceBucket).l.Back(); le != nil; le = le.Prev() {
+				r.track(le.Value.(*types.KernelOrder))
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package ker
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func expectReject(t *testing.T, errs <-chan KernelErr, reason types.RejectReason) {
+	select {
+	case kerr := <-errs:
+		var reject *OrderRejectErr
+		assert.True(t, errors.As(kerr, &reject))
+		assert.Equal(t, reason, reject.Reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected an order reject")
+	}
+}
+
+func Test_RiskLimits_Validate(t *testing.T) {
+	assert.Nil(t, RiskLimits{}.Validate())
+	assert.Nil(t, RiskLimits{MaxQty: 1, MaxNotional: 1, PriceCollar: types.ONE, MaxOpenOrders: 1}.Validate())
+	assert.NotNil(t, RiskLimits{MaxQty: -1}.Validate())
+	assert.NotNil(t, RiskLimits{MaxOpenOrders: -1}.Validate())
+	assert.NotNil(t, RiskLimits{PriceCollar: types.ONE + 1}.Validate())
+}
+
+func Test_riskControl_check(t *testing.T) {
+	r := newRiskControl(newKillSwitch())
+	r.setLimits(RiskLimits{MaxQty: 100, MaxNotional: 10000, PriceCollar: types.ONE / 10})
+
+	cases := []struct {
+		name       string
+		order      *types.KernelOrder
+		ask1, bid1 int64
+		reason     types.RejectReason
+	}{
+		{"within limits", newTestBidOrder(100, 100), 100, 90, types.REJECT_NONE},
+		{"size", newTestBidOrder(10, 101), 100, 90, types.REJECT_RISK_MAX_QTY},
+		{"notional", newTestAskOrder(101, 100), 100, 90, types.REJECT_RISK_MAX_NOTIONAL},
+		{"market budget", &types.KernelOrder{Amount: 10, Left: 10, QuoteBudget: 20000, Type: types.MARKET}, 100, 90, types.REJECT_RISK_MAX_NOTIONAL},
+		{"bid at collar", newTestBidOrder(110, 10), 100, 90, types.REJECT_NONE},
+		{"bid through collar", newTestBidOrder(111, 10), 100, 90, types.REJECT_RISK_PRICE_COLLAR},
+		{"ask at collar", newTestAskOrder(81, 10), 100, 90, types.REJECT_NONE},
+		{"ask through collar", newTestAskOrder(80, 10), 100, 90, types.REJECT_RISK_PRICE_COLLAR},
+		{"no opposite price", newTestBidOrder(500, 10), math.MaxInt64, 90, types.REJECT_NONE},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.reason, r.check(c.order, c.ask1, c.bid1))
+		})
+	}
+
+	// custom checks run after the built-in ones
+	r.addCheck(func(order *types.KernelOrder, ask1, bid1 int64) types.RejectReason {
+		if order.Price == 99 {
+			return types.REJECT_RISK_CUSTOM
+		}
+		return types.REJECT_NONE
+	})
+	assert.Equal(t, types.REJECT_RISK_CUSTOM, r.check(newTestBidOrder(99, 10), 100, 90))
+	assert.Equal(t, types.REJECT_RISK_MAX_QTY, r.check(newTestBidOrder(99, 1000), 100, 90))
+}
+
+func Test_orderAcceptor_RiskOpenOrdersAndKillSwitch(t *testing.T) {
+	acceptor := newTestAcceptor()
+	acceptor.kernel.startDummyMatchedInfoChan()
+	acceptor.risk.setLimits(RiskLimits{MaxOpenOrders: 2})
+
+	first := submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 1})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 101, Left: 10, AccountID: 1})
+	// orders of other accounts are counted apart
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 99, Left: 10, AccountID: 2})
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 10, Price: 102, Left: 10, AccountID: 1}
+	expectReject(t, acceptor.kernel.errorInfoChan, types.REJECT_RISK_MAX_OPEN_ORDERS)
+
+	// cancelled and filled orders are no longer open
+	submitAndWait(acceptor, &types.KernelOrder{KernelOrderID: first.KernelOrderID, Price: 100})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 102, Left: 10, AccountID: 1})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: -10, Price: 102, Left: -10, AccountID: 3})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 103, Left: 10, AccountID: 1})
+	assert.Equal(t, 2, acceptor.risk.openCount(1))
+
+	// limits change at runtime
+	acceptor.risk.setLimits(RiskLimits{})
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 90, Left: 10, AccountID: 1})
+	assert.Equal(t, 3, acceptor.risk.openCount(1))
+
+	acceptor.risk.kills.set(1, true)
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 10, Price: 90, Left: 10, AccountID: 1}
+	expectReject(t, acceptor.kernel.errorInfoChan, types.REJECT_RISK_ACCOUNT_KILLED)
+	// a killed account can still cancel
+	cancelled := submitAndWait(acceptor, &types.KernelOrder{KernelOrderID: 1, Price: 90, AccountID: 1})
+	assert.Equal(t, types.CANCELLED, cancelled.Status)
+	acceptor.risk.kills.set(1, false)
+	submitAndWait(acceptor, &types.KernelOrder{Amount: 10, Price: 90, Left: 10, AccountID: 1})
+	acceptor.kernel.Stop()
+}
+
+func Test_MatchingEngine_RiskChecks(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_risk")
+	assert.NotNil(t, engine.SetRiskLimits(RiskLimits{MaxQty: -1}))
+	assert.Nil(t, engine.SetRiskLimits(RiskLimits{MaxQty: 100}))
+	engine.AddRiskCheck(func(order *types.KernelOrder, ask1, bid1 int64) types.RejectReason {
+		if order.AccountID == 13 {
+			return types.REJECT_RISK_CUSTOM
+		}
+		return types.REJECT_NONE
+	})
+	engine.Start()
+
+	expect := func(reason types.RejectReason) {
+		select {
+		case err := <-engine.ErrorInfoChan():
+			var reject *OrderRejectErr
+			assert.True(t, errors.As(err, &reject))
+			assert.Equal(t, reason, reject.Reason)
+		case <-time.After(time.Second):
+			t.Fatal("expected an order reject")
+		}
+	}
+	engine.SubmitOrder(&types.KernelOrder{Amount: 101, Price: 100, Left: 101, AccountID: 1})
+	expect(types.REJECT_RISK_MAX_QTY)
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 13})
+	expect(types.REJECT_RISK_CUSTOM)
+	engine.SetKillSwitch(1, true)
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 1})
+	expect(types.REJECT_RISK_ACCOUNT_KILLED)
+
+	engine.SetKillSwitch(1, false)
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 1})
+	assert.Eventually(t, func() bool {
+		return engine.BestBid() == 100
+	}, time.Second, 5*time.Millisecond)
+	engine.Stop()
+}
+
+func Test_Exchange_RiskChecks(t *testing.T) {
+	x, err := NewExchange(1, "test_exchange_risk", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, x.SetRiskLimits("CCC", RiskLimits{}), ErrUnknownSymbol)
+	assert.ErrorIs(t, x.AddRiskCheck(nil, "CCC"), ErrUnknownSymbol)
+	assert.Nil(t, x.SetRiskLimits("AAA", RiskLimits{MaxQty: 5}))
+	x.Start()
+	go func() {
+		for range x.Events() {
+		}
+	}()
+
+	// the kill switch applies to every instrument, limits to one
+	x.SetKillSwitch(4, true)
+	var reasons []types.RejectReason
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: 1, Price: 100, Left: 1, AccountID: 4}))
+	assert.Nil(t, x.SubmitOrder("BBB", &types.KernelOrder{Amount: 1, Price: 100, Left: 1, AccountID: 4}))
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 5}))
+	assert.Nil(t, x.SubmitOrder("BBB", &types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 5}))
+	for len(reasons) < 3 {
+		select {
+		case err := <-x.ErrorInfoChan():
+			var reject *OrderRejectErr
+			assert.True(t, errors.As(err, &reject))
+			reasons = append(reasons, reject.Reason)
+		case <-time.After(time.Second):
+			t.Fatal("expected order rejects")
+		}
+	}
+	assert.ElementsMatch(t, []types.RejectReason{types.REJECT_RISK_ACCOUNT_KILLED, types.REJECT_RISK_ACCOUNT_KILLED,
+		types.REJECT_RISK_MAX_QTY}, reasons)
+	assert.Eventually(t, func() bool {
+		bid, _ := x.BestBid("BBB")
+		return bid == 100
+	}, time.Second, 5*time.Millisecond)
+	x.Stop()
+}
@@ -0,0 +1,104 @@
+package ker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrUnknownSession is returned for heartbeats of a session that is not open, or already expired.
+var ErrUnknownSession = errors.New("unknown session")
+
+// sessionManager tracks the liveness of gateway sessions. A session that misses heartbeats for
+// longer than the grace period expires, and the resting orders tagged with it are cancelled.
+type sessionManager struct {
+	mux      sync.Mutex
+	grace    time.Duration
+	lastSeen map[uint64]time.Time
+}
+
+func newSessionManager(grace time.Duration) *sessionManager {
+	return &sessionManager{
+		grace:    grace,
+		lastSeen: make(map[uint64]time.Time),
+	}
+}
+
+func (m *sessionManager) setGracePeriod(grace time.Duration) {
+	m.mux.Lock()
+	m.grace = grace
+	m.mux.Unlock()
+}
+
+// open registers a session, reopening an open session counts as a heartbeat.
+func (m *sessionManager) open(id uint64) {
+	m.mux.Lock()
+	m.lastSeen[id] = time.Now()
+	m.mux.Unlock()
+}
+
+func (m *sessionManager) heartbeat(id uint64) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.lastSeen[id]; !ok {
+		return ErrUnknownSession
+	}
+	m.lastSeen[id] = time.Now()
+	return nil
+}
+
+// close unregisters a session, it returns false if the session was not open.
+func (m *sessionManager) close(id uint64) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.lastSeen[id]; !ok {
+		return false
+	}
+	delete(m.lastSeen, id)
+	return true
+}
+
+func (m *sessionManager) alive(id uint64) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, ok := m.lastSeen[id]
+	return ok
+}
+
+// expire unregisters and returns the sessions without heartbeat since the grace period.
+func (m *sessionManager) expire(now time.Time) []uint64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	var expired []uint64
+	for id, seen := range m.lastSeen {
+		if now.Sub(seen) > m.grace {
+			expired = append(expired, id)
+			delete(m.lastSeen, id)
+		}
+	}
+	return expired
+}
+
+// watch expires sessions until ctx is done. A session is unregistered before onExpire is called,
+// so its new orders are already rejected when its resting orders get cancelled.
+func (m *sessionManager) watch(ctx context.Context, onExpire func(id uint64)) {
+	m.mux.Lock()
+	interval := m.grace / 4
+	m.mux.Unlock()
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, id := range m.expire(now) {
+				onExpire(id)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package ker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_sessionManager(t *testing.T) {
+	m := newSessionManager(time.Second)
+	assert.False(t, m.alive(1))
+	assert.ErrorIs(t, m.heartbeat(1), ErrUnknownSession)
+
+	m.open(1)
+	m.open(2)
+	assert.True(t, m.alive(1))
+	assert.Nil(t, m.heartbeat(1))
+
+	now := time.Now()
+	assert.Equal(t, 0, len(m.expire(now)))
+	m.lastSeen[2] = now.Add(-2 * time.Second)
+	assert.Equal(t, []uint64{2}, m.expire(now))
+	assert.False(t, m.alive(2))
+	assert.ErrorIs(t, m.heartbeat(2), ErrUnknownSession)
+
+	assert.True(t, m.close(1))
+	assert.False(t, m.close(1))
+	assert.False(t, m.alive(1))
+}
+
+func Test_orderAcceptor_RejectClosedSession(t *testing.T) {
+	acceptor := newTestAcceptor()
+	acceptor.startDummyOrderReceivedChan()
+	acceptor.kernel.startDummyMatchedInfoChan()
+
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 10, Price: 100, Left: 10, SessionID: 9}
+	kerr := <-acceptor.kernel.errorInfoChan
+	var reject *OrderRejectErr
+	assert.True(t, errors.As(kerr, &reject))
+	assert.Equal(t, types.REJECT_SESSION_CLOSED, reject.Reason)
+
+	acceptor.sessions.open(9)
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 10, Price: 100, Left: 10, SessionID: 9}
+	// orders without session are never rejected
+	acceptor.newOrderChan <- &types.KernelOrder{Amount: 10, Price: 101, Left: 10, SessionID: 0}
+	assert.Eventually(t, func() bool {
+		return acceptor.kernel.bid.Length == 2
+	}, time.Second, 5*time.Millisecond)
+	acceptor.kernel.Stop()
+}
+
+func Test_MatchingEngine_CancelOnDisconnect(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_session")
+	engine.SetSessionGracePeriod(60 * time.Millisecond)
+	engine.Start()
+
+	engine.OpenSession(1)
+	engine.OpenSession(2)
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100, Left: 10, SessionID: 1})
+	engine.SubmitOrder(&types.KernelOrder{Amount: -10, Price: 120, Left: -10, SessionID: 1})
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 99, Left: 10, SessionID: 2})
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 98, Left: 10, SessionID: 0})
+
+	// session 2 keeps sending heartbeats, session 1 crashed
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				_ = engine.Heartbeat(2)
+			}
+		}
+	}()
+	defer close(stop)
+
+	var cancelled []types.KernelOrder
+	var report *MassCancelReport
+	for report == nil {
+		select {
+		case r := <-engine.MatchedInfoChan():
+			if r.MassCancel != nil {
+				report = r.MassCancel
+			} else {
+				cancelled = append(cancelled, r.TakerOrder)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the orders of session 1 to be cancelled")
+		}
+	}
+	assert.Equal(t, uint64(1), report.Filter.SessionID)
+	assert.Equal(t, 2, report.Cancelled)
+	assert.Equal(t, 2, len(cancelled))
+	for _, order := range cancelled {
+		assert.Equal(t, uint64(1), order.SessionID)
+		assert.Equal(t, types.CANCELLED, order.Status)
+	}
+	assert.Equal(t, int64(99), engine.BestBid())
+	assert.Equal(t, 2, engine.BidLength())
+	assert.Equal(t, 0, engine.AskLength())
+
+	assert.ErrorIs(t, engine.Heartbeat(1), ErrUnknownSession)
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100, Left: 10, SessionID: 1})
+	select {
+	case err := <-engine.ErrorInfoChan():
+		var reject *OrderRejectErr
+		assert.True(t, errors.As(err, &reject))
+		assert.Equal(t, types.REJECT_SESSION_CLOSED, reject.Reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected an order reject")
+	}
+
+	// a clean logout cancels right away
+	closed, err := engine.CloseSession(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, closed.Cancelled)
+	assert.Equal(t, int64(98), engine.BestBid())
+	_, err = engine.CloseSession(2)
+	assert.ErrorIs(t, err, ErrUnknownSession)
+
+	engine.Stop()
+}
+
+func Test_Exchange_CancelOnDisconnect(t *testing.T) {
+	x, err := NewExchange(1, "test_exchange_session", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	x.SetSessionGracePeriod(60 * time.Millisecond)
+	x.Start()
+	go func() {
+		for range x.Events() {
+		}
+	}()
+
+	x.OpenSession(5)
+	x.OpenSession(6)
+	x.OpenSession(7)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				_ = x.Heartbeat(6)
+				_ = x.Heartbeat(7)
+			}
+		}
+	}()
+	defer close(stop)
+
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: 10, Price: 100, Left: 10, SessionID: 5}))
+	assert.Nil(t, x.SubmitOrder("BBB", &types.KernelOrder{Amount: 10, Price: 100, Left: 10, SessionID: 5}))
+	assert.Nil(t, x.SubmitOrder("BBB", &types.KernelOrder{Amount: 10, Price: 90, Left: 10, SessionID: 6}))
+
+	assert.Eventually(t, func() bool {
+		bidA, _ := x.BestBid("AAA")
+		bidB, _ := x.BestBid("BBB")
+		return bidA == testBid1PriceEmpty && bidB == 90
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, x.Heartbeat(5), ErrUnknownSession)
+
+	assert.Nil(t, x.SubmitOrder("AAA", &types.KernelOrder{Amount: 10, Price: 100, Left: 10, SessionID: 7}))
+	assert.Eventually(t, func() bool {
+		bidA, _ := x.BestBid("AAA")
+		return bidA == 100
+	}, time.Second, 5*time.Millisecond)
+	n, err := x.CloseSession(7)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	_, err = x.CloseSession(7)
+	assert.ErrorIs(t, err, ErrUnknownSession)
+
+	x.Stop()
+}
@@ -8,10 +8,22 @@ package ker
 import "time"
 
 var (
-	kernelOrderLogPath   = "./kernelorder_log/"
-	kernelSnapshotPath   = "./orderbook_snapshot/"
-	saveOrderLog         = true
-	redoSnapshotInterval = time.Second
+	kernelOrderLogPath         = "./kernelorder_log/"
+	kernelSnapshotPath         = "./orderbook_snapshot/"
+	saveOrderLog               = true
+	redoSnapshotInterval       = time.Second
+	sessionGracePeriod         = 5 * time.Second
+	defaultQueueDepth          = 1
+	walSegmentSize       int64 = 64 << 20  // bytes of a WAL segment before it is rotated, 0 disables
+	walSegmentAge              = time.Hour // age of a WAL segment before it is rotated, 0 disables
+	walRetention               = false     // delete the WAL segments covered by a snapshot
+	walDurability              = WAL_SYNC
+	walGroupRecords            = 64                     // records fsynced at once by a group commit
+	walGroupInterval           = 200 * time.Microsecond // longest wait of a record for its group commit
+	snapshotInterval           = time.Second            // time between periodic snapshots, 0 disables
+	snapshotRecords            = uint64(0)              // WAL records between periodic snapshots, 0 disables
+	snapshotKeep               = 3                      // periodic snapshots kept in a directory, 0 keeps them all
+	snapshotDeltas             = 0                      // periodic delta snapshots between full ones, 0 disables
 	// marketPriceOffset    = 1.1
 )
 
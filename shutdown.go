@@ -0,0 +1,123 @@
+package ker
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// lifecycle tracks the shutdown of an acceptor. Submitters enter it before queueing, so that the
+// acceptor drains its queues only once no submit is racing with the shutdown.
+type lifecycle struct {
+	closing    chan struct{} // closed once the intake stops
+	done       chan struct{} // closed once the primary acceptor returned
+	submitting atomic.Int64  // submits in progress
+	closeOnce  sync.Once
+	doneOnce   sync.Once
+	eventsOnce sync.Once
+	logOnce    sync.Once
+	snapOnce   sync.Once
+	logErr     error
+	snapSeq    uint64 // WAL sequence covered by the final snapshot
+	snapErr    error
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// stopIntake makes every new submit and request fail with ErrStopped, the acceptor drains what was
+// queued before and returns.
+func (s *scheduler) stopIntake() {
+	s.life.closeOnce.Do(func() {
+		close(s.life.closing)
+	})
+}
+
+// enter registers a submit, it returns false once the intake is stopped. A true return must be
+// followed by a leave call.
+func (s *scheduler) enter() bool {
+	s.life.submitting.Add(1)
+	select {
+	case <-s.life.closing:
+	case <-s.kernel.ctx.Done():
+	default:
+		return true
+	}
+	s.life.submitting.Add(-1)
+	return false
+}
+
+func (s *scheduler) leave() {
+	s.life.submitting.Add(-1)
+}
+
+// drain processes the orders, batches and requests queued before the intake stopped, should sync call.
+// Submitters still blocked on a full queue are served too, it returns once none is left.
+func (s *scheduler) drain() {
+	for {
+		select {
+		case req := <-s.requestChan:
+			s.handleRequest(req)
+		case order := <-s.newOrderChan:
+			s.accept(s.kernel, order, false, s.orderReceivedChan)
+		case batch := <-s.batchChan:
+			s.acceptBatch(batch)
+		case req := <-s.kernel.snapshotChan:
+			s.snapshot(s.kernel, req, false)
+		default:
+			// a submit that left before the load has its order visible in the queue
+			if s.life.submitting.Load() == 0 && len(s.newOrderChan) == 0 {
+				s.commit()
+				return
+			}
+			runtime.Gosched()
+		}
+	}
+}
+
+// closeEvents closes the event channels of the kernel once the acceptor returned, so that the
+// bridges deliver what is left and return. No kernel goroutine outlives the acceptor.
+func (s *scheduler) closeEvents() {
+	<-s.life.done
+	s.life.eventsOnce.Do(func() {
+		close(s.kernel.matchedInfoChan)
+		close(s.kernel.errorInfoChan)
+	})
+}
+
+// closeLog fsyncs and closes the WAL of a standalone acceptor once it returned.
+func (s *scheduler) closeLog() error {
+	<-s.life.done
+	s.life.logOnce.Do(func() {
+		s.life.logErr = s.wal.close()
+	})
+	return s.life.logErr
+}
+
+// finalSnapshot writes a snapshot of the book once the acceptor returned, stamped with the last
+// order written to the WAL, its position, the ID generator state and the quotes. Only the first call
+// writes one, it returns the sequence it covers.
+func (s *scheduler) finalSnapshot() (uint64, error) {
+	<-s.life.done
+	s.life.snapOnce.Do(func() {
+		last := s.lastOrder
+		if last == nil {
+			last = &types.KernelOrder{}
+		}
+		pos := s.snapshotPosition()
+		s.life.snapSeq = pos.WAL.Seq
+		snap, err := s.kernel.capture(s.acceptorDescription, last, pos, 0)
+		if err == nil {
+			snap.Quotes = s.quoteIDs()
+			err = writeSnapshot(snap)
+		}
+		s.life.snapErr = err
+	})
+	return s.life.snapSeq, s.life.snapErr
+}
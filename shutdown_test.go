@@ -0,0 +1,216 @@
+package ker
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_MatchingEngine_Shutdown(t *testing.T) {
+	originalPath := kernelOrderLogPath
+	kernelOrderLogPath = t.TempDir() + "/"
+	defer func() { kernelOrderLogPath = originalPath }()
+	originalSnapshotPath := kernelSnapshotPath
+	kernelSnapshotPath = t.TempDir() + "/"
+	defer func() { kernelSnapshotPath = originalSnapshotPath }()
+	saveOrderLogOrig := saveOrderLog
+	saveOrderLog = true
+	defer func() { saveOrderLog = saveOrderLogOrig }()
+
+	engine := NewMatchingEngine(1, "test_engine_shutdown")
+	assert.Nil(t, engine.SetQueueDepth(100))
+	engine.EnableShutdownSnapshot()
+	engine.Start()
+
+	// the orders wait in the queue while the kernel is paused
+	engine.s.kernel.Pause()
+	for i := int64(0); i < 5; i++ {
+		assert.Nil(t, engine.TrySubmit(newTestBidOrder(100+i, 10)))
+		assert.Nil(t, engine.TrySubmit(newTestAskOrder(100+i, 5)))
+	}
+	assert.Nil(t, engine.TrySubmit(newTestAskOrder(200, 10)))
+	assert.Equal(t, 11, engine.QueueDepth())
+
+	results := make(chan []MatchResult)
+	go func() {
+		var r []MatchResult
+		for mi := range engine.MatchedInfoChan() {
+			r = append(r, mi)
+		}
+		results <- r
+	}()
+	assert.Nil(t, engine.Shutdown(context.Background()))
+
+	// every queued order was processed and its results delivered before the channel was closed
+	select {
+	case r := <-results:
+		assert.Equal(t, 5, len(r))
+	case <-time.After(time.Second):
+		t.Fatal("expected the result channel to be closed")
+	}
+	assert.Equal(t, 5, engine.BidLength())
+	assert.Equal(t, int64(104), engine.BestBid())
+	assert.Equal(t, int64(200), engine.BestAsk())
+
+	// the WAL holds every order and is closed
+	b, err := os.ReadFile(engine.s.wal.f[0].Name())
+	assert.Nil(t, err)
+	assert.Equal(t, 11*(walHeaderSize+orderBinarySize), len(b))
+	_, err = engine.s.wal.f[0].Write([]byte{0})
+	assert.NotNil(t, err)
+
+	// the final snapshot restores the book
+	entries, err := os.ReadDir(kernelSnapshotPath + "test_engine_shutdown/")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	restored, ok := restoreKernel(kernelSnapshotPath + "test_engine_shutdown/" + entries[0].Name())
+	assert.True(t, ok)
+	assert.Equal(t, 5, restored.bid.Length)
+	assert.Equal(t, 1, restored.ask.Length)
+
+	assert.ErrorIs(t, engine.TrySubmit(newTestBidOrder(100, 1)), ErrStopped)
+	assert.ErrorIs(t, engine.SubmitOrderContext(context.Background(), newTestBidOrder(100, 1)), ErrStopped)
+	_, err = engine.SubmitBatch(context.Background(), []*types.KernelOrder{newTestBidOrder(100, 1)})
+	assert.ErrorIs(t, err, ErrStopped)
+	_, err = engine.MassQuote(MassQuote{AccountID: 1})
+	assert.ErrorIs(t, err, ErrStopped)
+	engine.SubmitOrder(newTestBidOrder(100, 1))
+	// stopping again is harmless
+	engine.Stop()
+	assert.Nil(t, engine.Shutdown(context.Background()))
+}
+
+func Test_MatchingEngine_Shutdown_NoOrderLost(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_shutdown_no_order_lost")
+	assert.Nil(t, engine.SetQueueDepth(8))
+	engine.Start()
+
+	// every order accepted by the intake is in the book once Shutdown returns
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	for g := int64(0); g < 8; g++ {
+		wg.Add(1)
+		go func(g int64) {
+			defer wg.Done()
+			for i := int64(1); ; i++ {
+				if engine.SubmitOrderContext(context.Background(), newTestBidOrder(g*100000+i, 1)) != nil {
+					return
+				}
+				accepted.Add(1)
+			}
+		}(g)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, engine.Shutdown(context.Background()))
+	wg.Wait()
+	assert.NotZero(t, accepted.Load())
+	assert.Equal(t, int(accepted.Load()), engine.BidLength())
+}
+
+func Test_MatchingEngine_Shutdown_Timeout(t *testing.T) {
+	engine := NewMatchingEngine(1, "test_engine_shutdown_timeout")
+	engine.Start()
+	go func() {
+		for range engine.ErrorInfoChan() {
+		}
+	}()
+
+	// nobody reads the results, so they can't all be delivered
+	for i := int64(1); i <= 300; i++ {
+		engine.SubmitOrder(newTestBidOrder(i, 1))
+	}
+	engine.SubmitOrder(newTestAskOrder(1, 300))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, engine.Shutdown(ctx), context.DeadlineExceeded)
+
+	// Stop drops what nobody read
+	stopped := make(chan struct{})
+	go func() {
+		engine.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected Stop to return")
+	}
+	assert.Equal(t, 0, engine.BidLength())
+}
+
+func Test_Exchange_Shutdown(t *testing.T) {
+	originalPath := kernelOrderLogPath
+	kernelOrderLogPath = t.TempDir() + "/"
+	defer func() { kernelOrderLogPath = originalPath }()
+	saveOrderLogOrig := saveOrderLog
+	saveOrderLog = true
+	defer func() { saveOrderLog = saveOrderLogOrig }()
+
+	x, err := NewExchange(1, "test_exchange_shutdown", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	x.Start()
+	events := make(chan int)
+	go func() {
+		n := 0
+		for range x.Events() {
+			n++
+		}
+		events <- n
+	}()
+
+	for _, symbol := range x.Symbols() {
+		assert.Nil(t, x.SubmitOrder(symbol, newTestBidOrder(100, 10)))
+		assert.Nil(t, x.SubmitOrder(symbol, newTestAskOrder(100, 10)))
+	}
+	assert.Nil(t, x.Shutdown(context.Background()))
+	select {
+	case n := <-events:
+		assert.Equal(t, 2, n)
+	case <-time.After(time.Second):
+		t.Fatal("expected the event channel to be closed")
+	}
+
+	var logged int
+	assert.Nil(t, readSharedOrderLog(x.log.f[0].Name(), func(walRecord) { logged++ }))
+	assert.Equal(t, 4, logged)
+	_, err = x.log.f[0].Write([]byte{0})
+	assert.NotNil(t, err)
+
+	assert.ErrorIs(t, x.SubmitOrder("AAA", newTestBidOrder(100, 1)), ErrStopped)
+	assert.ErrorIs(t, x.TrySubmit("BBB", newTestBidOrder(100, 1)), ErrStopped)
+	x.Stop()
+}
+
+func Test_Exchange_ShutdownKeepsSharedWAL(t *testing.T) {
+	dir := setTestWAL(t, 1)
+	originalSnapshotPath := kernelSnapshotPath
+	kernelSnapshotPath = t.TempDir() + "/"
+	defer func() { kernelSnapshotPath = originalSnapshotPath }()
+	SetWALRetention(true)
+
+	x, err := NewExchange(1, "test_exchange_shutdown_wal", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	x.EnableShutdownSnapshot()
+	x.Start()
+	assert.Nil(t, x.SubmitOrder("AAA", newTestAskOrder(300, 10)))
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(100, 20)))
+	assert.Nil(t, x.Shutdown(context.Background()))
+
+	// recovery replays the shared WAL, the snapshots don't let it be deleted
+	manifest := dir + "test_exchange_shutdown_wal" + walManifestExt
+	assert.Equal(t, 2, len(readTestManifest(t, manifest).Segments))
+	x2, err := NewExchange(1, "test_exchange_shutdown_wal_2", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.Nil(t, x2.Recover(manifest))
+	ask, _ := x2.BestAsk("AAA")
+	bid, _ := x2.BestBid("BBB")
+	assert.Equal(t, int64(300), ask)
+	assert.Equal(t, int64(100), bid)
+}
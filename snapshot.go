@@ -0,0 +1,422 @@
+package ker
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// ErrCorruptSnapshot is returned when a snapshot file fails its checks.
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// A snapshot is one file named after its creation time in unix nanoseconds, written to a temporary file
+// and renamed once fsynced. It is a little-endian header followed by its payload:
+//
+//	magic    uint32  snapshotMagic
+//	version  uint8   snapshotVersion
+//	reserved [3]byte
+//	length   uint64  payload length
+//	sequence uint64  sequence of the last WAL record applied to the book
+//	crc      uint32  CRC32C of the header bytes before it and of the payload
+//
+// The payload is a gob-encoded snapshotFile.
+const (
+	snapshotHeaderSize        = 28
+	snapshotMagic      uint32 = 0x534b4d47 // "GMKS"
+	snapshotVersion    uint8  = 1
+	snapshotExt               = ".snap"
+)
+
+// snapshotPosition tells where a snapshot stands in the order flow.
+type snapshotPosition struct {
+	// Last WAL record applied to the book
+	WAL walPosition
+	// State of the ID generator once the orders up to that record were accepted
+	IDs idGenerator
+}
+
+// snapshotLevel is a price level of a snapshot, its orders in time priority.
+type snapshotLevel struct {
+	Price  int64
+	Orders []types.KernelOrder
+}
+
+// snapshotFile is the content of a snapshot.
+type snapshotFile struct {
+	Description string
+	// Creation time, unix nanoseconds
+	Created int64
+	// Creation time of the snapshot a delta applies to, 0 for a full snapshot. A delta holds the levels
+	// changed since, a removed level having no orders, and the whole ledger and positions.
+	Parent    int64
+	LastOrder types.KernelOrder
+	// Best price first
+	Asks     []snapshotLevel
+	Bids     []snapshotLevel
+	Position snapshotPosition
+	// JSON of the ledger and of the positions, nil if the kernel has none
+	Ledger    []byte
+	Positions []byte
+	// KernelOrderIDs of the resting quotes of each account, set by the primary acceptor
+	Quotes map[uint64][]uint64
+	// Snapshots a delta applies to, oldest first, set by loadSnapshot
+	chain []*snapshotFile
+	// Copies of the ledger and of the positions taken by capture, encoded into Ledger and Positions by
+	// the writer
+	ledger    *ledgerState
+	positions *positionBookState
+}
+
+// should stop kernel before calling this func
+// The snapshot is durable once it returns, a snapshot that failed to be written leaves no file behind.
+func (k *kernel) takeSnapshot(description string, lastKernelOrder *types.KernelOrder, pos snapshotPosition) error {
+	snap, err := k.capture(description, lastKernelOrder, pos, 0)
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(snap)
+}
+
+// capture copies the state of the kernel into a snapshot, the copy shares no memory with the book.
+// Should sync call, it is the only part of a snapshot the order flow waits for: the copy is encoded by
+// the writer.
+// With SetSnapshotDeltas, a delta of parent is captured if parent is the last snapshot captured, a full
+// snapshot otherwise.
+func (k *kernel) capture(description string, lastKernelOrder *types.KernelOrder, pos snapshotPosition, parent int64) (*snapshotFile, error) {
+	snap := &snapshotFile{
+		Description: description,
+		Created:     time.Now().UnixNano(),
+		Position:    pos,
+	}
+	if snap.Created <= k.lastCapture {
+		snap.Created = k.lastCapture + 1
+	}
+	if parent != 0 && parent == k.lastCapture && k.askChanges != nil {
+		snap.Parent = parent
+		snap.Asks = changedLevels(k.ask, k.askChanges, 1)
+		snap.Bids = changedLevels(k.bid, k.bidChanges, -1)
+	} else {
+		snap.Asks = snapshotLevels(k.ask)
+		snap.Bids = snapshotLevels(k.bid)
+	}
+	if lastKernelOrder != nil {
+		snap.LastOrder = *lastKernelOrder
+	}
+	if k.ledger != nil {
+		state := k.ledger.state()
+		snap.ledger = &state
+	}
+	if k.positions != nil {
+		state := k.positions.state()
+		snap.positions = &state
+	}
+	k.lastCapture = snap.Created
+	k.resetChanges()
+	return snap, nil
+}
+
+// writeSnapshot encodes a captured snapshot and writes it to the directory of its description.
+func writeSnapshot(snap *snapshotFile) error {
+	b, err := encodeSnapshot(snap)
+	if err != nil {
+		return err
+	}
+	dir := kernelSnapshotPath + snap.Description + "/"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(dir, strconv.FormatInt(snap.Created, 10)+snapshotExt, b)
+}
+
+// snapshotRequest asks an acceptor for a snapshot of its kernel. The acceptor copies the book between
+// two orders and goes on trading while the copy is written.
+type snapshotRequest struct {
+	description string
+	last        *types.KernelOrder // last order applied, set by the primary acceptor for its own requests
+	pos         snapshotPosition   // set by the primary acceptor for its own requests
+	parent      int64              // snapshot to take a delta of, 0 for a full snapshot
+	created     int64              // creation time of the snapshot, set by the acceptor
+	delta       bool               // whether a delta was taken, set by the acceptor
+	done        chan error         // result of the write
+}
+
+func newSnapshotRequest(description string, last *types.KernelOrder, pos snapshotPosition) *snapshotRequest {
+	return &snapshotRequest{
+		description: description,
+		last:        last,
+		pos:         pos,
+		done:        make(chan error, 1),
+	}
+}
+
+// snapshot serves a snapshot request in the acceptor goroutine of kernel, should sync call. The primary
+// acceptor commits its pending group first, so that the WAL position covers exactly the orders of the book.
+func (s *scheduler) snapshot(kernel *kernel, req *snapshotRequest, redo bool) {
+	if !redo {
+		s.commit()
+		req.last, req.pos = s.lastOrder, s.snapshotPosition()
+	}
+	snap, err := kernel.capture(req.description, req.last, req.pos, req.parent)
+	if err != nil {
+		req.done <- err
+		return
+	}
+	if !redo {
+		snap.Quotes = s.quoteIDs()
+	}
+	req.created, req.delta = snap.Created, snap.Parent != 0
+	go func() {
+		req.done <- writeSnapshot(snap)
+	}()
+}
+
+// sendSnapshot hands a snapshot request to the acceptor of kernel and waits until the snapshot is written.
+func (s *scheduler) sendSnapshot(kernel *kernel, req *snapshotRequest) error {
+	select {
+	case kernel.snapshotChan <- req:
+	case <-s.kernel.ctx.Done():
+		return ErrStopped
+	}
+	return <-req.done
+}
+
+// requestSnapshot has the primary acceptor take a snapshot, it returns the WAL sequence covered once
+// the snapshot is durable.
+func (s *scheduler) requestSnapshot() (uint64, error) {
+	req := newSnapshotRequest(s.acceptorDescription, nil, snapshotPosition{})
+	if !s.enter() {
+		return 0, ErrStopped
+	}
+	select {
+	case s.kernel.snapshotChan <- req:
+		s.leave()
+	case <-s.life.closing:
+		s.leave()
+		return 0, ErrStopped
+	case <-s.kernel.ctx.Done():
+		s.leave()
+		return 0, ErrStopped
+	}
+	if err := <-req.done; err != nil {
+		return 0, err
+	}
+	return req.pos.WAL.Seq, nil
+}
+
+// snapshotPosition returns the WAL position of the last order written and the ID generator state,
+// should be called by the primary acceptor or once it returned.
+func (s *scheduler) snapshotPosition() snapshotPosition {
+	pos := snapshotPosition{IDs: s.ids}
+	if s.sharedLog != nil {
+		s.sharedLog.mux.Lock()
+		pos.WAL = s.sharedLog.position()
+		s.sharedLog.mux.Unlock()
+	} else {
+		pos.WAL = s.wal.position()
+	}
+	return pos
+}
+
+// snapshotLevels copies the levels of a side with one allocation for its orders and one for its levels,
+// so that the order flow waits for little more than a memory copy of the book.
+func snapshotLevels(side *SkipList) []snapshotLevel {
+	n := 0
+	for bucket := side.Front(); bucket != nil; bucket = bucket.Next() {
+		n += bucket.value.(*priceBucket).l.Len()
+	}
+	orders := make([]types.KernelOrder, 0, n)
+	levels := make([]snapshotLevel, 0, side.Length)
+	for bucket := side.Front(); bucket != nil; bucket = bucket.Next() {
+		start := len(orders)
+		for e := bucket.value.(*priceBucket).l.Front(); e != nil; e = e.Next() {
+			orders = append(orders, *e.Value.(*types.KernelOrder))
+		}
+		levels = append(levels, snapshotLevel{Price: orders[start].Price, Orders: orders[start:len(orders):len(orders)]})
+	}
+	return levels
+}
+
+func encodeSnapshot(snap *snapshotFile) ([]byte, error) {
+	var err error
+	if snap.ledger != nil {
+		if snap.Ledger, err = json.Marshal(snap.ledger); err != nil {
+			return nil, err
+		}
+	}
+	if snap.positions != nil {
+		if snap.Positions, err = json.Marshal(snap.positions); err != nil {
+			return nil, err
+		}
+	}
+	buf := bytes.NewBuffer(make([]byte, snapshotHeaderSize))
+	if err := gob.NewEncoder(buf).Encode(snap); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b[0:], snapshotMagic)
+	b[4] = snapshotVersion
+	binary.LittleEndian.PutUint64(b[8:], uint64(len(b)-snapshotHeaderSize))
+	binary.LittleEndian.PutUint64(b[16:], snap.Position.WAL.Seq)
+	crc := crc32.Update(crc32.Checksum(b[:24], castagnoli), castagnoli, b[snapshotHeaderSize:])
+	binary.LittleEndian.PutUint32(b[24:], crc)
+	return b, nil
+}
+
+// readSnapshot reads and checks a snapshot file, a file failing its checks is reported as ErrCorruptSnapshot.
+func readSnapshot(path string) (*snapshotFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < snapshotHeaderSize {
+		return nil, fmt.Errorf("%w: %s: truncated header", ErrCorruptSnapshot, path)
+	}
+	if magic := binary.LittleEndian.Uint32(b[0:]); magic != snapshotMagic {
+		return nil, fmt.Errorf("%w: %s: bad magic %#x", ErrCorruptSnapshot, path, magic)
+	}
+	if b[4] != snapshotVersion {
+		return nil, fmt.Errorf("%w: %s: unsupported version %d", ErrCorruptSnapshot, path, b[4])
+	}
+	payload := b[snapshotHeaderSize:]
+	if length := binary.LittleEndian.Uint64(b[8:]); length != uint64(len(payload)) {
+		return nil, fmt.Errorf("%w: %s: length %d of a %d bytes payload", ErrCorruptSnapshot, path, length, len(payload))
+	}
+	if crc := crc32.Update(crc32.Checksum(b[:24], castagnoli), castagnoli, payload); crc != binary.LittleEndian.Uint32(b[24:]) {
+		return nil, fmt.Errorf("%w: %s: checksum mismatch", ErrCorruptSnapshot, path)
+	}
+	snap := &snapshotFile{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(snap); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptSnapshot, path, err)
+	}
+	if snap.Position.WAL.Seq != binary.LittleEndian.Uint64(b[16:]) {
+		return nil, fmt.Errorf("%w: %s: sequence mismatch", ErrCorruptSnapshot, path)
+	}
+	return snap, nil
+}
+
+// latestSnapshot returns the newest snapshot of dir passing its checks and its path, nil if there is none.
+// Snapshots failing their checks, or a delta whose chain does, are logged and skipped.
+func latestSnapshot(dir string) (*snapshotFile, string, error) {
+	names, err := snapshotNames(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, t := range names {
+		path := filepath.Join(dir, strconv.FormatInt(t, 10)+snapshotExt)
+		snap, err := loadSnapshot(path)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		return snap, path, nil
+	}
+	return nil, "", nil
+}
+
+// snapshotNames returns the creation times naming the snapshots of dir, newest first, none if dir is missing.
+func snapshotNames(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []int64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), snapshotExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if t, err := strconv.ParseInt(name, 10, 64); err == nil {
+			names = append(names, t)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] > names[j] })
+	return names, nil
+}
+
+// restoreKernel restores the snapshot at path, a delta over the chain of snapshots it applies to.
+func restoreKernel(path string) (*kernel, bool) {
+	snap, err := loadSnapshot(path)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, false
+	}
+	ker := newKernel()
+	if !ker.restore(snap) {
+		return nil, false
+	}
+	return ker, true
+}
+
+// restore loads a snapshot into an empty kernel, it returns false if its ledger or positions can't be read.
+// A delta is applied over the chain loaded with it.
+func (k *kernel) restore(snap *snapshotFile) bool {
+	for _, s := range append(snap.chain[:len(snap.chain):len(snap.chain)], snap) {
+		restoreLevels(k.ask, s.Asks, 1)
+		restoreLevels(k.bid, s.Bids, -1)
+	}
+	if k.ask.Length != 0 {
+		k.ask1Price = k.ask.Front().value.(*priceBucket).l.Front().Value.(*types.KernelOrder).Price
+	}
+	if k.bid.Length != 0 {
+		k.bid1Price = k.bid.Front().value.(*priceBucket).l.Front().Value.(*types.KernelOrder).Price
+	}
+	k.rebuildPegs()
+
+	if snap.Ledger != nil {
+		if k.ledger == nil {
+			k.ledger = newLedger()
+		}
+		if err := json.Unmarshal(snap.Ledger, k.ledger); err != nil {
+			log.Println(err.Error())
+			return false
+		}
+	}
+	if snap.Positions != nil {
+		if k.positions == nil {
+			k.positions = newPositionBook()
+		}
+		if err := json.Unmarshal(snap.Positions, k.positions); err != nil {
+			log.Println(err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// restoreLevels sets the levels of a side, sign orders the side as the kernel does: asks by price, bids
+// by negated price. A level without orders is removed.
+func restoreLevels(side *SkipList, levels []snapshotLevel, sign float64) {
+	for _, level := range levels {
+		if len(level.Orders) == 0 {
+			side.Remove(sign * float64(level.Price))
+			continue
+		}
+		l := list.New()
+		var left int64
+		for i := range level.Orders {
+			l.PushBack(&level.Orders[i])
+			left += level.Orders[i].Left
+		}
+		side.Set(sign*float64(level.Price), &priceBucket{
+			l:    l,
+			Left: left,
+		})
+	}
+}
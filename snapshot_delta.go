@@ -0,0 +1,107 @@
+package ker
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// markChanged records that the level of side at key changed since the last snapshot, when delta
+// snapshots are taken. Should be called by every change of a price level.
+func (k *kernel) markChanged(side *SkipList, key float64) {
+	if k.askChanges == nil {
+		return
+	}
+	if side == k.ask {
+		k.askChanges[key] = true
+	} else {
+		k.bidChanges[key] = true
+	}
+}
+
+// resetChanges tracks the levels changed from the snapshot just captured, if delta snapshots are taken.
+func (k *kernel) resetChanges() {
+	if snapshotDeltas <= 0 {
+		k.askChanges, k.bidChanges = nil, nil
+		return
+	}
+	if k.askChanges == nil {
+		k.askChanges, k.bidChanges = make(map[float64]bool), make(map[float64]bool)
+		return
+	}
+	clear(k.askChanges)
+	clear(k.bidChanges)
+}
+
+// changedLevels copies the changed levels of a side, best price first. A level that was removed is
+// copied without orders. sign turns a key into a price as restoreLevels does.
+func changedLevels(side *SkipList, changes map[float64]bool, sign float64) []snapshotLevel {
+	keys := make([]float64, 0, len(changes))
+	n := 0
+	for key := range changes {
+		keys = append(keys, key)
+		if e := side.Get(key); e != nil {
+			n += e.Value().(*priceBucket).l.Len()
+		}
+	}
+	sort.Float64s(keys)
+	orders := make([]types.KernelOrder, 0, n)
+	levels := make([]snapshotLevel, 0, len(keys))
+	for _, key := range keys {
+		level := snapshotLevel{Price: int64(sign * key)}
+		if e := side.Get(key); e != nil {
+			start := len(orders)
+			for le := e.Value().(*priceBucket).l.Front(); le != nil; le = le.Next() {
+				orders = append(orders, *le.Value.(*types.KernelOrder))
+			}
+			level.Orders = orders[start:len(orders):len(orders)]
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// loadSnapshot reads a snapshot and, for a delta, the chain of snapshots it applies to down to a full
+// one, from the same directory. A chain with a missing or corrupt link is reported as ErrCorruptSnapshot.
+func loadSnapshot(path string) (*snapshotFile, error) {
+	snap, err := readSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	for link := snap; link.Parent != 0; {
+		if link.Parent >= link.Created {
+			return nil, fmt.Errorf("%w: %s: delta of a newer snapshot %d", ErrCorruptSnapshot, path, link.Parent)
+		}
+		parent, err := readSnapshot(filepath.Join(dir, strconv.FormatInt(link.Parent, 10)+snapshotExt))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: base %d: %v", ErrCorruptSnapshot, path, link.Parent, err)
+		}
+		snap.chain = append([]*snapshotFile{parent}, snap.chain...)
+		link = parent
+	}
+	return snap, nil
+}
+
+// compactSnapshot merges a delta and the chain it applies to into a full snapshot, written in place of
+// the delta so that the deltas taken after it still apply. The snapshots of the chain are left to prune.
+func compactSnapshot(path string) error {
+	snap, err := loadSnapshot(path)
+	if err != nil || snap.Parent == 0 {
+		return err
+	}
+	k := newKernel()
+	if !k.restore(snap) {
+		return fmt.Errorf("%w: %s: can't restore its ledger or positions", ErrCorruptSnapshot, path)
+	}
+	full, err := k.capture(snap.Description, &snap.LastOrder, snap.Position, 0)
+	if err != nil {
+		return err
+	}
+	full.Created = snap.Created
+	full.Quotes = snap.Quotes
+	return writeSnapshot(full)
+}
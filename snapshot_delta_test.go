@@ -0,0 +1,270 @@
+package ker
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setTestSnapshotDeltas(t *testing.T, n int) {
+	original := snapshotDeltas
+	SetSnapshotDeltas(n)
+	t.Cleanup(func() { SetSnapshotDeltas(original) })
+}
+
+// assertSameBook checks that two kernels hold the same levels and best prices.
+func assertSameBook(t *testing.T, want, got *kernel) {
+	assert.Equal(t, snapshotLevels(want.ask), snapshotLevels(got.ask))
+	assert.Equal(t, snapshotLevels(want.bid), snapshotLevels(got.bid))
+	assert.Equal(t, want.ask1Price, got.ask1Price)
+	assert.Equal(t, want.bid1Price, got.bid1Price)
+}
+
+func snapshotPath(snap *snapshotFile) string {
+	return kernelSnapshotPath + snap.Description + "/" + strconv.FormatInt(snap.Created, 10) + snapshotExt
+}
+
+func Test_kernel_captureDelta(t *testing.T) {
+	setTestSnapshots(t)
+	setTestSnapshotDeltas(t, 2)
+	k := newKernel()
+	k.startDummyMatchedInfoChan()
+	k.placeOrder(newTestAskOrder(100, 10))
+	k.placeOrder(newTestAskOrder(101, 5))
+	k.placeOrder(newTestBidOrder(98, 3))
+	cancelled := newTestBidOrder(97, 1)
+	k.placeOrder(cancelled)
+
+	// no change is tracked before the first capture, it is a full snapshot
+	base, err := k.capture("delta", nil, snapshotPosition{WAL: walPosition{Seq: 4}}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), base.Parent)
+	assert.Equal(t, 2, len(base.Asks))
+	assert.Nil(t, writeSnapshot(base))
+
+	// a partial fill, a removed level and a new level
+	k.placeOrder(newTestBidOrder(100, 4))
+	k.removeOrder(cancelled)
+	k.placeOrder(newTestAskOrder(102, 2))
+	delta, err := k.capture("delta", nil, snapshotPosition{WAL: walPosition{Seq: 7}}, base.Created)
+	assert.Nil(t, err)
+	assert.Equal(t, base.Created, delta.Parent)
+	assert.Equal(t, []int64{100, 102}, []int64{delta.Asks[0].Price, delta.Asks[1].Price})
+	assert.Equal(t, 1, len(delta.Bids))
+	assert.Equal(t, int64(97), delta.Bids[0].Price)
+	assert.Empty(t, delta.Bids[0].Orders)
+	assert.Nil(t, writeSnapshot(delta))
+
+	restored, ok := restoreKernel(snapshotPath(delta))
+	assert.True(t, ok)
+	assertSameBook(t, k, restored)
+	snap, path, err := latestSnapshot(kernelSnapshotPath + "delta")
+	assert.Nil(t, err)
+	assert.Equal(t, snapshotPath(delta), path)
+	assert.Equal(t, uint64(7), snap.Position.WAL.Seq)
+	assert.Equal(t, 1, len(snap.chain))
+
+	// a delta of a snapshot that is not the last captured is a full snapshot
+	full, err := k.capture("delta", nil, snapshotPosition{}, base.Created)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), full.Parent)
+	assert.Equal(t, 3, len(full.Asks))
+
+	// without deltas no change is tracked
+	SetSnapshotDeltas(0)
+	_, err = k.capture("delta", nil, snapshotPosition{}, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, k.askChanges)
+	k.placeOrder(newTestAskOrder(103, 1))
+	next, err := k.capture("delta", nil, snapshotPosition{}, k.lastCapture)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), next.Parent)
+}
+
+func Test_compactSnapshot(t *testing.T) {
+	setTestSnapshots(t)
+	setTestSnapshotDeltas(t, 2)
+	k := newKernel()
+	k.startDummyMatchedInfoChan()
+	k.ledger = newLedger()
+	k.placeOrder(newTestAskOrder(100, 10))
+	k.placeOrder(newTestBidOrder(98, 3))
+	var chain []*snapshotFile
+	take := func(parent int64) *snapshotFile {
+		snap, err := k.capture("compact", nil, snapshotPosition{WAL: walPosition{Seq: uint64(len(chain) + 1)}}, parent)
+		assert.Nil(t, err)
+		assert.Nil(t, writeSnapshot(snap))
+		chain = append(chain, snap)
+		return snap
+	}
+	take(0)
+	k.placeOrder(newTestBidOrder(100, 4))
+	take(chain[0].Created)
+	k.placeOrder(newTestAskOrder(99, 2))
+	k.placeOrder(newTestBidOrder(97, 1))
+	last := take(chain[1].Created)
+	assert.Equal(t, chain[1].Created, last.Parent)
+
+	// the middle delta becomes a full snapshot in place, the last delta still applies over it
+	assert.Nil(t, compactSnapshot(snapshotPath(chain[1])))
+	compacted, err := readSnapshot(snapshotPath(chain[1]))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), compacted.Parent)
+	assert.Equal(t, chain[1].Created, compacted.Created)
+	assert.Equal(t, chain[1].Position, compacted.Position)
+	assert.NotNil(t, compacted.Ledger)
+	assert.Nil(t, os.Remove(snapshotPath(chain[0])))
+	restored, ok := restoreKernel(snapshotPath(last))
+	assert.True(t, ok)
+	assertSameBook(t, k, restored)
+	// compacting a full snapshot is a no-op
+	assert.Nil(t, compactSnapshot(snapshotPath(chain[1])))
+
+	// a delta whose base is missing is corrupt and skipped
+	assert.Nil(t, os.Remove(snapshotPath(chain[1])))
+	_, err = loadSnapshot(snapshotPath(last))
+	assert.ErrorIs(t, err, ErrCorruptSnapshot)
+	_, ok = restoreKernel(snapshotPath(last))
+	assert.False(t, ok)
+	snap, _, err := latestSnapshot(kernelSnapshotPath + "compact")
+	assert.Nil(t, err)
+	assert.Nil(t, snap)
+}
+
+func Test_snapshotSchedule_pruneChain(t *testing.T) {
+	setTestSnapshots(t)
+	setTestSnapshotDeltas(t, 3)
+	dir := kernelSnapshotPath + "prune_chain/"
+	k := newKernel()
+	var created []int64
+	take := func(parent int64) {
+		k.insertUnmatchedOrder(newTestAskOrder(100+int64(len(created)), 1))
+		snap, err := k.capture("prune_chain", nil, snapshotPosition{WAL: walPosition{Seq: uint64(len(created) + 1)}}, parent)
+		assert.Nil(t, err)
+		assert.Nil(t, writeSnapshot(snap))
+		created = append(created, snap.Created)
+	}
+	take(0)
+	take(0)
+	take(created[1])
+	take(created[2])
+
+	// the full snapshot and the delta the kept one applies to are kept
+	assert.Nil(t, (&snapshotSchedule{keep: 1}).prune(dir))
+	names, err := snapshotNames(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{created[3], created[2], created[1]}, names)
+	restored, ok := restoreKernel(dir + strconv.FormatInt(created[3], 10) + snapshotExt)
+	assert.True(t, ok)
+	assertSameBook(t, k, restored)
+
+	take(0)
+	assert.Nil(t, (&snapshotSchedule{keep: 1}).prune(dir))
+	names, err = snapshotNames(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{created[4]}, names)
+}
+
+func Test_snapshotSchedule_settle(t *testing.T) {
+	setTestSnapshots(t)
+	setTestSnapshotDeltas(t, 2)
+	k := newKernel()
+	p := &snapshotSchedule{deltas: 2}
+	price := int64(100)
+	take := func() *snapshotRequest {
+		price--
+		k.insertUnmatchedOrder(newTestBidOrder(price, 1))
+		req := newSnapshotRequest("settle", nil, snapshotPosition{})
+		req.parent = p.parent
+		snap, err := k.capture(req.description, nil, req.pos, req.parent)
+		assert.Nil(t, err)
+		req.created, req.delta = snap.Created, snap.Parent != 0
+		assert.Nil(t, p.settle(req, writeSnapshot(snap)))
+		return req
+	}
+	assert.False(t, take().delta)
+	assert.True(t, take().delta)
+	assert.Equal(t, 1, p.depth)
+	// the second delta of the chain is compacted
+	second := take()
+	assert.True(t, second.delta)
+	assert.Equal(t, 0, p.depth)
+	compacted, err := readSnapshot(kernelSnapshotPath + "settle/" + strconv.FormatInt(second.created, 10) + snapshotExt)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), compacted.Parent)
+	assert.True(t, take().delta)
+
+	// a failed write restarts the chain with a full snapshot
+	assert.ErrorIs(t, p.settle(newSnapshotRequest("settle", nil, snapshotPosition{}), os.ErrClosed), os.ErrClosed)
+	assert.Equal(t, int64(0), p.parent)
+	assert.False(t, take().delta)
+}
+
+func Test_MatchingEngine_PeriodicDeltaSnapshots(t *testing.T) {
+	setTestWAL(t, 0)
+	setTestSnapshots(t)
+	setTestSnapshotPolicy(t, 0, 1, 2)
+	setTestSnapshotDeltas(t, 2)
+	const desc = "test_engine_periodic_delta"
+	engine := NewMatchingEngine(1, desc)
+	engine.EnablePeriodicSnapshots()
+	engine.Start()
+	const n = 12
+	for i := int64(0); i < n; i++ {
+		if i%3 == 2 {
+			engine.SubmitOrder(newTestAskOrder(100+i%5, 1))
+		} else {
+			engine.SubmitOrder(newTestBidOrder(100+i%4, 2))
+		}
+	}
+	assert.Eventually(t, func() bool {
+		snap, _, err := latestSnapshot(kernelSnapshotPath + desc)
+		return err == nil && snap != nil && snap.Position.WAL.Seq == n
+	}, time.Second, time.Millisecond)
+	crashTestEngine(t, engine)
+
+	// every snapshot kept restores, the newest one to the book
+	names, err := snapshotNames(kernelSnapshotPath + desc)
+	assert.Nil(t, err)
+	for _, name := range names {
+		_, err := loadSnapshot(kernelSnapshotPath + desc + "/" + strconv.FormatInt(name, 10) + snapshotExt)
+		assert.Nil(t, err)
+	}
+	_, path, err := latestSnapshot(kernelSnapshotPath + desc)
+	assert.Nil(t, err)
+	restored, ok := restoreKernel(path)
+	assert.True(t, ok)
+	assertSameBook(t, engine.s.kernel, restored)
+}
+
+// BenchmarkSnapshotCaptureDelta measures the time the order flow waits for a delta snapshot of a book of
+// 10000 orders, by number of changed levels.
+func BenchmarkSnapshotCaptureDelta(b *testing.B) {
+	original := snapshotDeltas
+	SetSnapshotDeltas(1)
+	defer SetSnapshotDeltas(original)
+	for _, changed := range []int64{1, 10, 100} {
+		b.Run(strconv.FormatInt(changed, 10), func(b *testing.B) {
+			k := newKernel()
+			for i := int64(0); i < 5000; i++ {
+				k.insertUnmatchedOrder(newTestAskOrder(1001+i%500, 1))
+				k.insertUnmatchedOrder(newTestBidOrder(1000-i%500, 1))
+			}
+			if _, err := k.capture("bench", nil, snapshotPosition{}, 0); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := int64(0); j < changed; j++ {
+					k.markChanged(k.ask, float64(1001+j))
+				}
+				if _, err := k.capture("bench", nil, snapshotPosition{}, k.lastCapture); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package ker
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// snapshotSchedule triggers the periodic snapshots of a kernel, on time and on the number of WAL records
+// of the book written since the last one, and prunes the old snapshots of its directory.
+type snapshotSchedule struct {
+	interval time.Duration // 0 disables the time trigger
+	records  uint64        // 0 disables the record trigger
+	keep     int           // snapshots kept, 0 keeps them all
+	deltas   int           // delta snapshots between full ones, 0 disables
+	parent   int64         // snapshot the next delta applies to, 0 takes a full one
+	depth    int           // deltas since the last full snapshot
+	seq      uint64        // records of the book covered by the last snapshot
+	at       time.Time     // time of the last snapshot
+	ticker   *time.Ticker  // wakes an idle acceptor for the time trigger
+	writing  sync.WaitGroup
+	busy     bool          // a snapshot is being written, only read and set by the acceptor
+	written  chan struct{} // wakes the acceptor once the snapshot is written
+}
+
+func newSnapshotSchedule() *snapshotSchedule {
+	return &snapshotSchedule{
+		interval: snapshotInterval,
+		records:  snapshotRecords,
+		keep:     snapshotKeep,
+		deltas:   snapshotDeltas,
+		at:       time.Now(),
+		written:  make(chan struct{}, 1),
+	}
+}
+
+// due tells whether a snapshot of the book is due once seq records of it were written, never if none was
+// written since the last one.
+func (p *snapshotSchedule) due(seq uint64, now time.Time) bool {
+	if seq == p.seq {
+		return false
+	}
+	return (p.records > 0 && seq-p.seq >= p.records) || (p.interval > 0 && now.Sub(p.at) >= p.interval)
+}
+
+// taken records a snapshot covering seq records of the book.
+func (p *snapshotSchedule) taken(seq uint64, now time.Time) {
+	p.seq, p.at = seq, now
+}
+
+// settle follows the chain of delta snapshots once the snapshot of req is written with the result err.
+// The chain is compacted into a full snapshot once it holds deltas deltas, the next snapshot is a full one
+// if the write or the compaction failed.
+func (p *snapshotSchedule) settle(req *snapshotRequest, err error) error {
+	if err != nil {
+		p.parent, p.depth = 0, 0
+		return err
+	}
+	p.parent = req.created
+	if !req.delta {
+		p.depth = 0
+		return nil
+	}
+	if p.depth++; p.depth < p.deltas {
+		return nil
+	}
+	p.depth = 0
+	if err := compactSnapshot(kernelSnapshotPath + req.description + "/" + strconv.FormatInt(req.created, 10) + snapshotExt); err != nil {
+		p.parent = 0
+		return err
+	}
+	return nil
+}
+
+// tick returns the channel waking the acceptor for the time trigger, nil-safe.
+func (p *snapshotSchedule) tick() <-chan time.Time {
+	if p == nil || p.ticker == nil {
+		return nil
+	}
+	return p.ticker.C
+}
+
+// finished returns the channel waking the acceptor once the snapshot being written is done, nil-safe.
+func (p *snapshotSchedule) finished() <-chan struct{} {
+	if p == nil {
+		return nil
+	}
+	return p.written
+}
+
+// start arms the time trigger of the acceptor, stop disarms it and waits for the snapshot being written.
+// Both are nil-safe.
+func (p *snapshotSchedule) start() {
+	if p != nil && p.interval > 0 {
+		p.ticker = time.NewTicker(p.interval)
+	}
+}
+
+func (p *snapshotSchedule) stop() {
+	if p == nil {
+		return
+	}
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+	p.writing.Wait()
+}
+
+// prune deletes the snapshots of dir older than the newest keep ones that pass their checks, so that
+// a snapshot is only deleted once newer ones are known complete. The snapshots a kept delta applies to
+// are kept with it.
+func (p *snapshotSchedule) prune(dir string) error {
+	if p.keep <= 0 {
+		return nil
+	}
+	names, err := snapshotNames(dir)
+	if err != nil {
+		return err
+	}
+	chains := make(map[int64]bool)
+	complete := 0
+	for i, t := range names {
+		if complete == p.keep {
+			for _, t := range names[i:] {
+				if chains[t] {
+					continue
+				}
+				if err := os.Remove(filepath.Join(dir, strconv.FormatInt(t, 10)+snapshotExt)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return nil
+		}
+		if snap, err := loadSnapshot(filepath.Join(dir, strconv.FormatInt(t, 10)+snapshotExt)); err == nil {
+			complete++
+			for _, link := range snap.chain {
+				chains[link.Created] = true
+			}
+		}
+	}
+	return nil
+}
+
+// periodicSnapshot takes a snapshot of the primary kernel when its schedule is due, should sync call.
+// No snapshot starts while the previous one is being written. Once written, a chain of deltas is compacted
+// when due, the old snapshots are pruned and, with SetWALRetention, the WAL segments it covers are deleted.
+func (s *scheduler) periodicSnapshot(kernel *kernel) {
+	p := s.periodic
+	now := time.Now()
+	// the sequence of a shared WAL goes on with the orders of the other books, the records of this one tell
+	// whether it changed
+	if p.busy || !p.due(s.logged, now) {
+		return
+	}
+	req := newSnapshotRequest(s.acceptorDescription, nil, snapshotPosition{})
+	req.parent = p.parent
+	s.snapshot(kernel, req, false)
+	p.taken(s.logged, now)
+	p.busy = true
+	p.writing.Add(1)
+	go func() {
+		defer p.writing.Done()
+		defer func() { p.written <- struct{}{} }()
+		err := p.settle(req, <-req.done)
+		if err == nil {
+			err = p.prune(kernelSnapshotPath + req.description)
+		}
+		if err == nil && walRetention && s.sharedLog == nil {
+			err = s.wal.retain(req.pos.WAL.Seq)
+		}
+		if err != nil {
+			log.Println("periodic snapshot failed: ", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,168 @@
+package ker
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setTestSnapshotPolicy(t *testing.T, interval time.Duration, records uint64, keep int) {
+	originalInterval, originalRecords, originalKeep := snapshotInterval, snapshotRecords, snapshotKeep
+	SetSnapshotPolicy(interval, records, keep)
+	t.Cleanup(func() { SetSnapshotPolicy(originalInterval, originalRecords, originalKeep) })
+}
+
+func Test_snapshotSchedule_due(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name     string
+		interval time.Duration
+		records  uint64
+		seq      uint64
+		elapsed  time.Duration
+		due      bool
+	}{
+		{"unchanged", time.Second, 1, 10, time.Hour, false},
+		{"records", 0, 5, 15, 0, true},
+		{"few records", 0, 5, 14, time.Hour, false},
+		{"interval", time.Second, 0, 11, time.Second, true},
+		{"early", time.Second, 0, 11, time.Second - 1, false},
+		{"disabled", 0, 0, 100, time.Hour, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := &snapshotSchedule{interval: c.interval, records: c.records}
+			p.taken(10, now)
+			assert.Equal(t, c.due, p.due(c.seq, now.Add(c.elapsed)))
+		})
+	}
+}
+
+func Test_snapshotSchedule_prune(t *testing.T) {
+	setTestSnapshots(t)
+	dir := kernelSnapshotPath + "prune/"
+	k := newKernel()
+	for seq := uint64(1); seq <= 4; seq++ {
+		assert.Nil(t, k.takeSnapshot("prune", nil, snapshotPosition{WAL: walPosition{Seq: seq}}))
+		time.Sleep(time.Millisecond)
+	}
+	// a newer snapshot that is not complete doesn't count
+	torn := strconv.FormatInt(time.Now().UnixNano(), 10) + snapshotExt
+	assert.Nil(t, os.WriteFile(dir+torn, []byte("GMKS"), 0644))
+	seqs := func() []uint64 {
+		var seqs []uint64
+		names, err := snapshotNames(dir)
+		assert.Nil(t, err)
+		for _, name := range names {
+			if snap, err := readSnapshot(dir + strconv.FormatInt(name, 10) + snapshotExt); err == nil {
+				seqs = append(seqs, snap.Position.WAL.Seq)
+			}
+		}
+		return seqs
+	}
+
+	assert.Nil(t, (&snapshotSchedule{}).prune(dir))
+	assert.Equal(t, []uint64{4, 3, 2, 1}, seqs())
+	assert.Nil(t, (&snapshotSchedule{keep: 2}).prune(dir))
+	assert.Equal(t, []uint64{4, 3}, seqs())
+	_, err := os.Stat(dir + torn)
+	assert.Nil(t, err)
+	assert.Nil(t, (&snapshotSchedule{keep: 2}).prune(kernelSnapshotPath+"missing"))
+}
+
+func Test_MatchingEngine_PeriodicSnapshots(t *testing.T) {
+	setTestWAL(t, 2)
+	setTestSnapshots(t)
+	setTestSnapshotPolicy(t, 0, 2, 2)
+	SetWALRetention(true)
+	const desc = "test_engine_periodic"
+	engine := NewMatchingEngine(1, desc)
+	engine.EnablePeriodicSnapshots()
+	engine.Start()
+	for i := int64(0); i < 7; i++ {
+		engine.SubmitOrder(newTestBidOrder(100+i, 1))
+	}
+	// a snapshot is taken once two records were written since the previous one, records written meanwhile
+	// wait for it
+	newest := func() uint64 {
+		snap, _, err := latestSnapshot(kernelSnapshotPath + desc)
+		if err != nil || snap == nil {
+			return 0
+		}
+		return snap.Position.WAL.Seq
+	}
+	assert.Eventually(t, func() bool { return newest() >= 6 }, time.Second, time.Millisecond)
+	assert.Nil(t, engine.Shutdown(t.Context()))
+	names, err := snapshotNames(kernelSnapshotPath + desc)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(names))
+	assert.LessOrEqual(t, uint64(6), newest())
+	assert.LessOrEqual(t, uint64(4), engine.s.wal.manifest.SnapshotSeq)
+
+	// nothing is taken while no record is written
+	setTestSnapshotPolicy(t, 5*time.Millisecond, 0, 0)
+	idle := NewMatchingEngine(1, "test_engine_periodic_idle")
+	idle.EnablePeriodicSnapshots()
+	idle.Start()
+	idle.SubmitOrder(newTestBidOrder(100, 1))
+	assert.Eventually(t, func() bool {
+		names, _ := snapshotNames(kernelSnapshotPath + "test_engine_periodic_idle")
+		return len(names) == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	names, err = snapshotNames(kernelSnapshotPath + "test_engine_periodic_idle")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(names))
+	idle.Stop()
+}
+
+func Test_Exchange_PeriodicSnapshots(t *testing.T) {
+	setTestWAL(t, 0)
+	setTestSnapshots(t)
+	setTestSnapshotPolicy(t, 5*time.Millisecond, 0, 0)
+	const desc = "test_exchange_periodic"
+	x, err := NewExchange(1, desc, newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	x.EnablePeriodicSnapshots()
+	x.Start()
+	snapshots := func(symbol string) int {
+		names, _ := snapshotNames(kernelSnapshotPath + desc + "_" + symbol)
+		return len(names)
+	}
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(100, 1)))
+	assert.Eventually(t, func() bool { return snapshots("BBB") == 1 }, time.Second, time.Millisecond)
+
+	// the orders of the other book go on in the shared WAL, this one is unchanged
+	for i := int64(0); i < 6; i++ {
+		assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(100+i, 1)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return snapshots("AAA") > 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, 1, snapshots("BBB"))
+	x.Stop()
+}
+
+func Test_MatchingEngine_PeriodicSnapshotsWithoutWAL(t *testing.T) {
+	setTestSnapshots(t)
+	setTestSnapshotPolicy(t, 0, 2, 0)
+	originalSave := saveOrderLog
+	SetSaveOrderLog(false)
+	t.Cleanup(func() { SetSaveOrderLog(originalSave) })
+	const desc = "test_engine_periodic_no_wal"
+	engine := NewMatchingEngine(1, desc)
+	engine.EnablePeriodicSnapshots()
+	engine.Start()
+
+	// the records are counted though none is written
+	for i := int64(0); i < 4; i++ {
+		engine.SubmitOrder(newTestBidOrder(100+i, 1))
+	}
+	assert.Eventually(t, func() bool {
+		snap, _, err := latestSnapshot(kernelSnapshotPath + desc)
+		return err == nil && snap != nil && len(snap.Bids) == 4
+	}, time.Second, time.Millisecond)
+	engine.Stop()
+}
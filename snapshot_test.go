@@ -0,0 +1,204 @@
+package ker
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+func Test_takeSnapshot_RoundTrip(t *testing.T) {
+	setTestSnapshots(t)
+	k := newKernel()
+	first := newTestAskOrder(101, 5)
+	k.insertUnmatchedOrder(first)
+	k.insertUnmatchedOrder(newTestAskOrder(101, 7))
+	k.insertUnmatchedOrder(newTestAskOrder(103, 1))
+	k.insertUnmatchedOrder(newTestBidOrder(99, 2))
+	pos := snapshotPosition{
+		WAL: walPosition{Seq: 42, File: "test_round_trip_1_40.log", Offset: 96},
+		IDs: idGenerator{Seed: 7, Drawn: 4},
+	}
+	last := newTestBidOrder(99, 2)
+	assert.Nil(t, k.takeSnapshot("round_trip", last, pos))
+
+	// no temporary file is left behind
+	entries, err := os.ReadDir(kernelSnapshotPath + "round_trip")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	snap, path, err := latestSnapshot(kernelSnapshotPath + "round_trip")
+	assert.Nil(t, err)
+	assert.Equal(t, kernelSnapshotPath+"round_trip/"+entries[0].Name(), path)
+	assert.Equal(t, strconv.FormatInt(snap.Created, 10)+snapshotExt, entries[0].Name())
+	assert.Equal(t, "round_trip", snap.Description)
+	assert.Equal(t, pos, snap.Position)
+	assert.Equal(t, *last, snap.LastOrder)
+	assert.Equal(t, []int64{101, 103}, []int64{snap.Asks[0].Price, snap.Asks[1].Price})
+	assert.Equal(t, 2, len(snap.Asks[0].Orders))
+	assert.Equal(t, first.KernelOrderID, snap.Asks[0].Orders[0].KernelOrderID)
+
+	restored, ok := restoreKernel(path)
+	assert.True(t, ok)
+	assert.Equal(t, int64(101), restored.ask1Price)
+	assert.Equal(t, int64(99), restored.bid1Price)
+	assert.Equal(t, int64(-12), restored.ask.Front().value.(*priceBucket).Left)
+	assert.Equal(t, 2, restored.ask.Length)
+}
+
+func Test_latestSnapshot(t *testing.T) {
+	setTestSnapshots(t)
+	dir := kernelSnapshotPath + "latest/"
+	snap, path, err := latestSnapshot(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, snap)
+	assert.Empty(t, path)
+
+	k := newKernel()
+	assert.Nil(t, k.takeSnapshot("latest", nil, snapshotPosition{WAL: walPosition{Seq: 1}}))
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, k.takeSnapshot("latest", nil, snapshotPosition{WAL: walPosition{Seq: 2}}))
+	snap, _, err = latestSnapshot(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), snap.Position.WAL.Seq)
+
+	// newer files failing their checks and files that aren't snapshots are skipped
+	newer := strconv.FormatInt(time.Now().Add(time.Hour).UnixNano(), 10)
+	assert.Nil(t, os.WriteFile(dir+newer+snapshotExt, []byte("GMKS"), 0644))
+	assert.Nil(t, os.WriteFile(dir+newer+snapshotExt+".tmp", nil, 0644))
+	assert.Nil(t, os.WriteFile(dir+"finished.log", nil, 0644))
+	snap, _, err = latestSnapshot(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), snap.Position.WAL.Seq)
+}
+
+func Test_MatchingEngine_RecoverIDs(t *testing.T) {
+	setTestWAL(t, 0)
+	setTestSnapshots(t)
+	const desc = "test_engine_recover_ids"
+	engine := NewMatchingEngine(1, desc)
+	engine.Start()
+	// the orders rest on the bid side, their IDs are collected from the book
+	ids := make(map[uint64]bool)
+	collect := func(e *MatchingEngine, n int) {
+		assert.Eventually(t, func() bool { return e.BidLength() == n }, time.Second, time.Millisecond)
+		e.s.kernel.Pause()
+		for bucket := e.s.kernel.bid.Front(); bucket != nil; bucket = bucket.Next() {
+			for o := bucket.value.(*priceBucket).l.Front(); o != nil; o = o.Next() {
+				ids[o.Value.(*types.KernelOrder).KernelOrderID] = true
+			}
+		}
+		e.s.kernel.Resume()
+	}
+	engine.SubmitOrder(newTestBidOrder(100, 1))
+	engine.SubmitOrder(newTestBidOrder(101, 1))
+	collect(engine, 2)
+	assert.Nil(t, engine.Snapshot())
+	engine.SubmitOrder(newTestBidOrder(102, 1))
+	collect(engine, 3)
+	crashTestEngine(t, engine)
+
+	// the generator is restored from the snapshot and advanced by the replayed order
+	recovered := NewMatchingEngine(1, desc)
+	assert.Nil(t, recovered.Recover(kernelSnapshotPath+desc))
+	assert.Equal(t, engine.s.ids, recovered.s.ids)
+	recovered.Start()
+	recovered.SubmitOrder(newTestBidOrder(103, 1))
+	recovered.SubmitOrder(newTestBidOrder(1, 1))
+	collect(recovered, 5)
+	assert.Equal(t, 5, len(ids))
+	recovered.Stop()
+}
+
+func Test_kernel_capture(t *testing.T) {
+	setTestSnapshots(t)
+	k := newKernel()
+	k.startDummyMatchedInfoChan()
+	ask := newTestAskOrder(100, 10)
+	k.placeOrder(ask)
+	snap, err := k.capture("capture", ask, snapshotPosition{WAL: walPosition{Seq: 1}}, 0)
+	assert.Nil(t, err)
+
+	// trading goes on while the copy is written
+	k.placeOrder(newTestBidOrder(100, 4))
+	k.placeOrder(newTestAskOrder(99, 1))
+	assert.Nil(t, writeSnapshot(snap))
+	_, path, err := latestSnapshot(kernelSnapshotPath + "capture")
+	assert.Nil(t, err)
+	restored, ok := restoreKernel(path)
+	assert.True(t, ok)
+	assert.Equal(t, 1, restored.ask.Length)
+	assert.Equal(t, int64(100), restored.ask1Price)
+	assert.Equal(t, int64(-10), restored.ask.Front().value.(*priceBucket).Left)
+	assert.Equal(t, int64(-6), ask.Left)
+}
+
+func Test_kernel_captureLedger(t *testing.T) {
+	setTestSnapshots(t)
+	k := newKernel()
+	k.ledger = newLedger()
+	k.positions = newPositionBook()
+	k.ledger.credit(1, "USD", 100)
+	k.positions.apply(positionFill{account: 1, size: 2, price: 100})
+	snap, err := k.capture("capture_ledger", nil, snapshotPosition{}, 0)
+	assert.Nil(t, err)
+	// the ledger and positions are copied, their encoding is left to the writer
+	assert.Nil(t, snap.Ledger)
+	assert.Nil(t, snap.Positions)
+
+	k.ledger.credit(1, "USD", 50)
+	k.positions.apply(positionFill{account: 1, size: 3, price: 101})
+	assert.Nil(t, writeSnapshot(snap))
+	_, path, err := latestSnapshot(kernelSnapshotPath + "capture_ledger")
+	assert.Nil(t, err)
+	restored, ok := restoreKernel(path)
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), restored.ledger.get(1, "USD").Available)
+	assert.Equal(t, int64(2), restored.positions.get(1).Size)
+	assert.Equal(t, int64(100), restored.positions.last)
+}
+
+func Test_MatchingEngine_Snapshot(t *testing.T) {
+	setTestDurability(t, WAL_GROUP_COMMIT, 64, time.Hour)
+	setTestSnapshots(t)
+	const desc = "test_engine_snapshot"
+	engine := NewMatchingEngine(1, desc)
+	assert.ErrorIs(t, engine.Snapshot(), ErrStopped)
+	engine.Start()
+
+	// the pending group is committed first, the snapshot covers the order it holds
+	engine.SubmitOrder(newTestBidOrder(100, 1))
+	assert.Eventually(t, func() bool { return engine.s.wal.seq == 1 }, time.Second, time.Millisecond)
+	assert.Nil(t, engine.Snapshot())
+	snap, _, err := latestSnapshot(kernelSnapshotPath + desc)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), snap.Position.WAL.Seq)
+	assert.Equal(t, uint64(1), snap.Position.IDs.Drawn)
+	assert.Equal(t, 1, len(snap.Bids))
+	assert.Equal(t, snap.Bids[0].Orders[0], snap.LastOrder)
+
+	assert.Nil(t, engine.Shutdown(t.Context()))
+	assert.ErrorIs(t, engine.Snapshot(), ErrStopped)
+}
+
+// BenchmarkSnapshotCapture measures the time the order flow waits for a snapshot, by number of resting orders.
+func BenchmarkSnapshotCapture(b *testing.B) {
+	for _, n := range []int64{100, 1000, 10000} {
+		b.Run(strconv.FormatInt(n, 10), func(b *testing.B) {
+			k := newKernel()
+			for i := int64(0); i < n/2; i++ {
+				k.insertUnmatchedOrder(newTestAskOrder(1001+i%500, 1))
+				k.insertUnmatchedOrder(newTestBidOrder(1000-i%500, 1))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := k.capture("bench", nil, snapshotPosition{}, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
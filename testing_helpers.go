@@ -58,6 +58,38 @@ func drainMatchedInfoChan(acceptor *scheduler) {
 	}()
 }
 
+// collectMatchedInfo buffers the match results of an acceptor, so that a test can read them in order
+func collectMatchedInfo(acceptor *scheduler) chan *matchedInfo {
+	events := make(chan *matchedInfo, 64)
+	go func() {
+		for {
+			select {
+			case mi := <-acceptor.kernel.matchedInfoChan:
+				events <- mi
+			case <-acceptor.kernel.ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// nextMatchedInfo returns the next match result of events selected by match, the others are skipped.
+// t is the *testing.T of the test, the package only imports testing in its tests.
+func nextMatchedInfo(t interface{ Fatal(args ...any) }, events chan *matchedInfo, match func(*matchedInfo) bool) *matchedInfo {
+	for {
+		select {
+		case mi := <-events:
+			if match(mi) {
+				return mi
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected a match result")
+			return nil
+		}
+	}
+}
+
 func generateTestOrders(count int, priceRange, amountRange int64, asAsk bool) []*types.KernelOrder {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	orders := make([]*types.KernelOrder, count)
@@ -0,0 +1,195 @@
+package types
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidDecimal is returned for a string that is not a plain decimal number
+	ErrInvalidDecimal = errors.New("invalid decimal")
+	// ErrDecimalRange is returned for a decimal whose fixed-point value doesn't fit in an int64
+	ErrDecimalRange = errors.New("decimal out of range")
+	// ErrInexactDecimal is returned by ROUND_EXACT for a decimal with more digits than the scale
+	ErrInexactDecimal = errors.New("inexact decimal")
+	// ErrDecimalScale is returned for a scale that is not a power of ten
+	ErrDecimalScale = errors.New("decimal scale must be a power of ten")
+)
+
+// Rounding is how a decimal with more fractional digits than its scale is rounded.
+type Rounding uint8
+
+const (
+	ROUND_EXACT     Rounding = iota /* no rounding, extra non-zero digits are an error */
+	ROUND_DOWN                      /* toward zero */
+	ROUND_UP                        /* away from zero */
+	ROUND_HALF_UP                   /* to the nearest, ties away from zero */
+	ROUND_HALF_EVEN                 /* to the nearest, ties to the even value */
+	ROUND_FLOOR                     /* toward negative infinity */
+	ROUND_CEIL                      /* toward positive infinity */
+)
+
+// Decimals returns the number of fractional digits of a scale, ok is false if it is not a power of ten.
+func Decimals(scale int64) (int, bool) {
+	d := 0
+	p := int64(1)
+	for p < scale && p <= math.MaxInt64/10 {
+		p *= 10
+		d++
+	}
+	return d, p == scale
+}
+
+// ParseDecimal converts a decimal string like "-123.45" to a fixed-point integer with scale raw units
+// per 1, e.g. 123_450_000_000 with scale ONE. Exponents, spaces and separators are not accepted.
+// Digits beyond the scale are rounded with mode, the conversion is exact otherwise.
+func ParseDecimal(s string, scale int64, mode Rounding) (int64, error) {
+	decimals, ok := Decimals(scale)
+	if !ok {
+		return 0, ErrDecimalScale
+	}
+	negative := false
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if intPart == "" && fracPart == "" {
+		return 0, ErrInvalidDecimal
+	}
+	limit := uint64(math.MaxInt64)
+	if negative {
+		limit++
+	}
+	// the magnitude in raw units, then the digits rounded off
+	var m uint64
+	for i := 0; i < len(intPart)+decimals; i++ {
+		var c byte = '0'
+		if i < len(intPart) {
+			c = intPart[i]
+		} else if j := i - len(intPart); j < len(fracPart) {
+			c = fracPart[j]
+		}
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidDecimal
+		}
+		digit := uint64(c - '0')
+		if m > (limit-digit)/10 {
+			return 0, ErrDecimalRange
+		}
+		m = m*10 + digit
+	}
+	var first byte = '0'
+	sticky := false // a non-zero digit after the first rounded off
+	if len(fracPart) > decimals {
+		for i, c := range []byte(fracPart[decimals:]) {
+			if c < '0' || c > '9' {
+				return 0, ErrInvalidDecimal
+			}
+			if i == 0 {
+				first = c
+			} else if c != '0' {
+				sticky = true
+			}
+		}
+	}
+	if first != '0' || sticky {
+		var up bool
+		switch mode {
+		case ROUND_EXACT:
+			return 0, ErrInexactDecimal
+		case ROUND_DOWN:
+		case ROUND_UP:
+			up = true
+		case ROUND_HALF_UP:
+			up = first >= '5'
+		case ROUND_HALF_EVEN:
+			up = first > '5' || (first == '5' && (sticky || m%2 == 1))
+		case ROUND_FLOOR:
+			up = negative
+		case ROUND_CEIL:
+			up = !negative
+		default:
+			return 0, errors.New("unknown rounding mode " + strconv.Itoa(int(mode)))
+		}
+		if up {
+			if m == limit {
+				return 0, ErrDecimalRange
+			}
+			m++
+		}
+	}
+	if negative {
+		return int64(-m), nil
+	}
+	return int64(m), nil
+}
+
+// FormatDecimal converts a fixed-point integer with scale raw units per 1 to its shortest exact decimal
+// string, e.g. "123.45" for 123_450_000_000 with scale ONE. It panics if scale is not a power of ten.
+func FormatDecimal(v, scale int64) string {
+	decimals, ok := Decimals(scale)
+	if !ok {
+		panic(ErrDecimalScale)
+	}
+	m := abs64(v)
+	var b strings.Builder
+	if v < 0 {
+		b.WriteByte('-')
+	}
+	b.WriteString(strconv.FormatUint(m/uint64(scale), 10))
+	if frac := m % uint64(scale); frac != 0 {
+		digits := strconv.FormatUint(frac, 10)
+		b.WriteByte('.')
+		b.WriteString(strings.Repeat("0", decimals-len(digits)))
+		b.WriteString(strings.TrimRight(digits, "0"))
+	}
+	return b.String()
+}
+
+// Decimal is a fixed-point value that marshals to JSON as an exact decimal string, e.g. "123.45",
+// so that clients never see it as a float64.
+type Decimal struct {
+	// Value in raw units
+	Value int64
+	// Raw units representing 1, 0 means ONE
+	Scale int64
+}
+
+func (d Decimal) scale() int64 {
+	if d.Scale == 0 {
+		return ONE
+	}
+	return d.Scale
+}
+
+func (d Decimal) String() string {
+	return FormatDecimal(d.Value, d.scale())
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if _, ok := Decimals(d.scale()); !ok {
+		return nil, ErrDecimalScale
+	}
+	return []byte(`"` + d.String() + `"`), nil
+}
+
+// UnmarshalJSON accepts a decimal string or a JSON number without exponent, at the scale already set
+// in d. Digits beyond the scale are an error.
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	v, err := ParseDecimal(s, d.scale(), ROUND_EXACT)
+	if err != nil {
+		return err
+	}
+	d.Value = v
+	return nil
+}
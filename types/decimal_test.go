@@ -0,0 +1,132 @@
+package types
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDecimal(t *testing.T) {
+	cases := []struct {
+		s     string
+		scale int64
+		mode  Rounding
+		v     int64
+		err   error
+	}{
+		{"123.45", ONE, ROUND_EXACT, 123_450_000_000, nil},
+		{"-123.45", ONE, ROUND_EXACT, -123_450_000_000, nil},
+		{"+0.000000001", ONE, ROUND_EXACT, 1, nil},
+		{".5", 10, ROUND_EXACT, 5, nil},
+		{"7.", 10, ROUND_EXACT, 70, nil},
+		{"-0", ONE, ROUND_EXACT, 0, nil},
+		{"42", 1, ROUND_EXACT, 42, nil},
+		{"1.2300", 100, ROUND_EXACT, 123, nil},
+		{"9223372036.854775807", ONE, ROUND_EXACT, math.MaxInt64, nil},
+		{"-9223372036.854775808", ONE, ROUND_EXACT, math.MinInt64, nil},
+		{"9223372036.854775808", ONE, ROUND_EXACT, 0, ErrDecimalRange},
+		{"99999999999999999999", 1, ROUND_EXACT, 0, ErrDecimalRange},
+		{"9223372036.8547758071", ONE, ROUND_UP, 0, ErrDecimalRange},
+		{"1.005", 100, ROUND_EXACT, 0, ErrInexactDecimal},
+		{"1.001", 100, ROUND_DOWN, 100, nil},
+		{"-1.001", 100, ROUND_DOWN, -100, nil},
+		{"1.001", 100, ROUND_UP, 101, nil},
+		{"-1.001", 100, ROUND_UP, -101, nil},
+		{"1.005", 100, ROUND_HALF_UP, 101, nil},
+		{"1.0049", 100, ROUND_HALF_UP, 100, nil},
+		{"-1.005", 100, ROUND_HALF_UP, -101, nil},
+		{"1.005", 100, ROUND_HALF_EVEN, 100, nil},
+		{"1.015", 100, ROUND_HALF_EVEN, 102, nil},
+		{"1.00501", 100, ROUND_HALF_EVEN, 101, nil},
+		{"1.001", 100, ROUND_FLOOR, 100, nil},
+		{"-1.001", 100, ROUND_FLOOR, -101, nil},
+		{"1.001", 100, ROUND_CEIL, 101, nil},
+		{"-1.001", 100, ROUND_CEIL, -100, nil},
+		{"1.0000", 100, ROUND_EXACT, 100, nil},
+		{"", ONE, ROUND_EXACT, 0, ErrInvalidDecimal},
+		{"-", ONE, ROUND_EXACT, 0, ErrInvalidDecimal},
+		{".", ONE, ROUND_EXACT, 0, ErrInvalidDecimal},
+		{"1e3", ONE, ROUND_EXACT, 0, ErrInvalidDecimal},
+		{"1.2.3", ONE, ROUND_EXACT, 0, ErrInvalidDecimal},
+		{"1.0x", 1, ROUND_DOWN, 0, ErrInvalidDecimal},
+		{" 1", ONE, ROUND_EXACT, 0, ErrInvalidDecimal},
+		{"1", 3, ROUND_EXACT, 0, ErrDecimalScale},
+		{"1", 0, ROUND_EXACT, 0, ErrDecimalScale},
+	}
+	for _, c := range cases {
+		v, err := ParseDecimal(c.s, c.scale, c.mode)
+		assert.Equal(t, c.err, err, "%q", c.s)
+		assert.Equal(t, c.v, v, "%q", c.s)
+	}
+	_, err := ParseDecimal("1.5", 1, Rounding(99))
+	assert.NotNil(t, err)
+}
+
+func TestFormatDecimal(t *testing.T) {
+	assert.Equal(t, "123.45", FormatDecimal(123_450_000_000, ONE))
+	assert.Equal(t, "-0.000000001", FormatDecimal(-1, ONE))
+	assert.Equal(t, "100", FormatDecimal(100*ONE, ONE))
+	assert.Equal(t, "0", FormatDecimal(0, ONE))
+	assert.Equal(t, "42", FormatDecimal(42, 1))
+	assert.Equal(t, "0.05", FormatDecimal(5, 100))
+	assert.Equal(t, "-9223372036.854775808", FormatDecimal(math.MinInt64, ONE))
+	assert.Equal(t, "9.223372036854775807", FormatDecimal(math.MaxInt64, 1e18))
+	assert.Panics(t, func() { FormatDecimal(1, 3) })
+}
+
+func TestDecimal_RoundTrip(t *testing.T) {
+	for _, scale := range []int64{1, 10, 1000, ONE, 1e18} {
+		check := func(v int64) bool {
+			parsed, err := ParseDecimal(FormatDecimal(v, scale), scale, ROUND_EXACT)
+			return err == nil && parsed == v
+		}
+		assert.Nil(t, quick.Check(check, &quick.Config{MaxCount: 20000}), "scale %d", scale)
+	}
+}
+
+func TestDecimal_JSON(t *testing.T) {
+	type quote struct {
+		Price Decimal  `json:"price"`
+		Size  Decimal  `json:"size"`
+		Last  *Decimal `json:"last,omitempty"`
+	}
+	q := quote{Price: Decimal{Value: 123_450_000_000}, Size: Decimal{Value: 15, Scale: 1000}}
+	b, err := json.Marshal(q)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"price":"123.45","size":"0.015"}`, string(b))
+
+	// the scale is set before unmarshalling, numbers are read without float64 conversion
+	got := quote{Size: Decimal{Scale: 1000}}
+	assert.Nil(t, json.Unmarshal([]byte(`{"price":0.1,"size":"0.015","last":null}`), &got))
+	assert.Equal(t, Decimal{Value: ONE / 10}, got.Price)
+	assert.Equal(t, Decimal{Value: 15, Scale: 1000}, got.Size)
+	assert.Nil(t, got.Last)
+
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"size":"0.0155"}`), &got), ErrInexactDecimal)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"price":1e3}`), &got), ErrInvalidDecimal)
+	_, err = json.Marshal(Decimal{Value: 1, Scale: 3})
+	assert.ErrorIs(t, err, ErrDecimalScale)
+}
+
+func TestInstrument_Decimals(t *testing.T) {
+	ins := &Instrument{Symbol: "BTC_USDT", TickSize: ONE / 100, LotSize: 1000, QtyScale: 1e8}
+	assert.Nil(t, ins.Validate())
+	price, err := ins.ParsePrice("27000.5")
+	assert.Nil(t, err)
+	assert.Equal(t, 27000*ONE+ONE/2, price)
+	qty, err := ins.ParseQty("0.00001")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), qty)
+	_, err = ins.ParseQty("0.000000001")
+	assert.Equal(t, ErrInexactDecimal, err)
+	assert.Equal(t, "27000.5", ins.Price(price).String())
+	assert.Equal(t, "0.00001", ins.Qty(qty).String())
+
+	// before Validate the scales still default
+	raw := &Instrument{Symbol: "A"}
+	assert.Equal(t, "0.5", raw.Price(ONE/2).String())
+	assert.Equal(t, "3", raw.Qty(3).String())
+}
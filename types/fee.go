@@ -0,0 +1,77 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// FeeTier holds fee rates as fixed-point fractions of the notional, ONE is 100%.
+// A negative maker rate is a rebate paid to the maker.
+type FeeTier struct {
+	Maker int64 `json:"maker"`
+	Taker int64 `json:"taker"`
+}
+
+// FeeSchedule is the fee schedule of one instrument.
+type FeeSchedule struct {
+	// Currency the fees are charged in, attached to every fill
+	Currency string `json:"currency"`
+	// Tier 0 applies to accounts without a tier
+	Tiers []FeeTier `json:"tiers"`
+	// Tier index of an account
+	Accounts map[uint64]int `json:"accounts,omitempty"`
+}
+
+// Validate checks that the schedule is usable. Rates are within [-ONE, ONE] and the largest maker rebate
+// never exceeds the smallest taker fee, as a trade pairs the tier of the maker with the tier of the taker,
+// so that a trade never costs the exchange money.
+func (fs *FeeSchedule) Validate() error {
+	if len(fs.Tiers) == 0 {
+		return errors.New("fee schedule: no tier")
+	}
+	minMaker, minTaker := int64(ONE), int64(ONE)
+	for i, tier := range fs.Tiers {
+		if tier.Taker < 0 || tier.Taker > ONE || tier.Maker < -ONE || tier.Maker > ONE {
+			return fmt.Errorf("fee schedule: tier %d rate out of range", i)
+		}
+		minMaker, minTaker = min(minMaker, tier.Maker), min(minTaker, tier.Taker)
+	}
+	if minMaker+minTaker < 0 {
+		return errors.New("fee schedule: a maker rebate exceeds a taker fee")
+	}
+	for account, tier := range fs.Accounts {
+		if tier < 0 || tier >= len(fs.Tiers) {
+			return fmt.Errorf("fee schedule: account %d has unknown tier %d", account, tier)
+		}
+	}
+	return nil
+}
+
+// Tier returns the fee tier of an account.
+func (fs *FeeSchedule) Tier(account uint64) FeeTier {
+	return fs.Tiers[fs.Accounts[account]]
+}
+
+// Fee returns notional * rate / ONE in the units of notional, rate must be within [-ONE, ONE].
+// Fees are rounded up and rebates towards zero, the product is computed in 128 bits so that it never overflows.
+func Fee(notional, rate int64) int64 {
+	negative := (notional < 0) != (rate < 0)
+	hi, lo := bits.Mul64(abs64(notional), abs64(rate))
+	// |rate| <= ONE, so the quotient fits in 64 bits
+	q, r := bits.Div64(hi, lo, uint64(ONE))
+	if negative {
+		return -int64(q)
+	}
+	if r != 0 {
+		q++
+	}
+	return int64(q)
+}
+
+func abs64(v int64) uint64 {
+	if v < 0 {
+		return uint64(-v)
+	}
+	return uint64(v)
+}
@@ -0,0 +1,42 @@
+package types
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeSchedule_Validate(t *testing.T) {
+	fs := &FeeSchedule{
+		Currency: "USDT",
+		Tiers:    []FeeTier{{Maker: ONE / 1000, Taker: ONE / 500}, {Maker: -ONE / 10000, Taker: ONE / 1000}},
+		Accounts: map[uint64]int{7: 1},
+	}
+	assert.Nil(t, fs.Validate())
+	assert.Equal(t, fs.Tiers[1], fs.Tier(7))
+	assert.Equal(t, fs.Tiers[0], fs.Tier(8))
+
+	invalid := []*FeeSchedule{
+		{},
+		{Tiers: []FeeTier{{Taker: -1}}},
+		{Tiers: []FeeTier{{Taker: ONE + 1}}},
+		{Tiers: []FeeTier{{Maker: -2, Taker: 1}}},
+		// the rebate of tier 1 makers exceeds the fee of tier 0 takers
+		{Tiers: []FeeTier{{Maker: ONE / 10000, Taker: ONE / 10000}, {Maker: -ONE / 2000, Taker: ONE / 1000}}},
+		{Tiers: []FeeTier{{}}, Accounts: map[uint64]int{1: 1}},
+	}
+	for _, fs := range invalid {
+		assert.NotNil(t, fs.Validate(), "%+v", fs)
+	}
+}
+
+func TestFee(t *testing.T) {
+	assert.Equal(t, int64(20), Fee(10000, ONE/500))
+	// fees are rounded up, rebates towards zero
+	assert.Equal(t, int64(3), Fee(1005, ONE/500))
+	assert.Equal(t, int64(-1), Fee(19999, -ONE/10000))
+	assert.Equal(t, int64(0), Fee(10000, 0))
+	assert.Equal(t, int64(math.MaxInt64), Fee(math.MaxInt64, ONE))
+	assert.Equal(t, int64(math.MaxInt64/1000+1), Fee(math.MaxInt64, ONE/1000))
+}
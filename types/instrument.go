@@ -0,0 +1,155 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+)
+
+// Instrument is the reference data of a tradable symbol.
+// Prices and notionals are fixed-point integers with PriceScale units per 1 quote currency,
+// sizes are fixed-point integers with QtyScale units per 1 base currency.
+type Instrument struct {
+	// Instrument symbol, e.g. "BTC_USDT"
+	Symbol string `json:"symbol"`
+	// Raw price units representing 1, defaults to ONE
+	PriceScale int64 `json:"price_scale,omitempty"`
+	// Raw size units representing 1, defaults to 1. Notionals are size * price / QtyScale
+	QtyScale int64 `json:"qty_scale,omitempty"`
+	// Minimum price increment, in raw price units
+	TickSize int64 `json:"tick_size"`
+	// Minimum size increment
+	LotSize int64 `json:"lot_size"`
+	// Minimum order size, 0 means one lot is enough
+	MinQty int64 `json:"min_qty,omitempty"`
+	// Maximum order size, 0 means unlimited
+	MaxQty int64 `json:"max_qty,omitempty"`
+	// Minimum size * price, in the same units as KernelOrder.FilledTotal, 0 means unlimited
+	MinNotional int64 `json:"min_notional,omitempty"`
+	// Assets traded, needed by the account ledger only
+	BaseAsset  string `json:"base_asset,omitempty"`
+	QuoteAsset string `json:"quote_asset,omitempty"`
+}
+
+// Validate checks that the instrument definition itself is usable, filling in defaults.
+func (ins *Instrument) Validate() error {
+	if ins.Symbol == "" {
+		return errors.New("instrument: empty symbol")
+	}
+	if ins.PriceScale == 0 {
+		ins.PriceScale = ONE
+	}
+	if ins.PriceScale < 0 {
+		return fmt.Errorf("instrument %s: price_scale must be positive", ins.Symbol)
+	}
+	if ins.QtyScale == 0 {
+		ins.QtyScale = 1
+	}
+	if ins.QtyScale < 0 {
+		return fmt.Errorf("instrument %s: qty_scale must be positive", ins.Symbol)
+	}
+	if ins.TickSize <= 0 {
+		return fmt.Errorf("instrument %s: tick_size must be positive", ins.Symbol)
+	}
+	if ins.LotSize <= 0 {
+		return fmt.Errorf("instrument %s: lot_size must be positive", ins.Symbol)
+	}
+	// every fill is then worth a whole number of raw units, so notionals are exact
+	hi, lo := bits.Mul64(uint64(ins.LotSize), uint64(ins.TickSize))
+	if bits.Rem64(hi, lo, uint64(ins.QtyScale)) != 0 {
+		return fmt.Errorf("instrument %s: lot_size * tick_size must be a multiple of qty_scale", ins.Symbol)
+	}
+	if ins.MinQty < 0 || ins.MaxQty < 0 || ins.MinNotional < 0 {
+		return fmt.Errorf("instrument %s: limits must not be negative", ins.Symbol)
+	}
+	if ins.MaxQty != 0 && ins.MaxQty < ins.MinQty {
+		return fmt.Errorf("instrument %s: max_qty is below min_qty", ins.Symbol)
+	}
+	return nil
+}
+
+// CheckOrder validates price and size of a new order against the instrument.
+// Cancel requests (Amount == 0) are not checked.
+func (ins *Instrument) CheckOrder(order *KernelOrder) RejectReason {
+	if order.Amount == 0 {
+		return REJECT_NONE
+	}
+	// market orders have no price
+	market := order.Type == MARKET
+	if !market && order.Price <= 0 {
+		return REJECT_INVALID_PRICE
+	}
+	if !market && order.Price%ins.TickSize != 0 {
+		return REJECT_OFF_TICK
+	}
+	size := order.Amount
+	if size < 0 {
+		size = -size
+	}
+	if size%ins.LotSize != 0 {
+		return REJECT_OFF_LOT
+	}
+	if size < ins.MinQty {
+		return REJECT_QTY_TOO_SMALL
+	}
+	if ins.MaxQty != 0 && size > ins.MaxQty {
+		return REJECT_QTY_TOO_LARGE
+	}
+	if !market && ins.MinNotional != 0 {
+		if notional, _ := Notional(size, order.Price, ins.QtyScale); notional < ins.MinNotional {
+			return REJECT_NOTIONAL_TOO_SMALL
+		}
+	}
+	return REJECT_NONE
+}
+
+// LoadInstruments reads a JSON array of instruments from a file, keyed by symbol.
+func LoadInstruments(path string) (map[string]*Instrument, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Instrument
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("instrument file %s: %w", path, err)
+	}
+	instruments := make(map[string]*Instrument, len(list))
+	for _, ins := range list {
+		if err := ins.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := instruments[ins.Symbol]; ok {
+			return nil, fmt.Errorf("instrument %s: duplicated symbol", ins.Symbol)
+		}
+		instruments[ins.Symbol] = ins
+	}
+	return instruments, nil
+}
+
+// ParsePrice converts a decimal price like "123.45" to raw price units, digits beyond PriceScale are an error.
+func (ins *Instrument) ParsePrice(s string) (int64, error) {
+	return ParseDecimal(s, ins.Price(0).Scale, ROUND_EXACT)
+}
+
+// ParseQty converts a decimal size like "0.015" to raw size units, digits beyond QtyScale are an error.
+func (ins *Instrument) ParseQty(s string) (int64, error) {
+	return ParseDecimal(s, ins.Qty(0).Scale, ROUND_EXACT)
+}
+
+// Price returns a raw price as a Decimal at the price scale of the instrument.
+func (ins *Instrument) Price(v int64) Decimal {
+	if ins.PriceScale == 0 {
+		return Decimal{Value: v, Scale: ONE}
+	}
+	return Decimal{Value: v, Scale: ins.PriceScale}
+}
+
+// Qty returns a raw size as a Decimal at the quantity scale of the instrument.
+func (ins *Instrument) Qty(v int64) Decimal {
+	if ins.QtyScale == 0 {
+		return Decimal{Value: v, Scale: 1}
+	}
+	return Decimal{Value: v, Scale: ins.QtyScale}
+}
@@ -0,0 +1,113 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testInstrument() *Instrument {
+	return &Instrument{
+		Symbol:      "BTC_USDT",
+		TickSize:    ONE / 100,
+		LotSize:     10,
+		MinQty:      20,
+		MaxQty:      1000,
+		MinNotional: 50 * ONE,
+	}
+}
+
+func TestInstrument_Validate(t *testing.T) {
+	ins := testInstrument()
+	assert.Nil(t, ins.Validate())
+	assert.Equal(t, ONE, ins.PriceScale)
+
+	assert.NotNil(t, (&Instrument{TickSize: 1, LotSize: 1}).Validate())
+	assert.NotNil(t, (&Instrument{Symbol: "A", LotSize: 1}).Validate())
+	assert.NotNil(t, (&Instrument{Symbol: "A", TickSize: 1}).Validate())
+	assert.NotNil(t, (&Instrument{Symbol: "A", TickSize: 1, LotSize: 1, PriceScale: -1}).Validate())
+	assert.NotNil(t, (&Instrument{Symbol: "A", TickSize: 1, LotSize: 1, MinQty: 10, MaxQty: 5}).Validate())
+	assert.NotNil(t, (&Instrument{Symbol: "A", TickSize: 1, LotSize: 1, MinNotional: -1}).Validate())
+}
+
+func TestInstrument_CheckOrder(t *testing.T) {
+	ins := testInstrument()
+	assert.Nil(t, ins.Validate())
+
+	cases := []struct {
+		amount int64
+		price  int64
+		reason RejectReason
+	}{
+		{100, 3 * ONE, REJECT_NONE},
+		{-100, 3 * ONE, REJECT_NONE},
+		{0, 1, REJECT_NONE},
+		{100, 0, REJECT_INVALID_PRICE},
+		{100, -ONE, REJECT_INVALID_PRICE},
+		{100, 3*ONE + 1, REJECT_OFF_TICK},
+		{105, 3 * ONE, REJECT_OFF_LOT},
+		{-105, 3 * ONE, REJECT_OFF_LOT},
+		{10, 30 * ONE, REJECT_QTY_TOO_SMALL},
+		{1010, 3 * ONE, REJECT_QTY_TOO_LARGE},
+		{20, 2 * ONE, REJECT_NOTIONAL_TOO_SMALL},
+		{-20, 2 * ONE, REJECT_NOTIONAL_TOO_SMALL},
+		{20, 3 * ONE, REJECT_NONE},
+	}
+	for _, c := range cases {
+		order := &KernelOrder{Amount: c.amount, Left: c.amount, Price: c.price}
+		assert.Equal(t, c.reason, ins.CheckOrder(order), "amount %d price %d", c.amount, c.price)
+	}
+
+	// market orders have no price, their size is still checked
+	market := &KernelOrder{Amount: 100, Left: 100, Type: MARKET, QuoteBudget: ONE}
+	assert.Equal(t, REJECT_NONE, ins.CheckOrder(market))
+	market.Amount, market.Left = 105, 105
+	assert.Equal(t, REJECT_OFF_LOT, ins.CheckOrder(market))
+}
+
+func TestRejectReason_String(t *testing.T) {
+	assert.Equal(t, "price off tick", REJECT_OFF_TICK.String())
+	assert.Equal(t, "reject reason 200", RejectReason(200).String())
+}
+
+func TestLoadInstruments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "instruments.json")
+	content := `[
+		{"symbol": "BTC_USDT", "tick_size": 10000000, "lot_size": 1, "min_qty": 1, "max_qty": 100},
+		{"symbol": "ETH_USDT", "price_scale": 1000000, "tick_size": 1000, "lot_size": 10, "min_notional": 5000000}
+	]`
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+
+	instruments, err := LoadInstruments(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(instruments))
+	assert.Equal(t, ONE, instruments["BTC_USDT"].PriceScale)
+	assert.Equal(t, int64(100), instruments["BTC_USDT"].MaxQty)
+	assert.Equal(t, int64(1_000_000), instruments["ETH_USDT"].PriceScale)
+	assert.Equal(t, int64(5_000_000), instruments["ETH_USDT"].MinNotional)
+}
+
+func TestLoadInstruments_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := LoadInstruments(filepath.Join(dir, "missing.json"))
+	assert.NotNil(t, err)
+
+	badJson := filepath.Join(dir, "bad.json")
+	assert.Nil(t, os.WriteFile(badJson, []byte(`{"symbol":`), 0644))
+	_, err = LoadInstruments(badJson)
+	assert.NotNil(t, err)
+
+	invalid := filepath.Join(dir, "invalid.json")
+	assert.Nil(t, os.WriteFile(invalid, []byte(`[{"symbol": "A", "tick_size": 0, "lot_size": 1}]`), 0644))
+	_, err = LoadInstruments(invalid)
+	assert.NotNil(t, err)
+
+	dup := filepath.Join(dir, "dup.json")
+	assert.Nil(t, os.WriteFile(dup, []byte(`[{"symbol": "A", "tick_size": 1, "lot_size": 1}, {"symbol": "A", "tick_size": 1, "lot_size": 1}]`), 0644))
+	_, err = LoadInstruments(dup)
+	assert.NotNil(t, err)
+}
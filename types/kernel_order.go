@@ -20,12 +20,31 @@ const (
 	However, it is possible for lack of depth in the order book, causing market orders to execute at a price that is significantly different from the current bid or ask price.
 	*/
 	MARKET
+	/*
+	A transfer is not an order, it is the WAL record of a ledger deposit or withdrawal of AccountID.
+	Amount is the change of the base balance, FilledTotal the change of the quote balance.
+	*/
+	TRANSFER
+)
+
+/*
+Pegged orders have no fixed price, the kernel reprices them whenever the best prices change.
+Their reference ignores other pegged orders, and they never cross the book: a pegged order is always a maker.
+*/
+type PegType uint8
+
+const (
+	NO_PEG       PegType = iota
+	PRIMARY_PEG          /* pegged to the best price of its own side */
+	MARKET_PEG           /* pegged to the best price of the opposite side */
+	MIDPOINT_PEG         /* pegged to the midpoint of the best bid and the best ask */
 )
 
 const (
 	OPEN OrderStatus = iota
 	CLOSED
 	CANCELLED
+	REJECTED
 )
 
 const (
@@ -40,7 +59,7 @@ const (
 	ONE int64 = 1_000_000_000
 )
 
-// 72 bytes
+// 112 bytes
 type KernelOrder struct {
 	// Exchange Kernel KernelOrder ID
 	KernelOrderID uint64 `json:"kernel_order_id,omitempty"`
@@ -56,12 +75,24 @@ type KernelOrder struct {
 	Left int64 `json:"left,omitempty"`
 	// Total filled in quote currency
 	FilledTotal int64 `json:"filled_total,omitempty"`
+	// Maximum FilledTotal of a buy order, 0 means no budget
+	QuoteBudget int64 `json:"quote_budget,omitempty"`
 	// Order ID
 	Id uint64 `json:"id,omitempty"`
+	// Account owning the order
+	AccountID uint64 `json:"account_id,omitempty"`
+	// Gateway session that submitted the order, 0 if none
+	SessionID uint64 `json:"session_id,omitempty"`
+	// Added to the peg reference price of a pegged order
+	PegOffset int64 `json:"peg_offset,omitempty"`
+	// Highest price of a pegged bid, lowest price of a pegged ask, 0 means no limit
+	PegLimit int64 `json:"peg_limit,omitempty"`
 	// KernelOrder status  - `open`: to be filled - `closed`: filled - `cancelled`: cancelled
 	Status OrderStatus `json:"status,omitempty"`
 	// KernelOrder type. limit - limit order
 	Type OrderType `json:"type,omitempty"`
 	// Time in force  - gtc: GoodTillCancelled - ioc: ImmediateOrCancelled, taker only - poc: PendingOrCancelled, reduce only
 	TimeInForce TimeInForce `json:"time_in_force,omitempty"`
+	// Peg type, the kernel computes Price of pegged orders
+	PegType PegType `json:"peg_type,omitempty"`
 }
@@ -9,7 +9,7 @@ import (
 )
 
 func TestKernelOrderSize(t *testing.T) {
-	assert.Equal(t, 72, int(unsafe.Sizeof(KernelOrder{})))
+	assert.Equal(t, 112, int(unsafe.Sizeof(KernelOrder{})))
 }
 
 func TestList(t *testing.T) {
@@ -0,0 +1,36 @@
+package types
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Notional returns size * price / qtyScale, the value of size at price in the units of FilledTotal,
+// rounded toward zero. The product is computed in 128 bits, ok is false when the result doesn't fit
+// in an int64, it is then saturated to math.MaxInt64 or math.MinInt64. qtyScale must be positive.
+func Notional(size, price, qtyScale int64) (int64, bool) {
+	negative := (size < 0) != (price < 0)
+	hi, lo := bits.Mul64(abs64(size), abs64(price))
+	// the quotient fits in 64 bits only if hi < qtyScale
+	if hi >= uint64(qtyScale) {
+		return saturate(negative), false
+	}
+	q, _ := bits.Div64(hi, lo, uint64(qtyScale))
+	if negative {
+		if q > 1<<63 {
+			return math.MinInt64, false
+		}
+		return -int64(q), true
+	}
+	if q > math.MaxInt64 {
+		return math.MaxInt64, false
+	}
+	return int64(q), true
+}
+
+func saturate(negative bool) int64 {
+	if negative {
+		return math.MinInt64
+	}
+	return math.MaxInt64
+}
@@ -0,0 +1,89 @@
+package types
+
+import (
+	"math"
+	"math/big"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bigNotional is the reference: size * price / qtyScale truncated, and whether it fits in an int64
+func bigNotional(size, price, qtyScale int64) (int64, bool) {
+	n := new(big.Int).Mul(big.NewInt(size), big.NewInt(price))
+	n.Quo(n, big.NewInt(qtyScale))
+	if !n.IsInt64() {
+		return 0, false
+	}
+	return n.Int64(), true
+}
+
+func TestNotional_Property(t *testing.T) {
+	check := func(size, price, qtyScale int64) bool {
+		if qtyScale <= 0 {
+			qtyScale = qtyScale/2 + math.MaxInt64/2 + 1
+		}
+		got, ok := Notional(size, price, qtyScale)
+		want, wantOk := bigNotional(size, price, qtyScale)
+		if ok != wantOk {
+			return false
+		}
+		if !ok {
+			return got == saturate((size < 0) != (price < 0))
+		}
+		return got == want
+	}
+	assert.Nil(t, quick.Check(check, &quick.Config{MaxCount: 100000}))
+	// small scales, where the product overflows most
+	for _, scale := range []int64{1, 2, 3, 10, ONE} {
+		scaled := func(size, price int64) bool { return check(size, price, scale) }
+		assert.Nil(t, quick.Check(scaled, &quick.Config{MaxCount: 20000}))
+	}
+}
+
+func TestNotional_Boundaries(t *testing.T) {
+	cases := []struct {
+		size, price, qtyScale int64
+		notional              int64
+		ok                    bool
+	}{
+		{10 * ONE, 1000 * ONE, ONE, 10000 * ONE, true},
+		{math.MaxInt64, 1, 1, math.MaxInt64, true},
+		{math.MinInt64, 1, 1, math.MinInt64, true},
+		{math.MinInt64, -1, 1, math.MaxInt64, false},
+		{math.MaxInt64, -1, 1, -math.MaxInt64, true},
+		{1 << 32, 1 << 31, 1, math.MaxInt64, false},
+		{1 << 32, -(1 << 31), 1, math.MinInt64, true},
+		{1 << 32, 1 << 31, 2, 1 << 62, true},
+		{math.MaxInt64, math.MaxInt64, math.MaxInt64, math.MaxInt64, true},
+		{math.MaxInt64, math.MaxInt64, math.MaxInt64 - 1, math.MaxInt64, false},
+		{math.MinInt64, math.MinInt64, math.MaxInt64, math.MaxInt64, false},
+		{-7, 3, 2, -10, true},
+		{0, math.MaxInt64, 1, 0, true},
+	}
+	for _, c := range cases {
+		n, ok := Notional(c.size, c.price, c.qtyScale)
+		assert.Equal(t, c.ok, ok, "%d * %d / %d", c.size, c.price, c.qtyScale)
+		assert.Equal(t, c.notional, n, "%d * %d / %d", c.size, c.price, c.qtyScale)
+	}
+}
+
+func TestInstrument_QtyScale(t *testing.T) {
+	ins := &Instrument{Symbol: "BTC_USDT", TickSize: ONE / 100, LotSize: ONE / 1000, QtyScale: ONE, MinNotional: 10 * ONE}
+	assert.Nil(t, ins.Validate())
+	// 0.5 at 10 is below the minimum notional, 1 at 10 is not
+	assert.Equal(t, REJECT_NOTIONAL_TOO_SMALL, ins.CheckOrder(&KernelOrder{Amount: ONE / 2, Price: 10 * ONE}))
+	assert.Equal(t, REJECT_NONE, ins.CheckOrder(&KernelOrder{Amount: ONE, Price: 10 * ONE}))
+	// a notional too large to represent is not too small
+	assert.Equal(t, REJECT_NONE, ins.CheckOrder(&KernelOrder{Amount: math.MaxInt64 / ins.LotSize * ins.LotSize, Price: math.MaxInt64 / ins.TickSize * ins.TickSize}))
+
+	defaults := testInstrument()
+	assert.Nil(t, defaults.Validate())
+	assert.Equal(t, int64(1), defaults.QtyScale)
+	assert.NotNil(t, (&Instrument{Symbol: "A", TickSize: 1, LotSize: 1, QtyScale: -1}).Validate())
+	// one lot at one tick must be worth whole raw units
+	assert.NotNil(t, (&Instrument{Symbol: "A", TickSize: 10, LotSize: 10, QtyScale: 1000}).Validate())
+	assert.Nil(t, (&Instrument{Symbol: "A", TickSize: 100, LotSize: 10, QtyScale: 1000}).Validate())
+	assert.Nil(t, (&Instrument{Symbol: "A", TickSize: math.MaxInt64, LotSize: math.MaxInt64, QtyScale: math.MaxInt64}).Validate())
+}
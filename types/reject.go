@@ -0,0 +1,63 @@
+package types
+
+import "fmt"
+
+// RejectReason tells why the acceptor refused an order.
+type RejectReason uint8
+
+const (
+	REJECT_NONE                 RejectReason = iota
+	REJECT_INVALID_PRICE                     /* price is not positive */
+	REJECT_OFF_TICK                          /* price is not a multiple of the tick size */
+	REJECT_OFF_LOT                           /* size is not a multiple of the lot size */
+	REJECT_QTY_TOO_SMALL                     /* size is below the instrument minimum */
+	REJECT_QTY_TOO_LARGE                     /* size is above the instrument maximum */
+	REJECT_NOTIONAL_TOO_SMALL                /* size * price is below the instrument minimum notional */
+	REJECT_SESSION_CLOSED                    /* the session of the order is unknown or expired */
+	REJECT_NO_PEG_REFERENCE                  /* the reference price of a pegged order is missing */
+	REJECT_INVALID_QUOTE_BUDGET              /* the quote budget is negative, set on a sell or FOK order, or missing on a market order */
+	REJECT_POC_QUOTE_BUDGET                  /* a post-only order can't have a quote budget */
+	REJECT_RISK_MAX_QTY                      /* size is above the pre-trade risk limit */
+	REJECT_RISK_MAX_NOTIONAL                 /* size * price, or the quote budget, is above the pre-trade risk limit */
+	REJECT_RISK_PRICE_COLLAR                 /* price is too far through the opposite best price */
+	REJECT_RISK_MAX_OPEN_ORDERS              /* the account already has the maximum number of open orders */
+	REJECT_RISK_ACCOUNT_KILLED               /* the kill switch of the account is on */
+	REJECT_RISK_CUSTOM                       /* refused by a custom pre-trade risk check */
+	REJECT_INSUFFICIENT_FUNDS                /* the available balance can't back the order */
+	REJECT_PEG_LIMIT_REQUIRED                /* a pegged bid needs a PegLimit to reserve funds */
+	REJECT_NO_ACCOUNT                        /* the order has no account, which a ledger needs: account 0 is the fee account */
+	REJECT_THROTTLED                         /* the account or the session sent orders faster than its rate limit */
+	REJECT_NOTIONAL_OVERFLOW                 /* the worst-case notional of the order can't be represented */
+)
+
+var rejectReasonNames = [...]string{
+	REJECT_NONE:                 "none",
+	REJECT_INVALID_PRICE:        "invalid price",
+	REJECT_OFF_TICK:             "price off tick",
+	REJECT_OFF_LOT:              "size off lot",
+	REJECT_QTY_TOO_SMALL:        "size too small",
+	REJECT_QTY_TOO_LARGE:        "size too large",
+	REJECT_NOTIONAL_TOO_SMALL:   "notional too small",
+	REJECT_SESSION_CLOSED:       "session closed",
+	REJECT_NO_PEG_REFERENCE:     "no peg reference price",
+	REJECT_INVALID_QUOTE_BUDGET: "invalid quote budget",
+	REJECT_POC_QUOTE_BUDGET:     "post-only with quote budget",
+	REJECT_RISK_MAX_QTY:         "size above risk limit",
+	REJECT_RISK_MAX_NOTIONAL:    "notional above risk limit",
+	REJECT_RISK_PRICE_COLLAR:    "price outside collar",
+	REJECT_RISK_MAX_OPEN_ORDERS: "too many open orders",
+	REJECT_RISK_ACCOUNT_KILLED:  "account kill switch on",
+	REJECT_RISK_CUSTOM:          "refused by risk check",
+	REJECT_INSUFFICIENT_FUNDS:   "insufficient funds",
+	REJECT_PEG_LIMIT_REQUIRED:   "peg limit required",
+	REJECT_NO_ACCOUNT:           "no account",
+	REJECT_THROTTLED:            "throttled",
+	REJECT_NOTIONAL_OVERFLOW:    "notional too large",
+}
+
+func (r RejectReason) String() string {
+	if int(r) < len(rejectReasonNames) && rejectReasonNames[r] != "" {
+		return rejectReasonNames[r]
+	}
+	return fmt.Sprintf("reject reason %d", uint8(r))
+}
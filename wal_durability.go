@@ -0,0 +1,128 @@
+package ker
+
+import (
+	"log"
+	"time"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// WALDurability tells when the records written to the WAL are fsynced.
+type WALDurability uint8
+
+const (
+	// WAL_SYNC fsyncs every write before the order is applied, the default.
+	WAL_SYNC WALDurability = iota
+	// WAL_GROUP_COMMIT fsyncs the records of several orders at once, their acks and events are
+	// released only after the fsync.
+	WAL_GROUP_COMMIT
+	// WAL_ASYNC leaves the records to the page cache, a crash loses the orders written since the last
+	// rotation.
+	WAL_ASYNC
+)
+
+// walGroup counts the orders of a group commit, applied and written to the WAL but not yet fsynced, their
+// events are held by the kernel until the commit. It belongs to the primary acceptor goroutine.
+type walGroup struct {
+	pending    int  // orders whose events wait for the commit
+	records    int  // records written by the pending orders
+	collecting bool // whether the records being written are fsynced by commit
+	timer      *time.Timer
+}
+
+// add counts an order, written records if it was journaled. The first order of a group arms the timer
+// committing it.
+func (g *walGroup) add(records int) {
+	if g.pending == 0 {
+		if g.timer == nil {
+			g.timer = time.NewTimer(walGroupInterval)
+		} else {
+			g.timer.Reset(walGroupInterval)
+		}
+	}
+	g.pending++
+	g.records += records
+}
+
+// due returns the channel firing when the pending group must be committed, nil if there is none.
+func (g *walGroup) due() <-chan time.Time {
+	if g == nil || g.pending == 0 {
+		return nil
+	}
+	return g.timer.C
+}
+
+// grouped tells whether the WAL of the scheduler is written with group commit.
+func (s *scheduler) grouped() bool {
+	if !saveOrderLog {
+		return false
+	}
+	if s.sharedLog != nil {
+		return s.sharedLog.durability == WAL_GROUP_COMMIT
+	}
+	return s.wal.durability == WAL_GROUP_COMMIT
+}
+
+// syncLog fsyncs the WAL if it is written with group commit, so that the acks of what was written can
+// be released. It returns false if the fsync failed.
+func (s *scheduler) syncLog() bool {
+	if !s.grouped() {
+		return true
+	}
+	var err error
+	if s.sharedLog != nil {
+		err = s.sharedLog.sync()
+	} else {
+		err = s.wal.sync()
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	return true
+}
+
+// acceptGrouped admits and applies an order, its events are held until its record is fsynced, should
+// sync call. Orders are applied one at a time as the WAL replay does, so that each is admitted against
+// the book and balances left by the previous one.
+func (s *scheduler) acceptGrouped(order *types.KernelOrder) {
+	kernel := s.kernel
+	kernel.hold()
+	s.group.collecting = true
+	admitted, reason := s.admit(kernel, order, false, s.journal(false))
+	s.group.collecting = false
+	if reason != types.REJECT_NONE {
+		rejectOrder(kernel, order, reason)
+	}
+	if admitted != nil {
+		s.apply(kernel, admitted, s.orderReceivedChan)
+	}
+	if admitted == nil && s.group.pending == 0 {
+		// nothing to wait for
+		kernel.release()
+		return
+	}
+	records := 0
+	if admitted != nil {
+		records = 1
+	}
+	s.group.add(records)
+	if s.group.records >= walGroupRecords {
+		s.commit()
+	}
+}
+
+// commit fsyncs the records of the pending group, then releases the events of its orders in order,
+// should sync call.
+func (s *scheduler) commit() {
+	if s.group.pending == 0 {
+		return
+	}
+	s.group.timer.Stop()
+	if !s.syncLog() {
+		log.Panicln("Error in syncing order log.")
+	}
+	s.group.pending = 0
+	s.group.records = 0
+	s.kernel.release()
+}
@@ -0,0 +1,202 @@
+package ker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// setTestDurability logs to a temporary directory with the given durability.
+func setTestDurability(t testing.TB, mode WALDurability, maxRecords int, maxWait time.Duration) {
+	originalPath, originalSave := kernelOrderLogPath, saveOrderLog
+	originalMode, originalRecords, originalWait := walDurability, walGroupRecords, walGroupInterval
+	kernelOrderLogPath = t.TempDir() + "/"
+	saveOrderLog = true
+	SetWALDurability(mode, maxRecords, maxWait)
+	t.Cleanup(func() {
+		kernelOrderLogPath, saveOrderLog = originalPath, originalSave
+		SetWALDurability(originalMode, originalRecords, originalWait)
+	})
+}
+
+func assertNoAck(t *testing.T, acceptor *scheduler) {
+	select {
+	case order := <-acceptor.orderReceivedChan:
+		assert.Fail(t, "ack released before the group commit", "%+v", order)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func Test_orderAcceptor_GroupCommitByRecords(t *testing.T) {
+	setTestDurability(t, WAL_GROUP_COMMIT, 3, time.Hour)
+	acceptor := initAcceptor(1, "test_group_records")
+	acceptor.kernel.startDummyMatchedInfoChan()
+	go acceptor.orderAcceptor()
+	defer acceptor.kernel.Stop()
+
+	acceptor.newOrderChan <- newTestBidOrder(100, 1)
+	acceptor.newOrderChan <- newTestBidOrder(101, 1)
+	assertNoAck(t, acceptor)
+	// the orders are written and applied, their acks wait for the commit
+	assert.Equal(t, uint64(2), acceptor.wal.seq)
+	assert.Equal(t, 2, acceptor.kernel.bid.Length)
+
+	acceptor.newOrderChan <- newTestBidOrder(102, 1)
+	for i := int64(0); i < 3; i++ {
+		assert.Equal(t, 100+i, (<-acceptor.orderReceivedChan).Price)
+	}
+	assert.Equal(t, int64(102), acceptor.kernel.bid1Price)
+}
+
+func Test_orderAcceptor_GroupCommitByTime(t *testing.T) {
+	setTestDurability(t, WAL_GROUP_COMMIT, 100, 5*time.Millisecond)
+	acceptor := initAcceptor(1, "test_group_time")
+	acceptor.kernel.startDummyMatchedInfoChan()
+	go acceptor.orderAcceptor()
+	defer acceptor.kernel.Stop()
+
+	for round := int64(0); round < 2; round++ {
+		st := time.Now()
+		acceptor.newOrderChan <- newTestBidOrder(100+round, 1)
+		assert.Equal(t, 100+round, (<-acceptor.orderReceivedChan).Price)
+		assert.GreaterOrEqual(t, time.Since(st), 5*time.Millisecond)
+	}
+}
+
+func Test_orderAcceptor_GroupCommitOrdering(t *testing.T) {
+	setTestDurability(t, WAL_GROUP_COMMIT, 100, time.Hour)
+	acceptor := initAcceptor(1, "test_group_ordering")
+	acceptor.startDummyOrderReceivedChan()
+	acceptor.risk.setLimits(RiskLimits{MaxQty: 10})
+	go acceptor.orderAcceptor()
+	defer acceptor.kernel.Stop()
+
+	// a reject waits for the orders accepted before it
+	acceptor.newOrderChan <- newTestBidOrder(100, 1)
+	acceptor.newOrderChan <- newTestBidOrder(100, 20)
+	select {
+	case mi := <-acceptor.kernel.matchedInfoChan:
+		assert.Fail(t, "event released before the group commit", "%+v", mi)
+	case err := <-acceptor.kernel.errorInfoChan:
+		assert.Fail(t, "reject released before the group commit", "%v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// a request commits the pending group first
+	go acceptor.requestMassCancel(&MassCancel{})
+	var reject *OrderRejectErr
+	assert.ErrorAs(t, <-acceptor.kernel.errorInfoChan, &reject)
+	assert.Equal(t, types.REJECT_RISK_MAX_QTY, reject.Reason)
+	assert.Eventually(t, func() bool { return acceptor.kernel.bid.Length == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(2), acceptor.wal.seq)
+}
+
+func Test_MatchingEngine_GroupCommitBatchAndShutdown(t *testing.T) {
+	setTestDurability(t, WAL_GROUP_COMMIT, 100, time.Hour)
+	engine := NewMatchingEngine(1, "test_engine_group_commit")
+	assert.Nil(t, engine.SetQueueDepth(10))
+	engine.Start()
+
+	engine.SubmitOrder(newTestBidOrder(100, 1))
+	assert.Eventually(t, func() bool { return engine.BidLength() == 1 }, time.Second, time.Millisecond)
+	// a batch is fsynced as a group of its own, after the pending one
+	acks, err := engine.SubmitBatch(t.Context(), []*types.KernelOrder{newTestBidOrder(101, 1)})
+	assert.Nil(t, err)
+	assert.True(t, acks[0].Accepted)
+	assert.Equal(t, 2, engine.BidLength())
+
+	// the pending group is committed by the shutdown
+	engine.SubmitOrder(newTestBidOrder(102, 1))
+	assert.Nil(t, engine.Shutdown(t.Context()))
+	assert.Equal(t, 3, engine.BidLength())
+	assert.Equal(t, []uint64{1, 2, 3}, replayTestSeqs(t, engine.s.wal))
+}
+
+func Test_MatchingEngine_GroupCommitLedger(t *testing.T) {
+	setTestDurability(t, WAL_GROUP_COMMIT, 100, time.Hour)
+	engine := NewMatchingEngine(1, "test_engine_group_ledger")
+	assert.Nil(t, engine.EnableLedger("BTC", "USDT"))
+	assert.Nil(t, engine.SetQueueDepth(10))
+	engine.Start()
+	assert.Nil(t, engine.Deposit(1, "USDT", 1000))
+	assert.Nil(t, engine.Deposit(2, "BTC", 20))
+
+	// the first bid reserves 1000 and fills at 90, the second one is only backed by what the fill gave back
+	engine.SubmitOrder(&types.KernelOrder{Amount: -20, Price: 90, Left: -20, AccountID: 2})
+	engine.SubmitOrder(&types.KernelOrder{Amount: 10, Price: 100, Left: 10, AccountID: 1})
+	engine.SubmitOrder(&types.KernelOrder{Amount: 1, Price: 100, Left: 1, AccountID: 1})
+	assert.Eventually(t, func() bool { return engine.s.wal.seq == 5 }, time.Second, time.Millisecond)
+	// a transfer commits the pending group
+	assert.Nil(t, engine.Deposit(3, "USDT", 1))
+	assert.Equal(t, Balance{Available: 10}, engine.Balance(1, "USDT"))
+	assert.Equal(t, Balance{Available: 11}, engine.Balance(1, "BTC"))
+	engine.Stop()
+}
+
+func Test_orderLog_Durability(t *testing.T) {
+	setTestDurability(t, WAL_ASYNC, 0, 0)
+	l := newOrderLog("test_async")
+	assert.Equal(t, WAL_ASYNC, l.durability)
+	writeTestOrders(t, l, 1, 3)
+	assert.Nil(t, l.close())
+	assert.Equal(t, []uint64{1, 2, 3}, replayTestSeqs(t, l))
+
+	// a log keeps the mode it was created with
+	SetWALDurability(WAL_SYNC, 0, 0)
+	assert.Equal(t, WAL_ASYNC, l.durability)
+	assert.Equal(t, WAL_SYNC, newOrderLog("test_sync").durability)
+}
+
+func replayTestSeqs(t *testing.T, l *orderLog) []uint64 {
+	var seqs []uint64
+	assert.Nil(t, readManifest(l.manifestPath(), walPosition{}, func(rec walRecord) {
+		seqs = append(seqs, rec.seq)
+	}))
+	return seqs
+}
+
+// go test -bench=BenchmarkWALDurability -run=none
+func BenchmarkWALDurability(b *testing.B) {
+	modes := []struct {
+		name string
+		mode WALDurability
+	}{
+		{"sync", WAL_SYNC},
+		{"group", WAL_GROUP_COMMIT},
+		{"async", WAL_ASYNC},
+	}
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			setTestDurability(b, m.mode, 64, 200*time.Microsecond)
+			acceptor := initAcceptor(1, fmt.Sprintf("bench_%s", m.name))
+			acceptor.newOrderChan = make(chan *types.KernelOrder, 1024)
+			acceptor.kernel.startDummyMatchedInfoChan()
+			go acceptor.orderAcceptor()
+			defer acceptor.kernel.Stop()
+
+			// acks come in submission order, the latency of an order is the time to its ack
+			sent := make([]time.Time, b.N)
+			done := make(chan time.Duration)
+			go func() {
+				var total time.Duration
+				for i := 0; i < b.N; i++ {
+					<-acceptor.orderReceivedChan
+					total += time.Since(sent[i])
+				}
+				done <- total
+			}()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sent[i] = time.Now()
+				acceptor.newOrderChan <- newTestBidOrder(int64(100+i%1000), 1)
+			}
+			total := <-done
+			b.StopTimer()
+			b.ReportMetric(float64(total.Nanoseconds())/float64(b.N), "ns-ack-latency/op")
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package ker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/Curton/GoMatchingKernel/types"
+)
+
+// ErrCorruptWAL is returned when a WAL record fails its checks, the records after it are not replayed.
+var ErrCorruptWAL = errors.New("corrupt WAL")
+
+// Every WAL record is a little-endian header followed by its payload:
+//
+//	magic    uint32  walMagic
+//	version  uint8   walVersion
+//	type     uint8   walRecordType
+//	reserved uint16
+//	length   uint32  payload length
+//	sequence uint64  1 for the first record of a log, then incremented by one across its segments
+//	crc      uint32  CRC32C of the header bytes before it and of the payload
+const (
+	walHeaderSize        = 24
+	walMagic      uint32 = 0x574b4d47 // "GMKW"
+	walVersion    uint8  = 1
+)
+
+// walRecordType tells how the payload of a WAL record is encoded.
+type walRecordType uint8
+
+const (
+	walOrder       walRecordType = iota + 1 // a binary KernelOrder
+	walSymbolOrder                          // a symbol padded to symbolSize bytes, then a binary KernelOrder
+	walQuote                                // a walOrder record written by a mass quote
+	walSymbolQuote                          // a walSymbolOrder record written by a mass quote
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+	// size of a binary KernelOrder
+	orderBinarySize = binary.Size(types.KernelOrder{})
+)
+
+// payloadSize returns the payload length of a record type, 0 for an unknown type.
+func (t walRecordType) payloadSize() int {
+	switch t {
+	case walOrder, walQuote:
+		return orderBinarySize
+	case walSymbolOrder, walSymbolQuote:
+		return symbolSize + orderBinarySize
+	}
+	return 0
+}
+
+// appendWALRecord appends a framed record to b.
+func appendWALRecord(b []byte, t walRecordType, seq uint64, payload []byte) []byte {
+	var h [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(h[0:], walMagic)
+	h[4] = walVersion
+	h[5] = byte(t)
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(h[12:], seq)
+	crc := crc32.Update(crc32.Checksum(h[:20], castagnoli), castagnoli, payload)
+	binary.LittleEndian.PutUint32(h[20:], crc)
+	return append(append(b, h[:]...), payload...)
+}
+
+// walRecord is a record read from a WAL file, its payload is only valid until the next read.
+type walRecord struct {
+	typ     walRecordType
+	seq     uint64
+	payload []byte
+}
+
+// order decodes the payload of a record, symbol is empty for a walOrder or walQuote record.
+func (r walRecord) order() (symbol string, order *types.KernelOrder) {
+	b := r.payload
+	if r.typ == walSymbolOrder || r.typ == walSymbolQuote {
+		symbol = string(bytes.TrimRight(b[:symbolSize], "\x00"))
+		b = b[symbolSize:]
+	}
+	return symbol, readOrderBinary(b)
+}
+
+// quote tells whether the record was written by a mass quote, an order it places is a quote of its account.
+func (r walRecord) quote() bool {
+	return r.typ == walQuote || r.typ == walSymbolQuote
+}
+
+// walReader reads the records of a WAL file in write order, the file may still be appended to.
+type walReader struct {
+	r       io.ReaderAt
+	off     int64  // offset of the next record
+	seq     uint64 // sequence of the last record read
+	started bool   // whether seq is known, the next record must then follow it
+	header  [walHeaderSize]byte
+	payload []byte
+}
+
+// newWALReader reads a WAL file from its start, the file may be any segment of its log.
+func newWALReader(r io.ReaderAt) *walReader {
+	return &walReader{r: r}
+}
+
+// resumeWALReader reads a WAL segment whose first record must follow the record seq.
+func resumeWALReader(r io.ReaderAt, seq uint64) *walReader {
+	return &walReader{r: r, seq: seq, started: true}
+}
+
+// next returns the next record. At the end of the file it returns io.EOF, also when the last record is
+// truncated: a later call returns it once it is completely written. A record failing its checks is
+// reported as ErrCorruptWAL and the reader doesn't move past it.
+func (w *walReader) next() (walRecord, error) {
+	h := w.header[:]
+	if _, err := w.r.ReadAt(h, w.off); err != nil {
+		return walRecord{}, err
+	}
+	if magic := binary.LittleEndian.Uint32(h[0:]); magic != walMagic {
+		return walRecord{}, w.corrupt("bad magic %#x", magic)
+	}
+	if h[4] != walVersion {
+		return walRecord{}, w.corrupt("unsupported version %d", h[4])
+	}
+	t := walRecordType(h[5])
+	length := binary.LittleEndian.Uint32(h[8:])
+	if t.payloadSize() == 0 {
+		return walRecord{}, w.corrupt("unknown record type %d", t)
+	}
+	if int(length) != t.payloadSize() {
+		return walRecord{}, w.corrupt("record type %d with length %d", t, length)
+	}
+	if cap(w.payload) < int(length) {
+		w.payload = make([]byte, length)
+	}
+	payload := w.payload[:length]
+	if _, err := w.r.ReadAt(payload, w.off+walHeaderSize); err != nil {
+		return walRecord{}, err
+	}
+	if crc := crc32.Update(crc32.Checksum(h[:20], castagnoli), castagnoli, payload); crc != binary.LittleEndian.Uint32(h[20:]) {
+		return walRecord{}, w.corrupt("checksum mismatch")
+	}
+	seq := binary.LittleEndian.Uint64(h[12:])
+	if seq == 0 || (w.started && seq != w.seq+1) {
+		return walRecord{}, w.corrupt("sequence %d after %d", seq, w.seq)
+	}
+	w.off += walHeaderSize + int64(length)
+	w.seq = seq
+	w.started = true
+	return walRecord{typ: t, seq: seq, payload: payload}, nil
+}
+
+func (w *walReader) corrupt(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: record %d at offset %d: %s", ErrCorruptWAL, w.seq+1, w.off, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,130 @@
+package ker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testWALRecords(n int) []byte {
+	var b []byte
+	for i := 1; i <= n; i++ {
+		order := newTestBidOrder(int64(100+i), int64(i))
+		order.KernelOrderID = uint64(i)
+		payload := make([]byte, symbolSize)
+		copy(payload, "AAA")
+		b = appendWALRecord(b, walSymbolOrder, uint64(i), append(payload, getOrderBinary(order)...))
+	}
+	return b
+}
+
+func Test_walReader_RoundTrip(t *testing.T) {
+	b := testWALRecords(3)
+	assert.Equal(t, 3*(walHeaderSize+symbolSize+orderBinarySize), len(b))
+
+	r := newWALReader(bytes.NewReader(b))
+	for i := 1; i <= 3; i++ {
+		rec, err := r.next()
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i), rec.seq)
+		symbol, order := rec.order()
+		assert.Equal(t, "AAA", symbol)
+		assert.Equal(t, uint64(i), order.KernelOrderID)
+		assert.Equal(t, int64(100+i), order.Price)
+	}
+	_, err := r.next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_walReader_TruncatedTail(t *testing.T) {
+	b := testWALRecords(2)
+	size := len(b) / 2
+	// a torn write of the second record is the end of the log, not a corruption
+	for n := size; n < len(b); n++ {
+		r := newWALReader(bytes.NewReader(b[:n]))
+		_, err := r.next()
+		assert.Nil(t, err)
+		_, err = r.next()
+		assert.Equal(t, io.EOF, err, "%d bytes", n)
+		assert.Equal(t, int64(size), r.off)
+	}
+}
+
+func Test_walReader_BitFlip(t *testing.T) {
+	b := testWALRecords(2)
+	size := len(b) / 2
+	for i := size; i < len(b); i++ {
+		for bit := 0; bit < 8; bit++ {
+			flipped := append([]byte(nil), b...)
+			flipped[i] ^= 1 << bit
+			r := newWALReader(bytes.NewReader(flipped))
+			_, err := r.next()
+			assert.Nil(t, err)
+			_, err = r.next()
+			assert.ErrorIs(t, err, ErrCorruptWAL, "byte %d bit %d", i, bit)
+			// the reader doesn't move past the corrupted record
+			assert.Equal(t, int64(size), r.off)
+		}
+	}
+}
+
+func Test_walReader_Corruption(t *testing.T) {
+	order := getOrderBinary(newTestBidOrder(100, 1))
+	cases := map[string][]byte{
+		"sequence gap":     appendWALRecord(appendWALRecord(nil, walOrder, 1, order), walOrder, 3, order),
+		"zero sequence":    appendWALRecord(nil, walOrder, 0, order),
+		"unknown type":     appendWALRecord(nil, walRecordType(9), 1, order),
+		"length mismatch":  appendWALRecord(nil, walOrder, 1, order[:len(order)-1]),
+		"record type swap": appendWALRecord(nil, walSymbolOrder, 1, order),
+		"raw order":        append(order, order...),
+	}
+	version := appendWALRecord(nil, walOrder, 1, order)
+	version[4] = walVersion + 1
+	cases["version"] = version
+	for name, b := range cases {
+		r := newWALReader(bytes.NewReader(b))
+		_, err := r.next()
+		for err == nil {
+			_, err = r.next()
+		}
+		assert.ErrorIs(t, err, ErrCorruptWAL, name)
+	}
+	assert.Equal(t, uint64(walMagic), uint64(binary.LittleEndian.Uint32([]byte("GMKW"))))
+}
+
+func Test_readSharedOrderLog_Corruption(t *testing.T) {
+	path := t.TempDir() + "/shared.log"
+	b := testWALRecords(3)
+	size := len(b) / 3
+
+	// a torn last record is dropped
+	assert.Nil(t, os.WriteFile(path, b[:len(b)-1], 0644))
+	var ids []uint64
+	assert.Nil(t, readSharedOrderLog(path, func(rec walRecord) {
+		_, order := rec.order()
+		ids = append(ids, order.KernelOrderID)
+	}))
+	assert.Equal(t, []uint64{1, 2}, ids)
+
+	// the records after a corrupted one are not replayed
+	b[size+walHeaderSize+symbolSize] ^= 1
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+	ids = nil
+	err := readSharedOrderLog(path, func(rec walRecord) {
+		_, order := rec.order()
+		ids = append(ids, order.KernelOrderID)
+	})
+	assert.True(t, errors.Is(err, ErrCorruptWAL))
+	assert.Equal(t, []uint64{1}, ids)
+
+	x, err := NewExchange(1, "test_exchange_wal_corrupt", newTestInstruments("AAA"))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, x.Recover(path), ErrCorruptWAL)
+	bid, _ := x.BestBid("AAA")
+	assert.Equal(t, int64(101), bid)
+}
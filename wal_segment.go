@@ -0,0 +1,409 @@
+package ker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// extension of the manifest of a WAL, the manifest of a WAL named desc is desc + walManifestExt
+const walManifestExt = ".manifest"
+
+// walManifest lists the segment files of a WAL in sequence order, it is rewritten atomically on every
+// change. It outlives the process: a restart continues the sequence in a new segment.
+type walManifest struct {
+	Segments []walSegment `json:"segments"`
+	// Sequence covered by the snapshot the deleted segments were retained for
+	SnapshotSeq uint64 `json:"snapshot_seq,omitempty"`
+}
+
+// walSegment is a WAL file holding the records FirstSeq to LastSeq.
+type walSegment struct {
+	// File name in the log directory
+	File     string `json:"file"`
+	FirstSeq uint64 `json:"first_seq"`
+	// FirstSeq - 1 while empty, final once sealed
+	LastSeq uint64 `json:"last_seq"`
+	// A sealed segment is never written again
+	Sealed bool `json:"sealed"`
+	// Creation time, unix seconds
+	Created int64 `json:"created"`
+}
+
+// walPosition is the place of a record in a WAL: its sequence, the segment holding it and the offset
+// after it. A position without File is only known by its sequence.
+type walPosition struct {
+	Seq    uint64
+	File   string
+	Offset int64
+}
+
+// orderLog is the WAL of an acceptor, or of an Exchange when shared. Records are appended to the active
+// segment, which is sealed and replaced once it reaches walSegmentSize bytes or walSegmentAge.
+type orderLog struct {
+	f           *[1]*os.File // active segment, nil until the first write
+	description string
+	dir         string    // log directory, set on the first write
+	seq         uint64    // sequence of the last record written
+	size        int64     // bytes written to the active segment
+	opened      time.Time // creation time of the active segment
+	loaded      bool      // whether the manifest was read from disk
+	durability  WALDurability
+	mux         sync.Mutex // guards manifest, the redo reader and retention read it concurrently
+	manifest    walManifest
+}
+
+func newOrderLog(description string) *orderLog {
+	return &orderLog{
+		f:           &[1]*os.File{nil},
+		description: description,
+		durability:  walDurability,
+	}
+}
+
+// write frames payloads as records of type t and appends them with one write, rotating the active
+// segment first if it is due. seq only advances if the write succeeded.
+func (l *orderLog) write(t walRecordType, payloads ...[]byte) bool {
+	if l.f[0] != nil && l.due() {
+		if err := l.rotate(); err != nil {
+			log.Println(err.Error())
+			return false
+		}
+	}
+	if l.f[0] == nil {
+		if err := l.open(); err != nil {
+			log.Println(err.Error())
+			return false
+		}
+	}
+	b := make([]byte, 0, len(payloads)*(walHeaderSize+t.payloadSize()))
+	for i, payload := range payloads {
+		b = appendWALRecord(b, t, l.seq+uint64(i)+1, payload)
+	}
+	if _, err := l.f[0].Write(b); err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	l.seq += uint64(len(payloads))
+	l.size += int64(len(b))
+	return true
+}
+
+// due tells whether the active segment is large or old enough to be rotated.
+func (l *orderLog) due() bool {
+	return (walSegmentSize > 0 && l.size >= walSegmentSize) ||
+		(walSegmentAge > 0 && time.Since(l.opened) >= walSegmentAge)
+}
+
+// open creates a new active segment and lists it in the manifest before anything is written to it.
+func (l *orderLog) open() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err := l.prepare(); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := l.description + "_" + strconv.FormatInt(now.Unix(), 10) + "_" + strconv.FormatUint(l.seq+1, 10) + ".log"
+	flag := os.O_APPEND | os.O_CREATE | os.O_RDWR
+	if l.durability == WAL_SYNC {
+		flag |= os.O_SYNC
+	}
+	f, err := os.OpenFile(filepath.Join(l.dir, name), flag, 0644)
+	if err != nil {
+		return err
+	}
+	l.manifest.Segments = append(l.manifest.Segments, walSegment{File: name, FirstSeq: l.seq + 1, LastSeq: l.seq, Created: now.Unix()})
+	if err := l.saveManifest(); err != nil {
+		l.manifest.Segments = l.manifest.Segments[:len(l.manifest.Segments)-1]
+		_ = f.Close()
+		return err
+	}
+	l.f[0] = f
+	l.size = 0
+	l.opened = now
+	return nil
+}
+
+// resume reads the manifest left by a previous run before anything is written, so that seq is the
+// sequence of the last record already in the log.
+func (l *orderLog) resume() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.prepare()
+}
+
+// prepare fixes the log directory and reads the manifest once, should hold mux.
+func (l *orderLog) prepare() error {
+	if l.loaded {
+		return nil
+	}
+	l.dir = kernelOrderLogPath
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return err
+	}
+	if err := l.load(); err != nil {
+		return err
+	}
+	l.loaded = true
+	return nil
+}
+
+// load reads the manifest left by a previous run, if any. A segment left unsealed by a crash is sealed
+// after its last complete record, the sequence continues after it.
+func (l *orderLog) load() error {
+	b, err := os.ReadFile(l.manifestPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &l.manifest); err != nil {
+		return err
+	}
+	l.seq = l.manifest.SnapshotSeq
+	for i := range l.manifest.Segments {
+		seg := &l.manifest.Segments[i]
+		if !seg.Sealed {
+			seg.LastSeq = l.scan(*seg)
+			seg.Sealed = true
+		}
+		l.seq = max(l.seq, seg.LastSeq)
+	}
+	return nil
+}
+
+// scan returns the sequence of the last complete record of a segment.
+func (l *orderLog) scan(seg walSegment) uint64 {
+	b, err := os.ReadFile(filepath.Join(l.dir, seg.File))
+	if err != nil {
+		log.Println(err.Error())
+		return seg.FirstSeq - 1
+	}
+	r := resumeWALReader(bytes.NewReader(b), seg.FirstSeq-1)
+	for {
+		if _, err := r.next(); err != nil {
+			if err != io.EOF {
+				// the records after it are not replayed anyway, new ones go to a new segment
+				log.Println(seg.File, ":", err.Error())
+			}
+			return r.seq
+		}
+	}
+}
+
+// rotate seals the active segment, the next write opens a new one.
+func (l *orderLog) rotate() error {
+	if err := l.close(); err != nil {
+		return err
+	}
+	l.f[0] = nil
+	return nil
+}
+
+// sync fsyncs the active segment, the sealed ones were fsynced when sealed.
+func (l *orderLog) sync() error {
+	if l.f[0] == nil {
+		return nil
+	}
+	return l.f[0].Sync()
+}
+
+// close fsyncs, seals and closes the active segment, if it was ever created.
+func (l *orderLog) close() error {
+	if l.f[0] == nil {
+		return nil
+	}
+	if err := l.f[0].Sync(); err != nil {
+		_ = l.f[0].Close()
+		return err
+	}
+	if err := l.f[0].Close(); err != nil {
+		return err
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	seg := &l.manifest.Segments[len(l.manifest.Segments)-1]
+	if seg.Sealed {
+		return nil
+	}
+	seg.LastSeq = l.seq
+	seg.Sealed = true
+	return l.saveManifest()
+}
+
+// retain deletes the sealed segments whose records are all covered by a durable snapshot taken at seq.
+// The manifest stops listing them before their files are deleted.
+func (l *orderLog) retain(seq uint64) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	var keep, drop []walSegment
+	for _, seg := range l.manifest.Segments {
+		if seg.Sealed && seg.LastSeq <= seq {
+			drop = append(drop, seg)
+		} else {
+			keep = append(keep, seg)
+		}
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+	all, snapshotSeq := l.manifest.Segments, l.manifest.SnapshotSeq
+	l.manifest.Segments = keep
+	l.manifest.SnapshotSeq = max(snapshotSeq, seq)
+	if err := l.saveManifest(); err != nil {
+		l.manifest.Segments, l.manifest.SnapshotSeq = all, snapshotSeq
+		return err
+	}
+	for _, seg := range drop {
+		if err := os.Remove(filepath.Join(l.dir, seg.File)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentAfter returns the segment following the one stored in file for a reader that read file up to
+// the record seq, false if there is none yet or if records written to file before its rotation are unread.
+func (l *orderLog) segmentAfter(file string, seq uint64) (walSegment, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for i, seg := range l.manifest.Segments {
+		if seg.File == file && i+1 < len(l.manifest.Segments) {
+			next := l.manifest.Segments[i+1]
+			return next, seq+1 >= next.FirstSeq
+		}
+	}
+	return walSegment{}, false
+}
+
+// position returns the position of the last record written. The file is only known once a segment was
+// opened by this process, a restarted log knows the sequence only.
+func (l *orderLog) position() walPosition {
+	if l.opened.IsZero() {
+		return walPosition{Seq: l.seq}
+	}
+	return walPosition{Seq: l.seq, File: l.active().File, Offset: l.size}
+}
+
+// active returns the active segment, it must have been opened.
+func (l *orderLog) active() walSegment {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.manifest.Segments[len(l.manifest.Segments)-1]
+}
+
+func (l *orderLog) manifestPath() string {
+	return filepath.Join(l.dir, l.description+walManifestExt)
+}
+
+// saveManifest replaces the manifest file atomically, should hold mux.
+func (l *orderLog) saveManifest() error {
+	b, err := json.Marshal(&l.manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.dir, l.description+walManifestExt, b)
+}
+
+// writeFileAtomic writes b to a temporary file of dir, fsyncs it and renames it to name, then fsyncs dir
+// so that the rename is durable. Readers see the previous file or the complete new one.
+func writeFileAtomic(dir, name string, b []byte) error {
+	tmp, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readManifest calls fn with every record of the segments listed in a manifest following the record
+// from, in sequence order. The segment of from is read from its offset if it is still listed, the
+// records are looked up by sequence otherwise. A truncated record ends its segment, a missing segment
+// or a sequence gap is reported as ErrCorruptWAL.
+func readManifest(path string, from walPosition, fn func(rec walRecord)) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var m walManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	segments, seq, off, resumed := m.Segments, from.Seq, int64(0), false
+	for i, seg := range m.Segments {
+		if from.File != "" && seg.File == from.File && seg.FirstSeq <= from.Seq+1 {
+			segments, off, resumed = m.Segments[i:], from.Offset, true
+			break
+		}
+	}
+	if !resumed && len(segments) != 0 {
+		if segments[0].FirstSeq > from.Seq+1 {
+			return fmt.Errorf("%w: %s starts at record %d after %d", ErrCorruptWAL, segments[0].File, segments[0].FirstSeq, from.Seq)
+		}
+		seq = segments[0].FirstSeq - 1
+	}
+	for i, seg := range segments {
+		if seg.FirstSeq != seq+1 && !(resumed && i == 0) {
+			return fmt.Errorf("%w: %s starts at record %d after %d", ErrCorruptWAL, seg.File, seg.FirstSeq, seq)
+		}
+		f, err := os.Open(filepath.Join(filepath.Dir(path), seg.File))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrCorruptWAL, err)
+		}
+		r := resumeWALReader(f, seq)
+		if resumed && i == 0 {
+			r.off = off
+		}
+		for {
+			rec, err := r.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				_ = f.Close()
+				return err
+			}
+			if rec.seq > from.Seq {
+				fn(rec)
+			}
+		}
+		_ = f.Close()
+		seq = r.seq
+		if seg.Sealed && seq != seg.LastSeq {
+			return fmt.Errorf("%w: %s ends at record %d instead of %d", ErrCorruptWAL, seg.File, seq, seg.LastSeq)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package ker
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setTestWAL logs to a temporary directory, rotating segments every n records.
+func setTestWAL(t *testing.T, n int64) string {
+	dir := t.TempDir() + "/"
+	originalPath, originalSize, originalAge, originalRetention := kernelOrderLogPath, walSegmentSize, walSegmentAge, walRetention
+	kernelOrderLogPath = dir
+	SetWALRotation(n*int64(walHeaderSize+orderBinarySize), 0)
+	t.Cleanup(func() {
+		kernelOrderLogPath = originalPath
+		SetWALRotation(originalSize, originalAge)
+		SetWALRetention(originalRetention)
+	})
+	return dir
+}
+
+func readTestManifest(t *testing.T, path string) walManifest {
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	var m walManifest
+	assert.Nil(t, json.Unmarshal(b, &m))
+	return m
+}
+
+func writeTestOrders(t *testing.T, l *orderLog, from, to int) {
+	for i := from; i <= to; i++ {
+		order := newTestBidOrder(100, 1)
+		order.KernelOrderID = uint64(i)
+		assert.True(t, writeOrderLog(l, order))
+	}
+}
+
+func replayTestManifest(t *testing.T, path string, from walPosition) []uint64 {
+	var ids []uint64
+	assert.Nil(t, readManifest(path, from, func(rec walRecord) {
+		_, order := rec.order()
+		ids = append(ids, order.KernelOrderID)
+	}))
+	return ids
+}
+
+func Test_orderLog_Rotation(t *testing.T) {
+	dir := setTestWAL(t, 2)
+	l := newOrderLog("test_rotation")
+	writeTestOrders(t, l, 1, 5)
+
+	manifest := dir + "test_rotation" + walManifestExt
+	m := readTestManifest(t, manifest)
+	assert.Equal(t, 3, len(m.Segments))
+	for i, seg := range m.Segments[:2] {
+		assert.True(t, seg.Sealed)
+		assert.Equal(t, uint64(2*i+1), seg.FirstSeq)
+		assert.Equal(t, uint64(2*i+2), seg.LastSeq)
+	}
+	// the active segment is sealed on close
+	assert.False(t, m.Segments[2].Sealed)
+	assert.Nil(t, l.close())
+	m = readTestManifest(t, manifest)
+	assert.Equal(t, walSegment{File: m.Segments[2].File, FirstSeq: 5, LastSeq: 5, Sealed: true, Created: m.Segments[2].Created}, m.Segments[2])
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5}, replayTestManifest(t, manifest, walPosition{}))
+
+	// a segment file alone can be read too
+	var ids []uint64
+	assert.Nil(t, readSharedOrderLog(dir+m.Segments[1].File, func(rec walRecord) {
+		_, order := rec.order()
+		ids = append(ids, order.KernelOrderID)
+	}))
+	assert.Equal(t, []uint64{3, 4}, ids)
+
+	// rotation by age
+	SetWALRotation(0, time.Nanosecond)
+	l = newOrderLog("test_rotation_age")
+	writeTestOrders(t, l, 1, 3)
+	assert.Equal(t, 3, len(readTestManifest(t, dir+"test_rotation_age"+walManifestExt).Segments))
+}
+
+func Test_orderLog_Restart(t *testing.T) {
+	dir := setTestWAL(t, 0)
+	manifest := dir + "test_restart" + walManifestExt
+	l := newOrderLog("test_restart")
+	writeTestOrders(t, l, 1, 3)
+	assert.Nil(t, l.close())
+
+	// a restart continues the sequence in a new segment
+	l = newOrderLog("test_restart")
+	writeTestOrders(t, l, 4, 5)
+	// crash with a torn write
+	_, err := l.f[0].Write(appendWALRecord(nil, walOrder, 6, getOrderBinary(newTestBidOrder(100, 1)))[:30])
+	assert.Nil(t, err)
+	assert.Nil(t, l.f[0].Close())
+	assert.False(t, readTestManifest(t, manifest).Segments[1].Sealed)
+
+	// the unsealed segment is sealed after its last complete record
+	l = newOrderLog("test_restart")
+	writeTestOrders(t, l, 6, 6)
+	assert.Nil(t, l.close())
+	m := readTestManifest(t, manifest)
+	assert.Equal(t, 3, len(m.Segments))
+	assert.Equal(t, uint64(5), m.Segments[1].LastSeq)
+	assert.True(t, m.Segments[1].Sealed)
+	assert.Equal(t, uint64(6), m.Segments[2].FirstSeq)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, replayTestManifest(t, manifest, walPosition{}))
+
+	// a missing segment breaks the history
+	assert.Nil(t, os.Remove(dir+m.Segments[1].File))
+	assert.ErrorIs(t, readManifest(manifest, walPosition{}, func(walRecord) {}), ErrCorruptWAL)
+}
+
+func Test_orderLog_Retention(t *testing.T) {
+	dir := setTestWAL(t, 2)
+	manifest := dir + "test_retention" + walManifestExt
+	l := newOrderLog("test_retention")
+	writeTestOrders(t, l, 1, 5)
+	files := readTestManifest(t, manifest).Segments
+
+	// only the segments whose records are all covered go
+	assert.Nil(t, l.retain(3))
+	m := readTestManifest(t, manifest)
+	assert.Equal(t, files[1:], m.Segments)
+	assert.Equal(t, uint64(3), m.SnapshotSeq)
+	_, err := os.Stat(dir + files[0].File)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + files[1].File)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{4, 5}, replayTestManifest(t, manifest, walPosition{Seq: m.SnapshotSeq}))
+	assert.ErrorIs(t, readManifest(manifest, walPosition{}, func(walRecord) {}), ErrCorruptWAL)
+
+	// the active segment is kept until sealed
+	assert.Nil(t, l.retain(5))
+	assert.Equal(t, files[2:], readTestManifest(t, manifest).Segments)
+	assert.Nil(t, l.close())
+	assert.Nil(t, l.retain(5))
+	m = readTestManifest(t, manifest)
+	assert.Equal(t, 0, len(m.Segments))
+	assert.Equal(t, uint64(5), m.SnapshotSeq)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	// the sequence continues after the snapshot
+	l = newOrderLog("test_retention")
+	writeTestOrders(t, l, 6, 6)
+	assert.Equal(t, uint64(6), readTestManifest(t, manifest).Segments[0].FirstSeq)
+	assert.Nil(t, l.close())
+}
+
+func Test_MatchingEngine_ShutdownRetention(t *testing.T) {
+	dir := setTestWAL(t, 2)
+	SetWALRetention(true)
+	originalSnapshotPath := kernelSnapshotPath
+	kernelSnapshotPath = t.TempDir() + "/"
+	defer func() { kernelSnapshotPath = originalSnapshotPath }()
+
+	engine := NewMatchingEngine(1, "test_engine_retention")
+	engine.EnableShutdownSnapshot()
+	engine.Start()
+	for i := 0; i < 5; i++ {
+		engine.SubmitOrder(newTestBidOrder(int64(100+i), 1))
+	}
+	assert.Nil(t, engine.Shutdown(t.Context()))
+
+	// every segment is covered by the final snapshot
+	m := readTestManifest(t, dir+"test_engine_retention"+walManifestExt)
+	assert.Equal(t, 0, len(m.Segments))
+	assert.Equal(t, uint64(5), m.SnapshotSeq)
+	snapshots, err := filepath.Glob(kernelSnapshotPath + "test_engine_retention/*" + snapshotExt)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(snapshots))
+	snap, err := readSnapshot(snapshots[0])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), snap.Position.WAL.Seq)
+}
+
+func Test_Exchange_RecoverManifest(t *testing.T) {
+	dir := setTestWAL(t, 1)
+
+	x, err := NewExchange(1, "test_exchange_segments", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	x.Start()
+	assert.Nil(t, x.SubmitOrder("AAA", newTestAskOrder(300, 10)))
+	assert.Nil(t, x.SubmitOrder("BBB", newTestBidOrder(100, 20)))
+	assert.Nil(t, x.SubmitOrder("AAA", newTestBidOrder(300, 4)))
+	<-x.Events()
+	assert.Nil(t, x.Shutdown(t.Context()))
+	expectA, _ := x.OrderBook("AAA")
+	expectB, _ := x.OrderBook("BBB")
+
+	manifest := dir + "test_exchange_segments" + walManifestExt
+	assert.Equal(t, 3, len(readTestManifest(t, manifest).Segments))
+	x2, err := NewExchange(1, "test_exchange_segments_2", newTestInstruments("AAA", "BBB"))
+	assert.Nil(t, err)
+	assert.Nil(t, x2.Recover(manifest))
+	gotA, _ := x2.OrderBook("AAA")
+	gotB, _ := x2.OrderBook("BBB")
+	assert.Equal(t, expectA, gotA)
+	assert.Equal(t, expectB, gotB)
+}
+
+func Test_orderLogReader_FollowsSegments(t *testing.T) {
+	setTestWAL(t, 1)
+	originalSnapshotPath := kernelSnapshotPath
+	kernelSnapshotPath = t.TempDir() + "/"
+	defer func() { kernelSnapshotPath = originalSnapshotPath }()
+
+	acceptor := initAcceptor(1, "test_redo_segments")
+	acceptor.startDummyOrderReceivedChan()
+	acceptor.kernel.startDummyMatchedInfoChan()
+	go acceptor.orderAcceptor()
+	acceptor.newOrderChan <- newTestAskOrder(300, 10)
+	assert.Eventually(t, func() bool { return acceptor.wal.seq == 1 }, time.Second, time.Millisecond)
+	acceptor.startRedoKernel()
+	assert.Eventually(t, func() bool { return acceptor.redoKernel.ask.Length == 1 }, time.Second, time.Millisecond)
+
+	// every order goes to a new segment
+	for i := 0; i < 4; i++ {
+		acceptor.newOrderChan <- newTestAskOrder(int64(290-i), 10)
+	}
+	assert.Eventually(t, func() bool {
+		return acceptor.redoKernel.ask.Length == 5 && acceptor.redoKernel.ask1Price == 287
+	}, 3*redoSnapshotInterval, 10*time.Millisecond)
+	assert.Equal(t, 5, len(acceptor.wal.manifest.Segments))
+	acceptor.kernel.Stop()
+	acceptor.redoKernel.Stop()
+}
+
+func Test_orderLog_segmentAfter(t *testing.T) {
+	setTestWAL(t, 2)
+	l := newOrderLog("test_segment_after")
+	writeTestOrders(t, l, 1, 1)
+	first := l.active()
+	_, ok := l.segmentAfter(first.File, 1)
+	assert.False(t, ok)
+
+	// a reader at the end of the first segment must read the record appended before the rotation first
+	writeTestOrders(t, l, 2, 3)
+	_, ok = l.segmentAfter(first.File, 1)
+	assert.False(t, ok)
+	next, ok := l.segmentAfter(first.File, 2)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), next.FirstSeq)
+	assert.Nil(t, l.close())
+}